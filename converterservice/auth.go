@@ -0,0 +1,154 @@
+// API key authentication for the ConverterService API. Callers send their key as
+// "authorization: Bearer <key>" metadata, which is checked against the hashed keys in the api_keys table
+package converterservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	db "github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+)
+
+// The metadata key holding the API key, and the scheme it is sent with
+const (
+	authorizationMetadata = "authorization"
+	bearerScheme          = "bearer "
+)
+
+// The number of random bytes in a generated API key
+const apiKeyBytes = 32
+
+// The context key under which the authenticated API key is stored
+type apiKeyContextKey struct{}
+
+// Checks the API key sent with each request
+type Authenticator struct {
+	repo db.FileConverterRepository
+}
+
+func NewAuthenticator(repo db.FileConverterRepository) *Authenticator {
+	return &Authenticator{repo: repo}
+}
+
+/*
+ * Rejects unary calls that do not carry an enabled API key
+ */
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+/*
+ * Rejects streams that do not carry an enabled API key
+ */
+func (a *Authenticator) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// A server stream whose context carries the authenticated API key
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+/*
+ * Looks up the API key sent with the request, returning a context holding the key.
+ * Missing, unknown and disabled keys are all Unauthenticated, so callers cannot probe which keys exist
+ */
+func (a *Authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	key := bearerToken(metadataValue(ctx, authorizationMetadata))
+	if key == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing API key")
+	}
+	apiKey, err := a.repo.GetApiKey(HashApiKey(key))
+	if err != nil {
+		log.Printf("failed to look up api key, encountered %v", err)
+		return nil, status.Error(codes.Internal, "an internal error occurred")
+	}
+	if apiKey == nil || !apiKey.Enabled {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if _, err := a.repo.RecordApiKeyUse(apiKey.Id); err != nil {
+		log.Printf("failed to record use of api key %s, encountered %v", apiKey.Id, err)
+	}
+	return context.WithValue(ctx, apiKeyContextKey{}, apiKey), nil
+}
+
+/*
+ * Returns the token from a bearer authorization value, or the empty string when the value is not one
+ */
+func bearerToken(authorization string) string {
+	if len(authorization) <= len(bearerScheme) || !strings.EqualFold(authorization[:len(bearerScheme)], bearerScheme) {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len(bearerScheme):])
+}
+
+/*
+ * Returns the API key the request was authenticated with, or nil if it was not
+ */
+func apiKeyFromContext(ctx context.Context) *db.ApiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*db.ApiKey)
+	return key
+}
+
+/*
+ * Returns the tenant of the API key the request was authenticated with. Requests made without a key,
+ * which are only accepted when keys are not required, share the empty tenant
+ */
+func tenantFromContext(ctx context.Context) string {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return key.Tenant
+	}
+	return ""
+}
+
+/*
+ * Returns the hex SHA-256 of an API key. Keys are random, so an unsalted hash is enough to keep them secret at rest
+ */
+func HashApiKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+/*
+ * Creates and stores a new enabled API key for the tenant, returning its id and the key itself.
+ * Only the hash is stored, so the key cannot be recovered afterwards
+ */
+func CreateApiKey(repo db.FileConverterRepository, name string, tenant string) (string, string, error) {
+	if tenant == "" {
+		return "", "", errors.New("api keys must belong to a tenant")
+	}
+	secret := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	id := uuid.New().String()
+	key := base64.RawURLEncoding.EncodeToString(secret)
+	if _, err := repo.CreateApiKey(id, name, tenant, HashApiKey(key)); err != nil {
+		return "", "", err
+	}
+	return id, key, nil
+}
@@ -0,0 +1,146 @@
+package converterservice_test
+
+import (
+	"context"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/mocks"
+	"github.com/reggiemcdonald/grpc-audio-converter/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// A server stream that only carries a context
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func withApiKey(key string) context.Context {
+	return metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "Bearer "+key))
+}
+
+func TestAuthenticator_UnaryInterceptor(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	id, key, err := converterservice.CreateApiKey(repo, "test-name", "test-tenant")
+	assert.Nil(t, err)
+	assert.NotContains(t, repo.ApiKeys, key, "only the hash of the key should be stored")
+	authenticator := converterservice.NewAuthenticator(repo)
+	handled := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled = true
+		return req, nil
+	}
+	t.Run("valid key", func(t *testing.T) {
+		res, err := authenticator.UnaryInterceptor(withApiKey(key), "test-req", &grpc.UnaryServerInfo{}, handler)
+		assert.Nil(t, err)
+		assert.Equal(t, "test-req", res)
+		assert.True(t, handled, "should have called the handler")
+		assert.False(t, repo.ApiKeys[converterservice.HashApiKey(key)].LastUsed.IsZero(), "should record the use")
+	})
+	rejected := map[string]context.Context{
+		"missing key": context.TODO(),
+		"unknown key": withApiKey("unknown-key"),
+		"wrong scheme": metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "Basic "+key)),
+	}
+	for name, ctx := range rejected {
+		t.Run(name, func(t *testing.T) {
+			handled = false
+			_, err := authenticator.UnaryInterceptor(ctx, "test-req", &grpc.UnaryServerInfo{}, handler)
+			assert.Equal(t, codes.Unauthenticated, status.Code(err))
+			assert.False(t, handled, "should not have called the handler")
+		})
+	}
+	t.Run("disabled key", func(t *testing.T) {
+		disabled, err := repo.SetApiKeyEnabled(id, false)
+		assert.True(t, disabled)
+		assert.Nil(t, err)
+		handled = false
+		_, err = authenticator.UnaryInterceptor(withApiKey(key), "test-req", &grpc.UnaryServerInfo{}, handler)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.False(t, handled, "should not have called the handler")
+	})
+}
+
+func TestAuthenticator_StreamInterceptor(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	_, key, err := converterservice.CreateApiKey(repo, "test-name", "test-tenant")
+	assert.Nil(t, err)
+	authenticator := converterservice.NewAuthenticator(repo)
+	var handledStream grpc.ServerStream
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		handledStream = stream
+		return nil
+	}
+	err = authenticator.StreamInterceptor(nil, &testServerStream{ctx: withApiKey(key)}, &grpc.StreamServerInfo{},
+		handler)
+	assert.Nil(t, err)
+	assert.NotNil(t, handledStream, "should have called the handler")
+	handledStream = nil
+	err = authenticator.StreamInterceptor(nil, &testServerStream{ctx: context.TODO()}, &grpc.StreamServerInfo{}, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, handledStream, "should not have called the handler")
+}
+
+func TestAuthenticator_ScopesIdempotencyKeys(t *testing.T) {
+	config := testingConfiguration()
+	server := converterservice.NewWithConfiguration(toServerConfiguration(config))
+	authenticator := converterservice.NewAuthenticator(config.Db)
+	_, key, err := converterservice.CreateApiKey(config.Db, "test-name", "test-tenant")
+	assert.Nil(t, err)
+	req := &pb.ConvertFileRequest{
+		SourceUrl: testGrpcRequest.SourceUrl,
+		SourceEncoding: testGrpcRequest.SourceEncoding,
+		DestEncoding: testGrpcRequest.DestEncoding,
+		IdempotencyKey: "test-key",
+	}
+	convert := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.ConvertFile(ctx, req.(*pb.ConvertFileRequest))
+	}
+	authenticated, err := authenticator.UnaryInterceptor(withApiKey(key), req, &grpc.UnaryServerInfo{}, convert)
+	assert.Nil(t, err)
+	// A caller claiming to be anonymous must not receive the authenticated caller's job
+	anonymous, err := server.ConvertFile(context.TODO(), req)
+	assert.Nil(t, err)
+	assert.NotEqual(t, authenticated.(*pb.ConvertFileResponse).Id, anonymous.Id)
+}
+
+func TestAuthenticator_IsolatesTenants(t *testing.T) {
+	config := testingConfiguration()
+	server := converterservice.NewWithConfiguration(toServerConfiguration(config))
+	authenticator := converterservice.NewAuthenticator(config.Db)
+	_, ownerKey, err := converterservice.CreateApiKey(config.Db, "owner", "tenant-a")
+	assert.Nil(t, err)
+	_, colleagueKey, err := converterservice.CreateApiKey(config.Db, "colleague", "tenant-a")
+	assert.Nil(t, err)
+	_, otherKey, err := converterservice.CreateApiKey(config.Db, "other", "tenant-b")
+	assert.Nil(t, err)
+	call := func(key string, handler grpc.UnaryHandler, req interface{}) (interface{}, error) {
+		return authenticator.UnaryInterceptor(withApiKey(key), req, &grpc.UnaryServerInfo{}, handler)
+	}
+	convert := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.ConvertFile(ctx, req.(*pb.ConvertFileRequest))
+	}
+	query := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.ConvertFileQuery(ctx, req.(*pb.ConvertFileQueryRequest))
+	}
+	res, err := call(ownerKey, convert, testGrpcRequest)
+	assert.Nil(t, err)
+	id := res.(*pb.ConvertFileResponse).Id
+	job, err := config.Db.GetConversion(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "tenant-a", job.Request.Tenant, "should store the tenant on the job")
+	_, err = call(colleagueKey, query, &pb.ConvertFileQueryRequest{Id: id})
+	assert.Nil(t, err, "keys of the same tenant should see its jobs")
+	_, err = call(otherKey, query, &pb.ConvertFileQueryRequest{Id: id})
+	assert.NotNil(t, err, "other tenants should not see the job")
+	_, err = server.ConvertFileQuery(context.TODO(), &pb.ConvertFileQueryRequest{Id: id})
+	assert.NotNil(t, err, "unauthenticated callers should not see the job")
+}
@@ -6,12 +6,20 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	db "github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	context "golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 /*
@@ -22,6 +30,14 @@ type ConverterServer struct {
 	repo          db.FileConverterRepository
 	config        *ConverterServerConfig
 	queue         FileConverterJobQueue
+	// What the installed ffmpeg can read and write, or nil if it could not be probed
+	capabilities  *fileconverter.Capabilities
+	grpcServer    *grpc.Server
+	webhooks      fileconverter.WebhookDispatcher
+	events        events.EventPublisher
+	rateLimiter   *rateLimiter
+	// Recorded on the jobs this instance starts
+	owner         string
 }
 
 /*
@@ -34,6 +50,101 @@ type ConverterServerConfig struct {
 	QueueSize         int
 	Port              int
 	S3service         fileconverter.FileUploader
+	SourceFetcher     fileconverter.SourceFetcher
+	// How many times a waiting job may be passed over for higher priority work. The PostgresQueue instead
+	// claims the oldest job whatever its priority after each instance claims this many jobs by priority
+	StarvationLimit   int
+	JobTimeout        time.Duration
+	Retry             fileconverter.RetryPolicy
+	ProgressInterval  time.Duration
+	CapabilityProber  fileconverter.CapabilityProber
+	// How long running jobs may take to finish once a shutdown begins
+	ShutdownGracePeriod time.Duration
+	// Where jobs wait to be run. Defaults to MemoryQueue
+	QueueBackend      QueueBackend
+	// How long a job claimed from the PostgresQueue is held without renewal
+	LeaseTimeout      time.Duration
+	// How often idle workers poll the PostgresQueue
+	PollInterval      time.Duration
+	// Which parts of the service to run. Defaults to AllMode
+	Mode              RunMode
+	// Identifies this instance across restarts, so that it only recovers the jobs it was running.
+	// Defaults to the hostname
+	InstanceId        string
+	// Notifies callback URLs of finished jobs. Requests with a callback URL are rejected when nil
+	Webhooks          fileconverter.WebhookDispatcher
+	// Publishes each job status transition, or nil to publish nothing
+	Events            events.EventPublisher
+	// Rejects API calls that do not carry an enabled API key
+	RequireApiKey     bool
+	// How often each client may create jobs. A zero rate places no limit
+	RateLimit         RateLimit
+	// How many queued or running jobs each client may have, or zero for no limit
+	MaxActiveJobs     int
+	// Reads the duration of fetched sources for the duration limit, or nil to run ffprobe
+	SourceProber      fileconverter.SourceProber
+	// The largest and longest source a job may convert, overridden for the tenants in TenantInputLimits
+	InputLimits       fileconverter.InputLimits
+	TenantInputLimits map[string]fileconverter.InputLimits
+	// Which source URLs jobs may fetch. Every source is allowed when nil
+	SourcePolicy      *fileconverter.SourcePolicy
+	// Encrypts the source headers stored with jobs. Requests with source headers are rejected when nil
+	SourceHeaderCipher *fileconverter.HeaderCipher
+}
+
+// Selects the job queue implementation
+type QueueBackend string
+
+const (
+	// Queues jobs in channels within the process
+	MemoryQueue   QueueBackend = "memory"
+	// Queues jobs in the database, shared by every instance of the service
+	PostgresQueue QueueBackend = "postgres"
+)
+
+// Selects which parts of the service run, so that API servers and workers can be scaled independently
+type RunMode string
+
+const (
+	// Serves the API and runs the jobs it accepts
+	AllMode    RunMode = "all"
+	// Serves the API, only persisting jobs for workers to claim
+	ApiMode    RunMode = "api"
+	// Runs the jobs claimed from the PostgresQueue, without serving the API
+	WorkerMode RunMode = "worker"
+)
+
+// Returns true when the mode serves the ConverterService API
+func (m RunMode) ServesApi() bool {
+	return m != WorkerMode
+}
+
+// Returns true when the mode runs conversions
+func (m RunMode) RunsJobs() bool {
+	return m != ApiMode
+}
+
+/*
+ * Returns the owner recorded on the jobs this instance starts. Jobs claimed from the PostgresQueue
+ * are recovered through their leases, so each process owns them under a unique suffix
+ */
+func (c *ConverterServerConfig) owner() string {
+	instanceId := c.InstanceId
+	if instanceId == "" {
+		instanceId = defaultInstanceId()
+	}
+	if c.durableQueue() {
+		return uniqueOwner(instanceId)
+	}
+	return instanceId
+}
+
+/*
+ * Returns true when jobs are queued in the database. API and worker
+ * modes only coordinate through the PostgresQueue, so they always use it
+ */
+func (c *ConverterServerConfig) durableQueue() bool {
+	return c.QueueBackend == PostgresQueue || c.Mode == ApiMode || c.Mode == WorkerMode
 }
 
 type converterServiceJob struct {
@@ -45,23 +156,70 @@ type converterServiceJob struct {
  * Creates a new converter service instance
  */
 func NewWithConfiguration(config *ConverterServerConfig) *ConverterServer {
-	queue := NewJobQueue(&JobQueueConfiguration{
-		Concurrency: config.Concurrency,
-		QueueSize: config.QueueSize,
-	})
-	if err := queue.Start(); err != nil {
-		log.Fatalf("could not start job queue, encountered %v", err)
-	}
-	return &ConverterServer{
+	capabilities := probeCapabilities(config)
+	owner := config.owner()
+	server := &ConverterServer{
 		fileConverter: fileconverter.New(&fileconverter.ConverterImplementation{
 			S3service: config.S3service,
 			Db: config.Db,
 			ExecutableFactory: config.ExecutableFactory,
+			SourceFetcher: config.SourceFetcher,
+			JobTimeout: config.JobTimeout,
+			Retry: config.Retry,
+			ProgressInterval: config.ProgressInterval,
+			Webhooks: config.Webhooks,
+			Events: config.Events,
+			SourceProber: config.SourceProber,
+			InputLimits: config.InputLimits,
+			TenantInputLimits: config.TenantInputLimits,
+			SourcePolicy: config.SourcePolicy,
+			Owner: owner,
 		}),
 		repo:   config.Db,
 		config: config,
-		queue: queue,
+		capabilities: capabilities,
+		webhooks: config.Webhooks,
+		events: config.Events,
+		rateLimiter: newRateLimiter(config.RateLimit),
+		owner: owner,
+	}
+	server.queue = server.newJobQueue()
+	if err := server.queue.Start(); err != nil {
+		log.Fatalf("could not start job queue, encountered %v", err)
 	}
+	if !config.durableQueue() {
+		server.recoverJobs()
+	}
+	return server
+}
+
+/*
+ * Creates the queue selected by the configuration. The PostgresQueue needs no recovery on startup,
+ * since unfinished jobs stay in the database until a worker claims them.
+ * In API mode the queue has no workers, so jobs are only persisted
+ */
+func (s *ConverterServer) newJobQueue() FileConverterJobQueue {
+	if s.config.durableQueue() {
+		concurrency := s.config.Concurrency
+		if !s.config.Mode.RunsJobs() {
+			concurrency = 0
+		}
+		return NewDurableJobQueue(&DurableJobQueueConfiguration{
+			Concurrency: concurrency,
+			Db: s.repo,
+			NewJob: s.claimedJob,
+			LeaseTimeout: s.config.LeaseTimeout,
+			PollInterval: s.config.PollInterval,
+			Owner: s.owner,
+			LeaseLost: s.fileConverter.Cancel,
+			StarvationLimit: s.config.StarvationLimit,
+		})
+	}
+	return NewJobQueue(&JobQueueConfiguration{
+		Concurrency: s.config.Concurrency,
+		QueueSize: s.config.QueueSize,
+		StarvationLimit: s.config.StarvationLimit,
+	})
 }
 
 func (s *ConverterServer) newJob(request *fileconverter.FileConversionRequest) FileConverterJob {
@@ -71,41 +229,220 @@ func (s *ConverterServer) newJob(request *fileconverter.FileConversionRequest) F
 	}
 }
 
-func Start(server *ConverterServer) {
-	log.Println("Starting service...")
-	port := server.config.Port
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+/*
+ * Rebuilds the job for a stored request, returning an error if the request can no longer be run
+ */
+func (s *ConverterServer) jobFromRecord(job *db.ConvertJob) (FileConverterJob, error) {
+	request, err := fileconverter.FileConversionRequestFromRecord(job.Id, &job.Request)
 	if err != nil {
-		log.Fatalf("Failed to listen to port %d, caused by %v. Is this port occupied?", port, err)
+		return nil, err
+	}
+	if err := s.checkSupported(request); err != nil {
+		return nil, err
+	}
+	if request.SourceHeaders, err = s.config.SourceHeaderCipher.Open(job.Id, job.Request.SourceHeaders); err != nil {
+		return nil, err
+	}
+	return s.newJob(request), nil
+}
+
+/*
+ * Rebuilds the job for a row claimed from the PostgresQueue, failing the row if it can no longer be run
+ */
+func (s *ConverterServer) claimedJob(job *db.ConvertJob) (FileConverterJob, error) {
+	next, err := s.jobFromRecord(job)
+	if err != nil {
+		s.failUnrunnable(job, fmt.Sprintf("could not run job: %v", err))
+	}
+	return next, err
+}
+
+/*
+ * Fails a stored job whose request can no longer be run, and sends its webhook
+ */
+func (s *ConverterServer) failUnrunnable(job *db.ConvertJob, message string) {
+	id := job.Id
+	if _, err := s.repo.FailConversion(id, s.owner, enums.INVALID_REQUEST, message); err != nil {
+		log.Printf("failed to update DB with failure, encountered %v", err)
+		return
+	}
+	if from, err := enums.StatusFromName(job.Status); err == nil {
+		events.Publish(s.events, id, from, enums.FAILED)
+	}
+	if s.webhooks == nil {
+		return
+	}
+	if job, err := s.repo.GetConversion(id); err != nil {
+		log.Printf("failed to get %s for its webhook, encountered %v", id, err)
+	} else {
+		s.webhooks.Dispatch(job)
+	}
+}
+
+/*
+ * Serves requests until the process receives SIGTERM or an interrupt, then shuts down gracefully.
+ * In worker mode nothing is served, and jobs are run until the signal is received
+ */
+func Start(server *ConverterServer) {
+	mode := server.config.Mode
+	if mode == "" {
+		mode = AllMode
+	}
+	log.Printf("Starting service in %s mode...", mode)
+	var lis net.Listener
+	if mode.ServesApi() {
+		port := server.config.Port
+		var err error
+		lis, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Fatalf("Failed to listen to port %d, caused by %v. Is this port occupied?", port, err)
+		}
+		server.grpcServer = grpc.NewServer(server.serverOptions()...)
+		pb.RegisterConverterServiceServer(server.grpcServer, server)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	shutdown := make(chan bool)
+	go func() {
+		sig := <- signals
+		log.Printf("received %v, shutting down", sig)
+		server.Shutdown()
+		close(shutdown)
+	}()
+	if lis != nil {
+		if err := server.grpcServer.Serve(lis); err != nil {
+			log.Fatalf("Failure! %v", err)
+		}
+	}
+	<- shutdown
+}
+
+/*
+ * Returns the options for the gRPC server, installing the API key interceptors when keys are required
+ */
+func (s *ConverterServer) serverOptions() []grpc.ServerOption {
+	if !s.config.RequireApiKey {
+		log.Println("API keys are not required, any client that can reach the service may use it")
+		return nil
+	}
+	authenticator := NewAuthenticator(s.repo)
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(authenticator.UnaryInterceptor),
+		grpc.StreamInterceptor(authenticator.StreamInterceptor),
+	}
+}
+
+/*
+ * Stops accepting requests and waits up to the grace period for running jobs to finish.
+ * Jobs that are still running are stopped and returned to the queue, so that they can be recovered
+ */
+func (s *ConverterServer) Shutdown() {
+	if s.grpcServer != nil {
+		s.grpcServer.GracefulStop()
+	}
+	unfinished := s.queue.Stop(s.config.ShutdownGracePeriod)
+	s.fileConverter.Stop()
+	if s.webhooks != nil {
+		s.webhooks.Stop()
 	}
-	s := grpc.NewServer()
-	pb.RegisterConverterServiceServer(s, server)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failure! %v", err)
+	if len(unfinished) == 0 {
+		log.Println("all running jobs finished")
+		return
+	}
+	for _, job := range unfinished {
+		requeued, err := s.repo.RequeueConversion(job.Id())
+		if err != nil {
+			log.Printf("failed to requeue %s, encountered %v", job.Id(), err)
+		} else if requeued {
+			log.Printf("%s did not finish within the grace period and was requeued", job.Id())
+			events.Publish(s.events, job.Id(), enums.CONVERTING, enums.QUEUED)
+		}
 	}
 }
 
 func (s *ConverterServer) ConvertFile(ctx context.Context, req *pb.ConvertFileRequest) (*pb.ConvertFileResponse, error) {
+	tenant, caller := tenantFromContext(ctx), callerFromContext(ctx)
+	if err := s.checkRateLimit(ctx, caller); err != nil {
+		return nil, err
+	}
 	id := uuid.New().String()
 	request, err := fileconverter.NewFileConversionRequest(req, id)
 	if err != nil {
-		if _, dbErr := s.repo.FailConversion(id); dbErr != nil {
+		if _, dbErr := s.repo.FailConversion(id, s.owner, enums.INVALID_REQUEST, err.Error()); dbErr != nil {
+			log.Printf("failed to update DB with failure, encountered %v", dbErr)
+		}
+		return nil, err
+	}
+	if err := s.checkSupported(request); err != nil {
+		if _, dbErr := s.repo.FailConversion(id, s.owner, enums.INVALID_REQUEST, err.Error()); dbErr != nil {
+			log.Printf("failed to update DB with failure, encountered %v", dbErr)
+		}
+		return nil, err
+	}
+	if err := s.config.SourcePolicy.Check(request.SourceUrl); err != nil {
+		if _, dbErr := s.repo.FailConversion(id, s.owner, enums.INVALID_REQUEST, err.Error()); dbErr != nil {
+			log.Printf("failed to update DB with failure, encountered %v", dbErr)
+		}
+		return nil, err
+	}
+	if err := s.config.SourcePolicy.CheckCallback(request.CallbackUrl); err != nil {
+		if _, dbErr := s.repo.FailConversion(id, s.owner, enums.INVALID_REQUEST, err.Error()); dbErr != nil {
 			log.Printf("failed to update DB with failure, encountered %v", dbErr)
 		}
 		return nil, err
 	}
-	if _, err := s.repo.NewRequest(id); err != nil {
+	request.Tenant = tenant
+	key := idempotencyKey(ctx, req)
+	var fingerprint string
+	if key != "" {
+		if fingerprint, err = requestFingerprint(req); err != nil {
+			log.Printf("failed to fingerprint request, encountered %v", err)
+			return nil, errors.New("an internal error occurred")
+		}
+		originalId, err := s.idempotentJob(caller, key, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if originalId != "" {
+			return &pb.ConvertFileResponse{Accepted: true, Id: originalId}, nil
+		}
+	}
+	if err := s.checkActiveJobQuota(ctx, caller); err != nil {
+		return nil, err
+	}
+	record := request.Record()
+	record.Caller = caller
+	if record.SourceHeaders, err = s.config.SourceHeaderCipher.Seal(id, request.SourceHeaders); err != nil {
+		log.Printf("failed to seal the source headers of %s, encountered %v", id, err)
 		return nil, errors.New("an internal error occurred")
 	}
+	createdId, err := s.createRequest(id, record, caller, key, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if createdId != id {
+		return &pb.ConvertFileResponse{Accepted: true, Id: createdId}, nil
+	}
+	events.Publish(s.events, id, nil, enums.QUEUED)
 	if err = s.queue.Enqueue(s.newJob(request)); err != nil {
 		log.Printf("failed to add job to queue, encountered %v", err)
+		// The client is told the request failed, so the stored job must not be recovered or count against its quota
+		if _, dbErr := s.repo.FailConversion(id, s.owner, enums.INTERNAL, "could not queue job: "+err.Error()); dbErr != nil {
+			log.Printf("failed to update DB with failure, encountered %v", dbErr)
+		} else {
+			events.Publish(s.events, id, enums.QUEUED, enums.FAILED)
+		}
+		s.releaseIdempotencyKey(caller, key)
+		if errors.Is(err, errQueueFull) {
+			return nil, status.Error(codes.ResourceExhausted, "too many requests, the job queue is full")
+		}
 		return nil, errors.New("an internal error occurred")
 	}
 	return &pb.ConvertFileResponse{Accepted: true, Id: id}, nil
 }
 
 func (s *ConverterServer) ConvertFileQuery(ctx context.Context, req *pb.ConvertFileQueryRequest) (*pb.ConvertFileQueryResponse, error) {
-	job, err := s.repo.GetConversion(req.Id)
+	job, err := s.repo.GetTenantConversion(tenantFromContext(ctx), req.Id)
 	if err != nil {
 		log.Printf("failed to get %s, encountered %v", req.Id, err)
 		return nil, errors.New(fmt.Sprintf("failed to get %s", req.Id))
@@ -114,6 +451,13 @@ func (s *ConverterServer) ConvertFileQuery(ctx context.Context, req *pb.ConvertF
 		Id: job.Id,
 		Status: pb.ConvertFileQueryResponse_Status(pb.ConvertFileQueryResponse_Status_value[job.Status]),
 		Url: job.CurrUrl,
+		ErrorCode: pb.ConvertFileQueryResponse_ErrorCode(pb.ConvertFileQueryResponse_ErrorCode_value[job.ErrorCode]),
+		ErrorMessage: job.ErrorMessage,
+		Progress: &pb.ConversionProgress{
+			Percent: float32(job.Progress.Percent),
+			ProcessedSeconds: job.Progress.Processed.Seconds(),
+			Speed: float32(job.Progress.Speed),
+		},
 	}, nil
 }
 
@@ -122,6 +466,121 @@ func (s *ConverterServer) ConvertStream(ctx context.Context, req *pb.ConvertStre
 	return &pb.ConvertStreamResponse{Buff: []byte{}, Encoding: 0}, nil
 }
 
+/*
+ * Discovers what the installed ffmpeg can read and write. If it cannot be run the capabilities are unknown,
+ * so every format is rejected. API mode never converts, so it accepts every registered format and leaves
+ * workers to fail the jobs they cannot run
+ */
+func probeCapabilities(config *ConverterServerConfig) *fileconverter.Capabilities {
+	if !config.Mode.RunsJobs() {
+		return fileconverter.RegisteredCapabilities()
+	}
+	prober := config.CapabilityProber
+	if prober == nil {
+		prober = fileconverter.NewCapabilityProber()
+	}
+	capabilities, err := prober.Probe()
+	if err != nil {
+		log.Printf("failed to probe ffmpeg for supported formats, all will be rejected: %v", err)
+		return nil
+	}
+	logUnsupportedFormats(capabilities)
+	return capabilities
+}
+
+/*
+ * Logs the registered formats that the installed ffmpeg cannot read or write
+ */
+func logUnsupportedFormats(capabilities *fileconverter.Capabilities) {
+	for _, format := range enums.Formats() {
+		if !capabilities.CanRead(format) {
+			log.Printf("%s is disabled as a source, ffmpeg has no %s demuxer", format.Name, format.Demuxer)
+		}
+		if !capabilities.CanWrite(format) {
+			log.Printf("%s is disabled as a destination, ffmpeg has no %s muxer or %s encoder",
+				format.Name, format.Muxer, format.Codec)
+		}
+	}
+}
+
+/*
+ * Rejects requests for encodings that the installed ffmpeg cannot read or write
+ */
+func (s *ConverterServer) checkSupported(request *fileconverter.FileConversionRequest) error {
+	if source := request.SourceEncoding.Format(); !s.capabilities.CanRead(source) {
+		return fmt.Errorf("%s is not supported as a source encoding", source.Name)
+	}
+	if dest := request.DestEncoding.Format(); !s.capabilities.CanWrite(dest) {
+		return fmt.Errorf("%s is not supported as a destination encoding", dest.Name)
+	}
+	if request.CallbackUrl != "" && s.webhooks == nil {
+		return errors.New("callbackUrl is not supported, since webhooks are not configured")
+	}
+	if len(request.SourceHeaders) > 0 && s.config.SourceHeaderCipher == nil {
+		return errors.New("sourceHeaders are not supported, since no source header key is configured")
+	}
+	return nil
+}
+
+/*
+ * Lists the registered formats that the installed ffmpeg can read or write
+ */
+func (s *ConverterServer) ListSupportedFormats(ctx context.Context, req *pb.ListSupportedFormatsRequest) (*pb.ListSupportedFormatsResponse, error) {
+	res := &pb.ListSupportedFormatsResponse{}
+	for _, format := range enums.Formats() {
+		source, destination := s.capabilities.CanRead(format), s.capabilities.CanWrite(format)
+		if !source && !destination {
+			continue
+		}
+		supported := &pb.SupportedFormat{
+			Encoding: format.Encoding,
+			Name: format.Name,
+			Extension: format.Extension,
+			MimeType: format.MimeType,
+			MinBitrate: uint32(format.MinBitrate),
+			MaxBitrate: uint32(format.MaxBitrate),
+			MaxChannels: uint32(format.MaxChannels),
+			Source: source,
+			Destination: destination,
+		}
+		for _, sampleRate := range format.SampleRates {
+			supported.SampleRates = append(supported.SampleRates, uint32(sampleRate))
+		}
+		for _, option := range format.Options {
+			supported.Options = append(supported.Options, string(option))
+		}
+		res.Formats = append(res.Formats, supported)
+	}
+	return res, nil
+}
+
 func (j *converterServiceJob) Start() {
 	j.converter.ConvertFile(j.request)
-}
\ No newline at end of file
+}
+
+func (j *converterServiceJob) Priority() enums.Priority {
+	return j.request.Priority
+}
+
+func (j *converterServiceJob) Id() string {
+	return j.request.Id
+}
+
+/*
+ * Redelivers the webhook events for a job that were not delivered
+ */
+func (s *ConverterServer) ReplayWebhooks(ctx context.Context, req *pb.ReplayWebhooksRequest) (*pb.ReplayWebhooksResponse, error) {
+	if s.webhooks == nil {
+		return nil, errors.New("webhooks are not configured")
+	}
+	if _, err := s.repo.GetTenantConversion(tenantFromContext(ctx), req.Id); err != nil {
+		log.Printf("failed to get %s, encountered %v", req.Id, err)
+		return nil, errors.New(fmt.Sprintf("failed to get %s", req.Id))
+	}
+	replayed, err := s.webhooks.Replay(req.Id)
+	if err != nil {
+		log.Printf("failed to replay webhooks for %s, encountered %v", req.Id, err)
+		return nil, errors.New("an internal error occurred")
+	}
+	return &pb.ReplayWebhooksResponse{Replayed: uint32(replayed)}, nil
+}
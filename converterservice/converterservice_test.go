@@ -5,9 +5,15 @@ import (
 	"context"
 	"fmt"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/mocks"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"testing"
 	"time"
 )
@@ -29,6 +35,8 @@ type testServerConfiguration struct {
 	S3service *mocks.S3FileUploaderMock
 	Db *mocks.MockFileConverterRepo
 	ExecutableFactory *mocks.MockExecutableFactory
+	SourceFetcher *mocks.MockSourceFetcher
+	CapabilityProber *mocks.MockCapabilityProber
 }
 
 func testingConfiguration() *testServerConfiguration {
@@ -40,6 +48,8 @@ func testingConfiguration() *testServerConfiguration {
 		S3service: s3Service,
 		Db: db,
 		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		CapabilityProber: mocks.NewMockCapabilityProber(),
 	}
 }
 
@@ -47,8 +57,10 @@ func toServerConfiguration(testConfig *testServerConfiguration) *converterservic
 	return &converterservice.ConverterServerConfig{
 		Db: testConfig.Db,
 		ExecutableFactory: testConfig.ExecutableFactory,
+		SourceFetcher: testConfig.SourceFetcher,
 		Port: testConfig.Port,
 		S3service: testConfig.S3service,
+		CapabilityProber: testConfig.CapabilityProber,
 		Concurrency: 5,
 		QueueSize: 100,
 	}
@@ -129,7 +141,10 @@ func TestConverterServer_ConvertFileQuery_Success(t *testing.T) {
 	job, err := config.Db.GetConversion(res.Id)
 	go func() {
 		for job.Status != pb.ConvertFileQueryResponse_COMPLETED.String() &&
-			job.Status != pb.ConvertFileQueryResponse_FAILED.String() {}
+			job.Status != pb.ConvertFileQueryResponse_FAILED.String() {
+			time.Sleep(time.Millisecond)
+			job, _ = config.Db.GetConversion(res.Id)
+		}
 		done <- true
 	}()
 	select {
@@ -156,7 +171,10 @@ func TestConverterServer_ConvertFileQuery_Fail(t *testing.T) {
 	job, err := config.Db.GetConversion(res.Id)
 	go func() {
 		for job.Status != pb.ConvertFileQueryResponse_COMPLETED.String() &&
-			job.Status != pb.ConvertFileQueryResponse_FAILED.String() {}
+			job.Status != pb.ConvertFileQueryResponse_FAILED.String() {
+			time.Sleep(time.Millisecond)
+			job, _ = config.Db.GetConversion(res.Id)
+		}
 		done <- true
 	}()
 	select {
@@ -167,8 +185,384 @@ func TestConverterServer_ConvertFileQuery_Fail(t *testing.T) {
 	assert.Equal(t, pb.ConvertFileQueryResponse_FAILED.String(), job.Status, "test should have failed to execute")
 	assert.Equal(t, "NONE", job.CurrUrl, "URL should be none")
 	assert.GreaterOrEqual(t, time.Now().Unix(), job.LastUpdated.Unix(), "last updated should be recent")
+	query, err := server.ConvertFileQuery(context.TODO(), &pb.ConvertFileQueryRequest{Id: res.Id})
+	assert.Nil(t, err, "should not have errored")
+	assert.Equal(t, pb.ConvertFileQueryResponse_FAILED, query.Status, "query should have a failed status")
+	assert.Equal(t, pb.ConvertFileQueryResponse_UPLOAD_FAILED, query.ErrorCode, "query should have the failure code")
+	assert.NotEmpty(t, query.ErrorMessage, "query should have the failure reason")
 }
 
 func TestConverterServer_ConvertStream(t *testing.T) {
 	t.Skip("not implemented")
-}
\ No newline at end of file
+}
+
+func TestConverterServer_ConvertFile_IdempotencyKey(t *testing.T) {
+	config := testingConfiguration()
+	server := converterservice.NewWithConfiguration(toServerConfiguration(config))
+	req := &pb.ConvertFileRequest{
+		SourceUrl: testGrpcRequest.SourceUrl,
+		SourceEncoding: testGrpcRequest.SourceEncoding,
+		DestEncoding: testGrpcRequest.DestEncoding,
+		IdempotencyKey: "test-key",
+	}
+	first, err := server.ConvertFile(context.TODO(), req)
+	assert.Nil(t, err, "should not have errored")
+	retry, err := server.ConvertFile(context.TODO(), req)
+	assert.Nil(t, err, "retry should not have errored")
+	assert.Equal(t, first.Id, retry.Id, "retry should return the original job")
+	assert.Len(t, config.Db.Data, 1, "should only have created one job")
+	t.Run("different payload", func(t *testing.T) {
+		res, err := server.ConvertFile(context.TODO(), &pb.ConvertFileRequest{
+			SourceUrl: "other-url",
+			SourceEncoding: req.SourceEncoding,
+			DestEncoding: req.DestEncoding,
+			IdempotencyKey: req.IdempotencyKey,
+		})
+		assert.Nil(t, res, "response should be nil")
+		assert.NotNil(t, err, "should have rejected the reused key")
+	})
+	t.Run("expired key", func(t *testing.T) {
+		config.Db.IdempotencyKeys["anonymous/"+req.IdempotencyKey].ExpiresAt = time.Now()
+		res, err := server.ConvertFile(context.TODO(), req)
+		assert.Nil(t, err, "should not have errored")
+		assert.NotEqual(t, first.Id, res.Id, "an expired key should create a new job")
+		assert.Len(t, config.Db.Data, 2)
+	})
+}
+
+func TestConverterServer_ConvertFile_IdempotencyKeyMetadata(t *testing.T) {
+	config := testingConfiguration()
+	server := converterservice.NewWithConfiguration(toServerConfiguration(config))
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("idempotency-key", "test-key"))
+	first, err := server.ConvertFile(ctx, testGrpcRequest)
+	assert.Nil(t, err, "should not have errored")
+	retry, err := server.ConvertFile(ctx, testGrpcRequest)
+	assert.Nil(t, err, "retry should not have errored")
+	assert.Equal(t, first.Id, retry.Id, "retry should return the original job")
+}
+
+func TestConverterServer_ListSupportedFormats_ProbeFailed(t *testing.T) {
+	testConfig := testingConfiguration()
+	testConfig.CapabilityProber.Success = false
+	server := converterservice.NewWithConfiguration(toServerConfiguration(testConfig))
+	res, err := server.ListSupportedFormats(context.Background(), &pb.ListSupportedFormatsRequest{})
+	assert.Nil(t, err)
+	assert.Empty(t, res.Formats, "no formats should be supported when ffmpeg could not be probed")
+	_, err = server.ConvertFile(context.Background(), testGrpcRequest)
+	assert.NotNil(t, err, "should reject conversions when ffmpeg could not be probed")
+}
+
+func TestConverterServer_ListSupportedFormats(t *testing.T) {
+	testConfig := testingConfiguration()
+	// libmp3lame is missing, and the build cannot read or write Ogg
+	delete(testConfig.CapabilityProber.Capabilities.Encoders, "libmp3lame")
+	delete(testConfig.CapabilityProber.Capabilities.Demuxers, "ogg")
+	delete(testConfig.CapabilityProber.Capabilities.Muxers, "ogg")
+	server := converterservice.NewWithConfiguration(toServerConfiguration(testConfig))
+	res, err := server.ListSupportedFormats(context.Background(), &pb.ListSupportedFormatsRequest{})
+	assert.Nil(t, err)
+	formats := map[pb.Encoding]*pb.SupportedFormat{}
+	for _, format := range res.Formats {
+		formats[format.Encoding] = format
+	}
+	assert.NotContains(t, formats, pb.Encoding_OGG)
+	assert.True(t, formats[pb.Encoding_MP3].Source)
+	assert.False(t, formats[pb.Encoding_MP3].Destination)
+	assert.True(t, formats[pb.Encoding_OPUS].Destination)
+	assert.False(t, formats[pb.Encoding_OPUS].Source)
+	ulaw := formats[pb.Encoding_ULAW]
+	assert.True(t, ulaw.Source)
+	assert.True(t, ulaw.Destination)
+	assert.Equal(t, []uint32{8000}, ulaw.SampleRates)
+	assert.Equal(t, uint32(1), ulaw.MaxChannels)
+	assert.Empty(t, ulaw.Options)
+	assert.Equal(t, "audio/mpeg", formats[pb.Encoding_MP3].MimeType)
+	assert.Equal(t, []string{"sampleRate", "channels"}, formats[pb.Encoding_FLAC].Options)
+	t.Run("unsupported destination", func(t *testing.T) {
+		res, err := server.ConvertFile(context.Background(), &pb.ConvertFileRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: pb.Encoding_WAV,
+			DestEncoding: pb.Encoding_MP3,
+		})
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+	})
+	t.Run("unsupported source", func(t *testing.T) {
+		res, err := server.ConvertFile(context.Background(), &pb.ConvertFileRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: pb.Encoding_OGG,
+			DestEncoding: pb.Encoding_WAV,
+		})
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestConverterServer_Shutdown(t *testing.T) {
+	testConfig := testingConfiguration()
+	testConfig.ExecutableFactory.Hang = true
+	config := toServerConfiguration(testConfig)
+	config.ShutdownGracePeriod = 50 * time.Millisecond
+	publisher := events.NewMemoryEventPublisher()
+	config.Events = publisher
+	server := converterservice.NewWithConfiguration(config)
+	res, err := server.ConvertFile(context.Background(), testGrpcRequest)
+	assert.Nil(t, err)
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if job, _ := testConfig.Db.GetConversion(res.Id); job != nil && job.Status == pb.ConvertFileQueryResponse_CONVERTING.String() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the conversion to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Shutdown()
+	job, err := testConfig.Db.GetConversion(res.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, pb.ConvertFileQueryResponse_QUEUED.String(), job.Status, "unfinished job should be requeued")
+	var transitions []string
+	for _, event := range publisher.Events() {
+		assert.Equal(t, res.Id, event.JobId)
+		transitions = append(transitions, fmt.Sprintf("%s->%s", event.OldStatus, event.NewStatus))
+	}
+	assert.Equal(t, []string{"->QUEUED", "QUEUED->CONVERTING", "CONVERTING->QUEUED"}, transitions)
+	_, err = server.ConvertFile(context.Background(), testGrpcRequest)
+	assert.NotNil(t, err, "should not accept jobs once shut down")
+}
+
+func TestConverterServer_ConvertFile_QueueFull(t *testing.T) {
+	testConfig := testingConfiguration()
+	testConfig.ExecutableFactory.Hang = true
+	config := toServerConfiguration(testConfig)
+	config.Concurrency = 1
+	config.QueueSize = 1
+	config.ShutdownGracePeriod = 50 * time.Millisecond
+	server := converterservice.NewWithConfiguration(config)
+	defer server.Shutdown()
+	accepted := 0
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		if _, err = server.ConvertFile(context.Background(), testGrpcRequest); err == nil {
+			accepted++
+		}
+	}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "should reject requests while the queue is full")
+	active, err := testConfig.Db.CountActiveConversions("anonymous")
+	assert.Nil(t, err)
+	assert.Equal(t, accepted, active, "rejected jobs should not be left to be recovered")
+}
+
+func TestNewWithConfiguration_RecoversJobs(t *testing.T) {
+	testConfig := testingConfiguration()
+	repo := testConfig.Db
+	record := &db.ConversionRequest{
+		SourceUrl: "test-url",
+		SourceEncoding: "MP3",
+		DestEncoding: "WAV",
+		Priority: "NORMAL",
+	}
+	_, err := repo.NewRequest("queued", record)
+	assert.Nil(t, err)
+	_, err = repo.NewRequest("converting", record)
+	assert.Nil(t, err)
+	_, err = repo.StartConversion("converting", "test-instance")
+	assert.Nil(t, err)
+	_, err = repo.NewRequest("converting-elsewhere", record)
+	assert.Nil(t, err)
+	_, err = repo.StartConversion("converting-elsewhere", "other-instance")
+	assert.Nil(t, err)
+	_, err = repo.NewRequest("unrecoverable", &db.ConversionRequest{SourceUrl: "test-url", SourceEncoding: "MIDI"})
+	assert.Nil(t, err)
+	config := toServerConfiguration(testConfig)
+	config.InstanceId = "test-instance"
+	converterservice.NewWithConfiguration(config)
+	for _, id := range []string{"queued", "converting"} {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			job, err := repo.GetConversion(id)
+			assert.Nil(t, err)
+			if job.Status == pb.ConvertFileQueryResponse_COMPLETED.String() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s to be recovered", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	job, err := repo.GetConversion("unrecoverable")
+	assert.Nil(t, err)
+	assert.Equal(t, pb.ConvertFileQueryResponse_FAILED.String(), job.Status)
+	assert.Equal(t, pb.ConvertFileQueryResponse_INVALID_REQUEST.String(), job.ErrorCode)
+	job, err = repo.GetConversion("converting-elsewhere")
+	assert.Nil(t, err)
+	assert.Equal(t, pb.ConvertFileQueryResponse_CONVERTING.String(), job.Status,
+		"should not recover jobs another instance is running")
+}
+
+func TestNewWithConfiguration_RecoversOverflow(t *testing.T) {
+	testConfig := testingConfiguration()
+	repo := testConfig.Db
+	ids := []string{"first", "second", "third", "fourth"}
+	for _, id := range ids {
+		_, err := repo.NewRequest(id, &db.ConversionRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: "MP3",
+			DestEncoding: "WAV",
+			Priority: "NORMAL",
+		})
+		assert.Nil(t, err)
+	}
+	config := toServerConfiguration(testConfig)
+	config.Concurrency = 1
+	config.QueueSize = 1
+	server := converterservice.NewWithConfiguration(config)
+	defer server.Shutdown()
+	assert.Eventually(t, func() bool {
+		for _, id := range ids {
+			if job, _ := repo.GetConversion(id); job.Status != pb.ConvertFileQueryResponse_COMPLETED.String() {
+				return false
+			}
+		}
+		return true
+	}, 5 * time.Second, 10 * time.Millisecond, "jobs that did not fit in the queue should be enqueued as it drains")
+}
+
+func TestNewWithConfiguration_ApiAndWorkerModes(t *testing.T) {
+	testConfig := testingConfiguration()
+	apiConfig := toServerConfiguration(testConfig)
+	apiConfig.Mode = converterservice.ApiMode
+	apiConfig.PollInterval = 10 * time.Millisecond
+	// API mode never converts, so it should not run ffmpeg to probe it
+	apiConfig.CapabilityProber = &mocks.MockCapabilityProber{Success: false}
+	api := converterservice.NewWithConfiguration(apiConfig)
+	defer api.Shutdown()
+	res, err := api.ConvertFile(context.Background(), testGrpcRequest)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	job, err := testConfig.Db.GetConversion(res.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, pb.ConvertFileQueryResponse_QUEUED.String(), job.Status, "api mode should not run jobs")
+	workerConfig := toServerConfiguration(testConfig)
+	workerConfig.Mode = converterservice.WorkerMode
+	workerConfig.PollInterval = 10 * time.Millisecond
+	worker := converterservice.NewWithConfiguration(workerConfig)
+	defer worker.Shutdown()
+	assert.Eventually(t, func() bool {
+		job, _ := testConfig.Db.GetConversion(res.Id)
+		return job.Status == pb.ConvertFileQueryResponse_COMPLETED.String()
+	}, 3 * time.Second, 10 * time.Millisecond, "worker mode should run the persisted job")
+}
+
+func TestConverterServer_ConvertFile_CallbackUrl(t *testing.T) {
+	testConfig := testingConfiguration()
+	request := &pb.ConvertFileRequest{
+		SourceUrl: "test-url",
+		SourceEncoding: pb.Encoding_MP3,
+		DestEncoding: pb.Encoding_WAV,
+		CallbackUrl: "https://example.com/hook",
+	}
+	server := converterservice.NewWithConfiguration(toServerConfiguration(testConfig))
+	_, err := server.ConvertFile(context.Background(), request)
+	assert.NotNil(t, err, "callbacks should be rejected when webhooks are not configured")
+	_, err = server.ReplayWebhooks(context.Background(), &pb.ReplayWebhooksRequest{Id: "test-id"})
+	assert.NotNil(t, err)
+	config := toServerConfiguration(testConfig)
+	config.Webhooks = fileconverter.NewWebhookDispatcher(testConfig.Db, "test-secret", fileconverter.RetryPolicy{}, nil)
+	server = converterservice.NewWithConfiguration(config)
+	res, err := server.ConvertFile(context.Background(), request)
+	assert.Nil(t, err)
+	job, err := testConfig.Db.GetConversion(res.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, request.CallbackUrl, job.Request.CallbackUrl)
+	_, err = server.ReplayWebhooks(context.Background(), &pb.ReplayWebhooksRequest{Id: "missing-id"})
+	assert.NotNil(t, err, "should not replay webhooks for unknown jobs")
+	replay, err := server.ReplayWebhooks(context.Background(), &pb.ReplayWebhooksRequest{Id: res.Id})
+	assert.Nil(t, err)
+	assert.NotNil(t, replay)
+}
+
+func TestConverterServer_ConvertFile_CallbackPolicy(t *testing.T) {
+	testConfig := testingConfiguration()
+	config := toServerConfiguration(testConfig)
+	config.SourcePolicy = &fileconverter.SourcePolicy{}
+	config.Webhooks = fileconverter.NewWebhookDispatcher(testConfig.Db, "test-secret", fileconverter.RetryPolicy{},
+		config.SourcePolicy)
+	defer config.Webhooks.Stop()
+	server := converterservice.NewWithConfiguration(config)
+	for _, callbackUrl := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:5432/hook"} {
+		res, err := server.ConvertFile(context.Background(), &pb.ConvertFileRequest{
+			SourceUrl: "http://93.184.216.34/test.mp3",
+			SourceEncoding: pb.Encoding_MP3,
+			DestEncoding: pb.Encoding_WAV,
+			CallbackUrl: callbackUrl,
+		})
+		assert.Nil(t, res, "response should be nil")
+		assert.NotNil(t, err, "%s should be rejected", callbackUrl)
+	}
+	assert.Empty(t, testConfig.Db.Data, "should not have queued a rejected callback")
+}
+
+func TestConverterServer_ConvertFile_SourcePolicy(t *testing.T) {
+	testConfig := testingConfiguration()
+	config := toServerConfiguration(testConfig)
+	config.SourcePolicy = &fileconverter.SourcePolicy{}
+	server := converterservice.NewWithConfiguration(config)
+	for _, sourceUrl := range []string{"file:///etc/passwd", "http://169.254.169.254/latest/meta-data", "http://127.0.0.1:5432"} {
+		res, err := server.ConvertFile(context.Background(), &pb.ConvertFileRequest{
+			SourceUrl: sourceUrl,
+			SourceEncoding: pb.Encoding_MP3,
+			DestEncoding: pb.Encoding_WAV,
+		})
+		assert.Nil(t, res, "response should be nil")
+		assert.NotNil(t, err, "%s should be rejected", sourceUrl)
+	}
+	assert.Empty(t, testConfig.Db.Data, "should not have queued a rejected source")
+	res, err := server.ConvertFile(context.Background(), &pb.ConvertFileRequest{
+		SourceUrl: "http://93.184.216.34/test.mp3",
+		SourceEncoding: pb.Encoding_MP3,
+		DestEncoding: pb.Encoding_WAV,
+	})
+	assert.Nil(t, err, "public sources should be accepted")
+	assert.NotNil(t, res)
+}
+
+func TestConverterServer_ConvertFile_SourceHeaders(t *testing.T) {
+	testConfig := testingConfiguration()
+	request := &pb.ConvertFileRequest{
+		SourceUrl: "https://example.com/test.mp3",
+		SourceEncoding: pb.Encoding_MP3,
+		DestEncoding: pb.Encoding_WAV,
+		IdempotencyKey: "test-key",
+		SourceHeaders: map[string]string{"Authorization": "Bearer test-token"},
+	}
+	server := converterservice.NewWithConfiguration(toServerConfiguration(testConfig))
+	_, err := server.ConvertFile(context.Background(), request)
+	assert.NotNil(t, err, "source headers should be rejected when no key is configured")
+	assert.Empty(t, testConfig.Db.Data)
+	cipher, err := fileconverter.NewHeaderCipher([]byte("test-source-header-key-32-bytes!"))
+	assert.Nil(t, err)
+	config := toServerConfiguration(testConfig)
+	config.SourceHeaderCipher = cipher
+	server = converterservice.NewWithConfiguration(config)
+	res, err := server.ConvertFile(context.Background(), request)
+	assert.Nil(t, err)
+	job, err := testConfig.Db.GetConversion(res.Id)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(job.Request.SourceHeaders), "test-token", "should not store the headers in plaintext")
+	headers, err := cipher.Open(res.Id, job.Request.SourceHeaders)
+	assert.Nil(t, err)
+	assert.Equal(t, fileconverter.SourceHeaders{"Authorization": "Bearer test-token"}, headers)
+	assert.Eventually(t, func() bool {
+		fetches, _ := testConfig.SourceFetcher.LastFetch()
+		return fetches > 0
+	}, 3 * time.Second, 10 * time.Millisecond)
+	_, fetchedHeaders := testConfig.SourceFetcher.LastFetch()
+	assert.Equal(t, headers, fetchedHeaders, "should fetch the source with its headers")
+	refreshed := *request
+	refreshed.SourceHeaders = map[string]string{"authorization": "Bearer refreshed-token"}
+	retry, err := server.ConvertFile(context.Background(), &refreshed)
+	assert.Nil(t, err, "retries may send refreshed credentials")
+	assert.Equal(t, res.Id, retry.Id)
+}
@@ -10,16 +10,47 @@ import (
 )
 
 type FileConverterRepository interface {
-	NewRequest(id string) (bool, error)
-	StartConversion(id string) (bool, error)
-	CompleteConversion(id string, url string) (bool, error)
-	FailConversion(id string) (bool, error)
+	NewRequest(id string, request *ConversionRequest) (bool, error)
+	StartConversion(id string, owner string) (bool, error)
+	CompleteConversion(id string, owner string, url string) (bool, error)
+	FailConversion(id string, owner string, code enums.ErrorCode, message string) (bool, error)
+	RequeueConversion(id string) (bool, error)
 	GetConversion(id string) (*ConvertJob, error)
+	GetTenantConversion(tenant string, id string) (*ConvertJob, error)
+	GetUnfinishedConversions(owner string) ([]*ConvertJob, error)
+	CountActiveConversions(caller string) (int, error)
+	ClaimConversion(owner string, lease time.Duration, oldestFirst bool) (*ConvertJob, error)
+	RenewLease(id string, owner string, lease time.Duration) (bool, error)
+	UpdateProgress(id string, progress *Progress) (bool, error)
+	CacheResult(hash string, objectKey string, expiresAt time.Time) (bool, error)
+	GetCachedResult(hash string) (*CachedResult, error)
+	EvictExpiredResults() (int64, error)
+	EvictExpiredIdempotencyKeys() (int64, error)
+	SaveIdempotencyKey(caller string, key string, requestHash string, jobId string) (bool, error)
+	NewIdempotentRequest(id string, request *ConversionRequest, caller string, key string, requestHash string) (bool, error)
+	GetIdempotencyKey(caller string, key string) (*IdempotencyRecord, error)
+	DeleteIdempotencyKey(caller string, key string) (bool, error)
+	NewWebhookDelivery(jobId string, url string, payload string, claimedUntil time.Time) (int64, error)
+	RecordWebhookAttempt(id int64, status enums.DeliveryStatus, responseCode int, message string,
+		claimedUntil time.Time) (bool, error)
+	ClaimUndeliveredWebhooks(jobId string, claimedUntil time.Time) ([]*WebhookDelivery, error)
+	ClaimAbandonedWebhooks(claimedUntil time.Time, limit int) ([]*WebhookDelivery, error)
+	CreateApiKey(id string, name string, tenant string, keyHash string) (bool, error)
+	GetApiKey(keyHash string) (*ApiKey, error)
+	SetApiKeyEnabled(id string, enabled bool) (bool, error)
+	RecordApiKeyUse(id string) (bool, error)
 }
 
 type DatabaseConnection interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Begin() (*sql.Tx, error)
+}
+
+// Runs statements on either the connection or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
 type FileConverterData struct {
@@ -28,30 +59,128 @@ type FileConverterData struct {
 
 // Struct representing a row in the file converter database
 type ConvertJob struct {
-	Id          string
-	Status      string
-	CurrUrl     string
-	LastUpdated time.Time
+	Id           string
+	Status       string
+	CurrUrl      string
+	LastUpdated  time.Time
+	ErrorCode    string
+	ErrorMessage string
+	Attempts     int
+	Progress     Progress
+	Request      ConversionRequest
+}
+
+// The parameters of a conversion, persisted so that unfinished jobs can be recovered
+type ConversionRequest struct {
+	SourceUrl      string
+	// Encodings and priority are stored by name
+	SourceEncoding string
+	DestEncoding   string
+	Priority       string
+	Timeout        time.Duration
+	SampleRate     int
+	Channels       int
+	// Where the job's webhook events are sent, or empty for none
+	CallbackUrl    string
+	// The tenant that owns the job, or empty for jobs created without an API key
+	Tenant         string
+	// The API key that created the job, which its quota is counted against
+	Caller         string
+	// The headers sent when fetching the source, encrypted so that credentials are not stored in plaintext
+	SourceHeaders  []byte
+}
+
+// How far a conversion has progressed
+type Progress struct {
+	// The percent of the input that has been converted
+	Percent   float64
+	// How much of the input has been converted
+	Processed time.Duration
+	// The conversion speed as a multiple of real time
+	Speed     float64
+}
+
+// Struct representing a row in the conversion cache, keyed by content address
+type CachedResult struct {
+	Hash      string
+	ObjectKey string
+	ExpiresAt time.Time
+}
+
+// Struct representing the job created for a caller's idempotency key
+type IdempotencyRecord struct {
+	Caller      string
+	Key         string
+	RequestHash string
+	JobId       string
+	CreatedAt   time.Time
+	// When the key may be used again for another request
+	ExpiresAt   time.Time
+}
+
+// Struct representing a webhook event and the outcome of delivering it
+type WebhookDelivery struct {
+	Id           int64
+	JobId        string
+	Url          string
+	// The JSON event, stored so that replays send the same body
+	Payload      string
+	Status       string
+	Attempts     int
+	// The HTTP status of the last attempt, or zero if no response was received
+	ResponseCode int
+	// Why the last attempt failed
+	Error        string
+	CreatedAt    time.Time
+	LastAttempt  time.Time
+	// Until when the instance delivering a pending event holds it, which is when its next attempt is due
+	NextAttempt  time.Time
+}
+
+// Struct representing an API key. Only the hash of the key itself is stored
+type ApiKey struct {
+	Id        string
+	Name      string
+	// The tenant whose jobs the key may create and read
+	Tenant    string
+	Enabled   bool
+	CreatedAt time.Time
+	// When the key was last used, or the zero time if it has never been used
+	LastUsed  time.Time
 }
 
 // Database constants
 const (
-	host       = "converter_db"
-	tableName  = "convert_jobs"
+	host                 = "converter_db"
+	tableName            = "convert_jobs"
+	cacheTableName       = "conversion_cache"
+	idempotencyTableName = "idempotency_keys"
+	webhookTableName     = "webhook_deliveries"
+	apiKeyTableName      = "api_keys"
 )
 
+// How often the last use of an API key is recorded, so that every request does not write to the database
+const apiKeyUseResolution = time.Minute
+
+// How long an idempotency key returns the job it created, after which it is evicted and may be used again
+const IdempotencyKeyTTL = 24 * time.Hour
 
 // FileConverterData constructor
 func NewFromCredentials(dbUser string, dbPass string) FileConverterRepository {
+	return &FileConverterData{
+		db: Connect(dbUser, dbPass),
+	}
+}
+
+// Opens a connection pool to the converter database, which can be shared with other users of the database
+func Connect(dbUser string, dbPass string) *sql.DB {
 	connstr := fmt.Sprintf("host=%s user=%s password=%s sslmode=disable", host, dbUser, dbPass)
 	log.Print(connstr)
 	db, err := sql.Open("postgres", connstr)
 	if err != nil {
 		log.Fatalf("failed to connect to database encountered, %v", err)
 	}
-	return &FileConverterData{
-		db: db,
-	}
+	return db
 }
 
 func NewFromConnection(db DatabaseConnection) FileConverterRepository {
@@ -67,45 +196,125 @@ func NewFromConnection(db DatabaseConnection) FileConverterRepository {
  *   Status string [QUEUED | CONVERTING | COMPLETED | FAILED]
  *   curr_url string
  *   last_updated timestamp
+ *   error_code string [see enums.ErrorCode]
+ *   error_message string
+ *   attempts int
+ *   progress_percent float
+ *   processed_ms int
+ *   speed float
+ *   source_url string
+ *   source_encoding string
+ *   dest_encoding string
+ *   priority string [see enums.Priority]
+ *   timeout_seconds int
+ *   sample_rate int
+ *   channels int
+ *   callback_url string
+ *   tenant string
+ *   caller string
+ *   source_headers bytea [encrypted]
+ *   lease_owner string
+ *   lease_expires_at timestamp
  */
-func (f *FileConverterData) NewRequest(id string) (bool, error) {
-	stmt := fmt.Sprintf("INSERT INTO %s VALUES ($1, $2, $3, $4)", tableName)
-	status, url, lastTime := enums.QUEUED.Name(), "NONE", time.Now()
-	_, err := f.db.Exec(stmt, id, status, url, lastTime)
-	if err != nil {
+func (f *FileConverterData) NewRequest(id string, request *ConversionRequest) (bool, error) {
+	if err := insertRequest(f.db, id, request); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
-// Updates the Status of the current file conversion to complete, including the presigned URL to the bucket object
-func (f *FileConverterData) StartConversion(id string) (bool, error) {
-	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, last_updated=$2 WHERE Id=$3", tableName)
+func insertRequest(conn execer, id string, request *ConversionRequest) error {
+	stmt := fmt.Sprintf("INSERT INTO %s (id, status, curr_url, last_updated, source_url, source_encoding, "+
+		"dest_encoding, priority, timeout_seconds, sample_rate, channels, callback_url, tenant, caller, "+
+		"source_headers) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)", tableName)
+	status, url, lastTime := enums.QUEUED.Name(), "NONE", time.Now()
+	_, err := conn.Exec(stmt, id, status, url, lastTime, request.SourceUrl, request.SourceEncoding,
+		request.DestEncoding, request.Priority, int(request.Timeout.Seconds()), request.SampleRate, request.Channels,
+		request.CallbackUrl, request.Tenant, request.Caller, request.SourceHeaders)
+	return err
+}
+
+// Updates the Status of the current file conversion to converting, counting the attempt and recording who runs it.
+// Returns false when the job is no longer queued or converting under the owner, such as when another worker
+// took over its lease
+func (f *FileConverterData) StartConversion(id string, owner string) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, attempts=attempts+1, last_updated=$2, lease_owner=$3 WHERE Id=$4 "+
+		"AND (Status='%s' OR (Status=$1 AND lease_owner=$3))", tableName, enums.QUEUED.Name())
 	status, lastUpdated := enums.CONVERTING.Name(), time.Now()
-	_, err := f.db.Exec(stmt, status, lastUpdated, id)
+	res, err := f.db.Exec(stmt, status, lastUpdated, owner, id)
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
 }
 
-//Updates the Status of the current file conversion to complete, including the presigned URL to the bucket object
-func (f *FileConverterData) CompleteConversion(id string, url string) (bool, error) {
-	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, curr_url=$2, last_updated=$3 WHERE Id=$4", tableName)
+/*
+ * Matches jobs that are not converting, or are converting under the owner bound to the parameter.
+ * Only the owner of a converting job may finish it, so that a worker whose lease was taken over
+ * cannot overwrite the result of the worker now running the job
+ */
+func ownedBy(param string) string {
+	return fmt.Sprintf("(Status<>'%s' OR lease_owner=%s)", enums.CONVERTING.Name(), param)
+}
+
+//Updates the Status of the current file conversion to complete, including the presigned URL to the bucket object.
+//Returns false when the job is converting under another owner
+func (f *FileConverterData) CompleteConversion(id string, owner string, url string) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, curr_url=$2, last_updated=$3 WHERE Id=$4 AND %s", tableName,
+		ownedBy("$5"))
 	status, lastUpdated := enums.COMPLETED.Name(), time.Now()
-	_, err := f.db.Exec(stmt, status, url, lastUpdated, id)
+	res, err := f.db.Exec(stmt, status, url, lastUpdated, id, owner)
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
 }
 
+// Returns an interrupted conversion to the queue. Returns false when the job was no longer converting
+func (f *FileConverterData) RequeueConversion(id string) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, last_updated=$2 WHERE Id=$3 AND Status=$4", tableName)
+	res, err := f.db.Exec(stmt, enums.QUEUED.Name(), time.Now(), id, enums.CONVERTING.Name())
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
 
-// Updates the Status of the specified file conversion to failed, along with the timestamp of failure
-func (f *FileConverterData) FailConversion(id string) (bool, error) {
-	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, last_updated=$2 WHERE Id=$3", tableName)
+// Updates the Status of the specified file conversion to failed, along with the reason and timestamp of failure.
+// Returns false when the job is converting under another owner
+func (f *FileConverterData) FailConversion(id string, owner string, code enums.ErrorCode, message string) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET Status=$1, error_code=$2, error_message=$3, last_updated=$4 WHERE Id=$5 AND %s",
+		tableName, ownedBy("$6"))
 	status, lastUpdated := enums.FAILED.Name(), time.Now()
-	_, err := f.db.Exec(stmt, status, lastUpdated, id)
+	res, err := f.db.Exec(stmt, status, code.Name(), message, lastUpdated, id, owner)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// Updates the progress of a running file conversion
+func (f *FileConverterData) UpdateProgress(id string, progress *Progress) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET progress_percent=$1, processed_ms=$2, speed=$3, last_updated=$4 WHERE Id=$5",
+		tableName)
+	processedMs := progress.Processed.Milliseconds()
+	_, err := f.db.Exec(stmt, progress.Percent, processedMs, progress.Speed, time.Now(), id)
 	if err != nil {
 		return false, err
 	}
@@ -114,15 +323,384 @@ func (f *FileConverterData) FailConversion(id string) (bool, error) {
 
 // Fetches convert job from the database
 func (f *FileConverterData) GetConversion(id string) (*ConvertJob, error) {
-	stmt := fmt.Sprintf("SELECT * FROM %s WHERE Id=$1", tableName)
+	stmt := fmt.Sprintf("SELECT %s FROM %s WHERE Id=$1", jobColumns, tableName)
+	return scanJob(f.db.QueryRow(stmt, id))
+}
+
+// Fetches a convert job only if it belongs to the tenant, so that tenants cannot read each other's jobs
+func (f *FileConverterData) GetTenantConversion(tenant string, id string) (*ConvertJob, error) {
+	stmt := fmt.Sprintf("SELECT %s FROM %s WHERE Id=$1 AND tenant=$2", jobColumns, tableName)
+	return scanJob(f.db.QueryRow(stmt, id, tenant))
+}
+
+// Fetches the jobs that are queued, and those converting that were started by the owner, oldest first
+func (f *FileConverterData) GetUnfinishedConversions(owner string) ([]*ConvertJob, error) {
+	stmt := fmt.Sprintf("SELECT %s FROM %s WHERE Status=$1 OR (Status=$2 AND lease_owner=$3) ORDER BY last_updated",
+		jobColumns, tableName)
+	rows, err := f.db.Query(stmt, enums.QUEUED.Name(), enums.CONVERTING.Name(), owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*ConvertJob
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+/*
+ * Claims the highest priority queued job for the owner, oldest first, leasing it for the given duration.
+ * When oldestFirst is set the oldest job is claimed whatever its priority, so that low priority jobs are not starved.
+ * A converting job whose lease has expired was abandoned by a crashed worker and is claimed again.
+ * Rows locked by another claim are skipped rather than waited on. Returns nil when there is no job to claim
+ */
+func (f *FileConverterData) ClaimConversion(owner string, lease time.Duration, oldestFirst bool) (*ConvertJob, error) {
+	order := priorityRank + " DESC, last_updated"
+	if oldestFirst {
+		order = "last_updated"
+	}
+	stmt := fmt.Sprintf("UPDATE %[1]s SET Status=$1, lease_owner=$2, lease_expires_at=$3, last_updated=$4 "+
+		"WHERE Id = (SELECT Id FROM %[1]s WHERE Status=$5 OR (Status=$1 AND lease_expires_at < $4) "+
+		"ORDER BY %[2]s LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING %[3]s",
+		tableName, order, jobColumns)
+	now := time.Now()
+	job, err := scanJob(f.db.QueryRow(stmt, enums.CONVERTING.Name(), owner, now.Add(lease), now, enums.QUEUED.Name()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// Extends the lease on a converting job. Returns false when the owner no longer holds the lease
+func (f *FileConverterData) RenewLease(id string, owner string, lease time.Duration) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET lease_expires_at=$1 WHERE Id=$2 AND lease_owner=$3 AND Status=$4", tableName)
+	res, err := f.db.Exec(stmt, time.Now().Add(lease), id, owner, enums.CONVERTING.Name())
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// Counts the caller's jobs that are queued or converting
+func (f *FileConverterData) CountActiveConversions(caller string) (int, error) {
+	stmt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE caller=$1 AND Status IN ($2, $3)", tableName)
+	var count int
+	err := f.db.QueryRow(stmt, caller, enums.QUEUED.Name(), enums.CONVERTING.Name()).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Orders jobs by the rank of their priority, treating jobs without a priority as NORMAL
+var priorityRank = fmt.Sprintf("CASE priority WHEN '%s' THEN %d WHEN '%s' THEN %d ELSE %d END",
+	enums.HIGH.Name(), enums.HIGH.Rank(), enums.LOW.Name(), enums.LOW.Rank(), enums.NORMAL.Rank())
+
+// The columns read into a ConvertJob. Jobs created before requests were persisted have no request columns
+const jobColumns = "id, status, curr_url, last_updated, COALESCE(error_code, ''), COALESCE(error_message, ''), " +
+	"attempts, progress_percent, processed_ms, speed, COALESCE(source_url, ''), COALESCE(source_encoding, ''), " +
+	"COALESCE(dest_encoding, ''), COALESCE(priority, ''), COALESCE(timeout_seconds, 0), COALESCE(sample_rate, 0), " +
+	"COALESCE(channels, 0), COALESCE(callback_url, ''), tenant, caller, source_headers"
+
+// A row of jobColumns, from either QueryRow or Query
+type jobRow interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row jobRow) (*ConvertJob, error) {
+	var (
+		job            ConvertJob
+		processedMs    int64
+		timeoutSeconds int
+	)
+	err := row.Scan(&job.Id, &job.Status, &job.CurrUrl, &job.LastUpdated, &job.ErrorCode, &job.ErrorMessage,
+		&job.Attempts, &job.Progress.Percent, &processedMs, &job.Progress.Speed, &job.Request.SourceUrl,
+		&job.Request.SourceEncoding, &job.Request.DestEncoding, &job.Request.Priority, &timeoutSeconds,
+		&job.Request.SampleRate, &job.Request.Channels, &job.Request.CallbackUrl, &job.Request.Tenant,
+		&job.Request.Caller, &job.Request.SourceHeaders)
+	if err != nil {
+		return nil, err
+	}
+	job.Progress.Processed = time.Duration(processedMs) * time.Millisecond
+	job.Request.Timeout = time.Duration(timeoutSeconds) * time.Second
+	return &job, nil
+}
+
+/*
+ * Records the object holding the converted output for a content address.
+ * The entry is only valid until expiresAt, which should match the expiry of the object itself
+ */
+func (f *FileConverterData) CacheResult(hash string, objectKey string, expiresAt time.Time) (bool, error) {
+	stmt := fmt.Sprintf("INSERT INTO %s VALUES ($1, $2, $3) "+
+		"ON CONFLICT (hash) DO UPDATE SET object_key=EXCLUDED.object_key, expires_at=EXCLUDED.expires_at", cacheTableName)
+	_, err := f.db.Exec(stmt, hash, objectKey, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Fetches an unexpired cache entry for the content address. Returns nil when there is no entry
+func (f *FileConverterData) GetCachedResult(hash string) (*CachedResult, error) {
+	stmt := fmt.Sprintf("SELECT hash, object_key, expires_at FROM %s WHERE hash=$1 AND expires_at > $2", cacheTableName)
 	var (
-		status string
-		currUrl string
-		lastUpdated time.Time
+		objectKey string
+		expiresAt time.Time
 	)
-	err := f.db.QueryRow(stmt, id).Scan(&id, &status, &currUrl, &lastUpdated)
+	err := f.db.QueryRow(stmt, hash, time.Now()).Scan(&hash, &objectKey, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &ConvertJob{id, status, currUrl, lastUpdated}, nil
-}
\ No newline at end of file
+	return &CachedResult{hash, objectKey, expiresAt}, nil
+}
+
+// Removes cache entries whose objects have expired, returning the number of entries removed
+func (f *FileConverterData) EvictExpiredResults() (int64, error) {
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE expires_at <= $1", cacheTableName)
+	res, err := f.db.Exec(stmt, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Deletes the idempotency keys that have expired, returning how many were deleted
+func (f *FileConverterData) EvictExpiredIdempotencyKeys() (int64, error) {
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE expires_at <= $1", idempotencyTableName)
+	res, err := f.db.Exec(stmt, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/*
+ * Claims an idempotency key for a caller until it expires, recording the hash of the request payload and the job
+ * it created. An expired key that has not been evicted yet is claimed again.
+ * Returns false without error when the caller has already used the key
+ */
+func (f *FileConverterData) SaveIdempotencyKey(caller string, key string, requestHash string, jobId string) (bool, error) {
+	return insertIdempotencyKey(f.db, caller, key, requestHash, jobId)
+}
+
+func insertIdempotencyKey(conn execer, caller string, key string, requestHash string, jobId string) (bool, error) {
+	stmt := fmt.Sprintf("INSERT INTO %[1]s (caller, key, request_hash, job_id, created_at, expires_at) "+
+		"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (caller, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, "+
+		"job_id=EXCLUDED.job_id, created_at=EXCLUDED.created_at, expires_at=EXCLUDED.expires_at "+
+		"WHERE %[1]s.expires_at <= EXCLUDED.created_at", idempotencyTableName)
+	now := time.Now()
+	res, err := conn.Exec(stmt, caller, key, requestHash, jobId, now, now.Add(IdempotencyKeyTTL))
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted > 0, nil
+}
+
+/*
+ * Claims the caller's idempotency key and inserts the job it creates in one transaction, so that the key never
+ * names a job that does not exist yet. A concurrent claim of the same key waits for the transaction to finish.
+ * Returns false without inserting the job when the caller has already used the key
+ */
+func (f *FileConverterData) NewIdempotentRequest(id string, request *ConversionRequest, caller string, key string,
+	requestHash string) (bool, error) {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	claimed, err := insertIdempotencyKey(tx, caller, key, requestHash, id)
+	if err == nil && claimed {
+		err = insertRequest(tx, id, request)
+	}
+	if err != nil || !claimed {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("failed to roll back the request for %s, encountered %v", id, rollbackErr)
+		}
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Fetches the record for a caller's idempotency key. Returns nil when the key has not been used or has expired
+func (f *FileConverterData) GetIdempotencyKey(caller string, key string) (*IdempotencyRecord, error) {
+	stmt := fmt.Sprintf("SELECT caller, key, request_hash, job_id, created_at, expires_at FROM %s "+
+		"WHERE caller=$1 AND key=$2 AND expires_at > $3", idempotencyTableName)
+	var (
+		requestHash string
+		jobId       string
+		createdAt   time.Time
+		expiresAt   time.Time
+	)
+	err := f.db.QueryRow(stmt, caller, key, time.Now()).Scan(&caller, &key, &requestHash, &jobId, &createdAt,
+		&expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &IdempotencyRecord{caller, key, requestHash, jobId, createdAt, expiresAt}, nil
+}
+
+// Releases a caller's idempotency key so that it can be used again
+func (f *FileConverterData) DeleteIdempotencyKey(caller string, key string) (bool, error) {
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE caller=$1 AND key=$2", idempotencyTableName)
+	_, err := f.db.Exec(stmt, caller, key)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// The columns of a webhook delivery, in the order scanned by scanWebhookDeliveries
+const webhookColumns = "id, job_id, url, payload, status, attempts, COALESCE(response_code, 0), COALESCE(error, ''), " +
+	"created_at, COALESCE(last_attempt, created_at), COALESCE(next_attempt, created_at)"
+
+// Records a webhook event to be delivered for a job, claimed by the caller until the given time,
+// and returns the id of the delivery
+func (f *FileConverterData) NewWebhookDelivery(jobId string, url string, payload string,
+	claimedUntil time.Time) (int64, error) {
+	stmt := fmt.Sprintf("INSERT INTO %s (job_id, url, payload, status, attempts, created_at, next_attempt) "+
+		"VALUES ($1, $2, $3, $4, 0, $5, $6) RETURNING id", webhookTableName)
+	var id int64
+	err := f.db.QueryRow(stmt, jobId, url, payload, enums.DELIVERY_PENDING.Name(), time.Now(), claimedUntil).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Records the outcome of an attempt to deliver a webhook event. A pending event stays claimed until the given time
+func (f *FileConverterData) RecordWebhookAttempt(id int64, status enums.DeliveryStatus, responseCode int,
+	message string, claimedUntil time.Time) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET status=$1, attempts=attempts+1, response_code=$2, error=$3, last_attempt=$4, "+
+		"next_attempt=$5 WHERE id=$6", webhookTableName)
+	_, err := f.db.Exec(stmt, status.Name(), responseCode, message, time.Now(), claimedUntil, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Claims a job's failed webhook deliveries and the pending ones no instance holds, oldest first.
+// Pending deliveries that are still being attempted are skipped
+func (f *FileConverterData) ClaimUndeliveredWebhooks(jobId string, claimedUntil time.Time) ([]*WebhookDelivery, error) {
+	stmt := fmt.Sprintf("WITH claimed AS (UPDATE %s SET next_attempt=$1 WHERE job_id=$2 AND "+
+		"(status=$3 OR (status=$4 AND COALESCE(next_attempt, created_at)<=$5)) RETURNING *) "+
+		"SELECT %s FROM claimed ORDER BY id", webhookTableName, webhookColumns)
+	rows, err := f.db.Query(stmt, claimedUntil, jobId, enums.DELIVERY_FAILED.Name(), enums.DELIVERY_PENDING.Name(),
+		time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// Claims up to limit pending webhook deliveries whose claim has expired, such as those interrupted by a restart,
+// oldest first. Deliveries claimed by another instance are skipped
+func (f *FileConverterData) ClaimAbandonedWebhooks(claimedUntil time.Time, limit int) ([]*WebhookDelivery, error) {
+	stmt := fmt.Sprintf("WITH claimed AS (UPDATE %s SET next_attempt=$1 WHERE id IN (SELECT id FROM %s "+
+		"WHERE status=$2 AND COALESCE(next_attempt, created_at)<=$3 ORDER BY id LIMIT $4 FOR UPDATE SKIP LOCKED) "+
+		"RETURNING *) SELECT %s FROM claimed ORDER BY id", webhookTableName, webhookTableName, webhookColumns)
+	rows, err := f.db.Query(stmt, claimedUntil, enums.DELIVERY_PENDING.Name(), time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.Id, &d.JobId, &d.Url, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error,
+			&d.CreatedAt, &d.LastAttempt, &d.NextAttempt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Stores a new, enabled API key for the tenant by the SHA-256 hash of the key
+func (f *FileConverterData) CreateApiKey(id string, name string, tenant string, keyHash string) (bool, error) {
+	stmt := fmt.Sprintf("INSERT INTO %s (id, name, tenant, key_hash, enabled, created_at) "+
+		"VALUES ($1, $2, $3, $4, TRUE, $5)", apiKeyTableName)
+	_, err := f.db.Exec(stmt, id, name, tenant, keyHash, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Fetches the API key with the given hash. Returns nil when there is no such key
+func (f *FileConverterData) GetApiKey(keyHash string) (*ApiKey, error) {
+	stmt := fmt.Sprintf("SELECT id, name, tenant, enabled, created_at, last_used FROM %s WHERE key_hash=$1",
+		apiKeyTableName)
+	var (
+		key      ApiKey
+		lastUsed sql.NullTime
+	)
+	err := f.db.QueryRow(stmt, keyHash).Scan(&key.Id, &key.Name, &key.Tenant, &key.Enabled, &key.CreatedAt, &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.LastUsed = lastUsed.Time
+	return &key, nil
+}
+
+// Enables or disables an API key. Returns false when there is no such key
+func (f *FileConverterData) SetApiKeyEnabled(id string, enabled bool) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET enabled=$1 WHERE id=$2", apiKeyTableName)
+	res, err := f.db.Exec(stmt, enabled, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+/*
+ * Records that an API key was used. Uses within apiKeyUseResolution of the last recorded use are not written,
+ * so returns false for them
+ */
+func (f *FileConverterData) RecordApiKeyUse(id string) (bool, error) {
+	stmt := fmt.Sprintf("UPDATE %s SET last_used=$1 WHERE id=$2 AND (last_used IS NULL OR last_used < $3)",
+		apiKeyTableName)
+	now := time.Now()
+	res, err := f.db.Exec(stmt, now, id, now.Add(-apiKeyUseResolution))
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
@@ -65,13 +65,53 @@ func TestNewWithConn(t *testing.T) {
 	assert.NotNil(t, repo)
 }
 
+var jobColumnNames = []string{
+	"Id",
+	"Status",
+	"CurrUrl",
+	"Last_Updated",
+	"Error_Code",
+	"Error_Message",
+	"Attempts",
+	"Progress_Percent",
+	"Processed_Ms",
+	"Speed",
+	"Source_Url",
+	"Source_Encoding",
+	"Dest_Encoding",
+	"Priority",
+	"Timeout_Seconds",
+	"Sample_Rate",
+	"Channels",
+	"Callback_Url",
+	"Tenant",
+	"Caller",
+	"Source_Headers",
+}
+
+var testRequest = &ConversionRequest{
+	SourceUrl: "test-source-url",
+	SourceEncoding: enums.MP3.Name(),
+	DestEncoding: enums.WAV.Name(),
+	Priority: enums.HIGH.Name(),
+	Timeout: 90 * time.Second,
+	SampleRate: 22050,
+	Channels: 1,
+	CallbackUrl: "https://example.com/hook",
+	Tenant: "test-tenant",
+	Caller: "key:test-key",
+	SourceHeaders: []byte("test-sealed-headers"),
+}
+
 func TestFileConverterData_NewRequest(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", tableName)).
-		WithArgs(b.id, enums.QUEUED.Name(), "NONE", AnyTime{}).
+		WithArgs(b.id, enums.QUEUED.Name(), "NONE", AnyTime{}, testRequest.SourceUrl, testRequest.SourceEncoding,
+			testRequest.DestEncoding, testRequest.Priority, 90, testRequest.SampleRate, testRequest.Channels,
+			testRequest.CallbackUrl, testRequest.Tenant, testRequest.Caller, testRequest.SourceHeaders).
 		WillReturnResult(sqlmock.NewResult(1,1))
-	if _, err := b.repo.NewRequest(b.id); err != nil {
+	if _, err := b.repo.NewRequest(b.id, testRequest); err != nil {
 		t.Error(err.Error())
 	}
 }
@@ -80,9 +120,11 @@ func TestFileConverterData_NewRequest_Fail(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", tableName)).
-		WithArgs(b.id, enums.QUEUED.Name(), "NONE", AnyTime{}).
+		WithArgs(b.id, enums.QUEUED.Name(), "NONE", AnyTime{}, testRequest.SourceUrl, testRequest.SourceEncoding,
+			testRequest.DestEncoding, testRequest.Priority, 90, testRequest.SampleRate, testRequest.Channels,
+			testRequest.CallbackUrl, testRequest.Tenant, testRequest.Caller, testRequest.SourceHeaders).
 		WillReturnError(testingError)
-	if _, err := b.repo.NewRequest(b.id); err == nil {
+	if _, err := b.repo.NewRequest(b.id, testRequest); err == nil {
 		t.Error(errorExpectedError)
 	}
 }
@@ -91,20 +133,35 @@ func TestFileConverterData_StartConversion_Success(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.CONVERTING.Name(), AnyTime{}, b.id).
+		WithArgs(enums.CONVERTING.Name(), AnyTime{}, "test-owner", b.id).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	if _, err := b.repo.StartConversion(b.id); err != nil {
+	if _, err := b.repo.StartConversion(b.id, "test-owner"); err != nil {
 		t.Error(err.Error())
 	}
 }
 
+func TestFileConverterData_StartConversion_LeaseLost(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
+		WithArgs(enums.CONVERTING.Name(), AnyTime{}, "test-owner", b.id).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	started, err := b.repo.StartConversion(b.id, "test-owner")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if started {
+		t.Error("should not start a job converting under another owner")
+	}
+}
+
 func TestFileConverterData_StartConversion_Fail(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.CONVERTING.Name(), AnyTime{}, b.id).
+		WithArgs(enums.CONVERTING.Name(), AnyTime{}, "test-owner", b.id).
 		WillReturnError(testingError)
-	if _, err := b.repo.StartConversion(b.id); err == nil {
+	if _, err := b.repo.StartConversion(b.id, "test-owner"); err == nil {
 		t.Error(errorExpectedError)
 	}
 }
@@ -114,10 +171,20 @@ func TestFileConverterData_CompleteConversion_Success(t *testing.T) {
 	defer AfterEach(t, b)
 	testUrl := "test-url"
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.COMPLETED.Name(), testUrl, AnyTime{}, b.id).
+		WithArgs(enums.COMPLETED.Name(), testUrl, AnyTime{}, b.id, "test-owner").
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	if _, err := b.repo.CompleteConversion(b.id, testUrl); err != nil {
+	if completed, err := b.repo.CompleteConversion(b.id, "test-owner", testUrl); err != nil {
 		t.Error(err.Error())
+	} else if !completed {
+		t.Error("should have completed the job")
+	}
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET (.+) AND \\(Status<>'CONVERTING' OR lease_owner=\\$5\\)", tableName)).
+		WithArgs(enums.COMPLETED.Name(), testUrl, AnyTime{}, b.id, "other-owner").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if completed, err := b.repo.CompleteConversion(b.id, "other-owner", testUrl); err != nil {
+		t.Error(err.Error())
+	} else if completed {
+		t.Error("should not complete a job converting under another owner")
 	}
 }
 
@@ -126,9 +193,9 @@ func TestFileConverterData_CompleteConversion_Fail(t *testing.T) {
 	defer AfterEach(t, b)
 	testUrl := "test-url"
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.COMPLETED.Name(), testUrl, AnyTime{}, b.id).
+		WithArgs(enums.COMPLETED.Name(), testUrl, AnyTime{}, b.id, "test-owner").
 		WillReturnError(testingError)
-	if _, err := b.repo.CompleteConversion(b.id, "test-url"); err == nil {
+	if _, err := b.repo.CompleteConversion(b.id, "test-owner", "test-url"); err == nil {
 		t.Error(errorExpectedError)
 	}
 }
@@ -137,9 +204,9 @@ func TestFileConverterData_FailConversion_Success(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.FAILED.Name(), AnyTime{}, b.id).
+		WithArgs(enums.FAILED.Name(), enums.UPLOAD_FAILED.Name(), "test-message", AnyTime{}, b.id, "test-owner").
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	if _, err := b.repo.FailConversion(b.id); err != nil {
+	if _, err := b.repo.FailConversion(b.id, "test-owner", enums.UPLOAD_FAILED, "test-message"); err != nil {
 		t.Error(err.Error())
 	}
 }
@@ -148,13 +215,42 @@ func TestFileConverterData_FailConversion_Fail(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
 	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
-		WithArgs(enums.FAILED.Name(), AnyTime{}, b.id).
+		WithArgs(enums.FAILED.Name(), enums.UPLOAD_FAILED.Name(), "test-message", AnyTime{}, b.id, "test-owner").
 		WillReturnError(testingError)
-	if _, err := b.repo.FailConversion(b.id); err == nil {
+	if _, err := b.repo.FailConversion(b.id, "test-owner", enums.UPLOAD_FAILED, "test-message"); err == nil {
 		t.Error(errorExpectedError)
 	}
 }
 
+func TestFileConverterData_RequeueConversion(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
+		WithArgs(enums.QUEUED.Name(), AnyTime{}, b.id, enums.CONVERTING.Name()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	requeued, err := b.repo.RequeueConversion(b.id)
+	assert.Nil(t, err)
+	assert.True(t, requeued)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", tableName)).
+		WithArgs(enums.QUEUED.Name(), AnyTime{}, b.id, enums.CONVERTING.Name()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	requeued, err = b.repo.RequeueConversion(b.id)
+	assert.Nil(t, err)
+	assert.False(t, requeued)
+}
+
+func TestFileConverterData_UpdateProgress(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	progress := &Progress{Percent: 42.5, Processed: 1500 * time.Millisecond, Speed: 2}
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET progress_percent", tableName)).
+		WithArgs(progress.Percent, int64(1500), progress.Speed, AnyTime{}, b.id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := b.repo.UpdateProgress(b.id, progress); err != nil {
+		t.Error(err.Error())
+	}
+}
+
 func TestFileConverterData_GetConversion_Success(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
@@ -162,15 +258,18 @@ func TestFileConverterData_GetConversion_Success(t *testing.T) {
 	status := enums.COMPLETED.Name()
 	currUrl := "test-url"
 	lastUpdated := time.Now()
-	columns := []string{
-		"Id",
-		"Status",
-		"CurrUrl",
-		"Last_Updated",
-	}
-	b.mock.ExpectQuery(fmt.Sprintf("SELECT \\* FROM %s", tableName)).
+	errorCode := enums.NO_ERROR.Name()
+	errorMessage := "test-message"
+	attempts := 2
+	progress := Progress{Percent: 100, Processed: 90 * time.Second, Speed: 1.5}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", tableName)).
 		WithArgs(b.id).
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(id, status, currUrl, lastUpdated))
+		WillReturnRows(sqlmock.NewRows(jobColumnNames).
+			AddRow(id, status, currUrl, lastUpdated, errorCode, errorMessage, attempts,
+				progress.Percent, progress.Processed.Milliseconds(), progress.Speed, testRequest.SourceUrl,
+				testRequest.SourceEncoding, testRequest.DestEncoding, testRequest.Priority, 90,
+				testRequest.SampleRate, testRequest.Channels, testRequest.CallbackUrl, testRequest.Tenant,
+				testRequest.Caller, testRequest.SourceHeaders))
 	res, err := b.repo.GetConversion(id)
 	assert.Nil(t, err)
 	assert.NotNil(t, res)
@@ -178,15 +277,453 @@ func TestFileConverterData_GetConversion_Success(t *testing.T) {
 	assert.Equal(t, status, res.Status)
 	assert.Equal(t, currUrl, res.CurrUrl)
 	assert.Equal(t, lastUpdated, res.LastUpdated)
+	assert.Equal(t, errorCode, res.ErrorCode)
+	assert.Equal(t, errorMessage, res.ErrorMessage)
+	assert.Equal(t, attempts, res.Attempts)
+	assert.Equal(t, progress, res.Progress)
+	assert.Equal(t, *testRequest, res.Request)
+}
+
+func TestFileConverterData_GetUnfinishedConversions(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	lastUpdated := time.Now()
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", tableName)).
+		WithArgs(enums.QUEUED.Name(), enums.CONVERTING.Name(), "test-owner").
+		WillReturnRows(sqlmock.NewRows(jobColumnNames).
+			AddRow("queued-id", enums.QUEUED.Name(), "NONE", lastUpdated, "", "", 0, 0, 0, 0,
+				testRequest.SourceUrl, testRequest.SourceEncoding, testRequest.DestEncoding, testRequest.Priority, 90,
+				testRequest.SampleRate, testRequest.Channels, testRequest.CallbackUrl, testRequest.Tenant,
+				testRequest.Caller, testRequest.SourceHeaders).
+			AddRow("converting-id", enums.CONVERTING.Name(), "NONE", lastUpdated, "", "", 1, 50, 1000, 1,
+				testRequest.SourceUrl, testRequest.SourceEncoding, testRequest.DestEncoding, testRequest.Priority, 90,
+				testRequest.SampleRate, testRequest.Channels, testRequest.CallbackUrl, testRequest.Tenant,
+				testRequest.Caller, testRequest.SourceHeaders))
+	jobs, err := b.repo.GetUnfinishedConversions("test-owner")
+	assert.Nil(t, err)
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, "queued-id", jobs[0].Id)
+		assert.Equal(t, enums.CONVERTING.Name(), jobs[1].Status)
+		assert.Equal(t, *testRequest, jobs[1].Request)
+	}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", tableName)).
+		WithArgs(enums.QUEUED.Name(), enums.CONVERTING.Name(), "test-owner").
+		WillReturnError(testingError)
+	jobs, err = b.repo.GetUnfinishedConversions("test-owner")
+	assert.Nil(t, jobs)
+	assert.NotNil(t, err)
+}
+
+func TestFileConverterData_CountActiveConversions(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT COUNT(.+) FROM %s", tableName)).
+		WithArgs(testRequest.Caller, enums.QUEUED.Name(), enums.CONVERTING.Name()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	count, err := b.repo.CountActiveConversions(testRequest.Caller)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT COUNT(.+) FROM %s", tableName)).
+		WithArgs(testRequest.Caller, enums.QUEUED.Name(), enums.CONVERTING.Name()).
+		WillReturnError(testingError)
+	_, err = b.repo.CountActiveConversions(testRequest.Caller)
+	assert.NotNil(t, err)
+}
+
+func TestFileConverterData_ClaimConversion(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	lastUpdated := time.Now()
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s (.+) FOR UPDATE SKIP LOCKED", tableName)).
+		WithArgs(enums.CONVERTING.Name(), "test-owner", AnyTime{}, AnyTime{}, enums.QUEUED.Name()).
+		WillReturnRows(sqlmock.NewRows(jobColumnNames).
+			AddRow(b.id, enums.CONVERTING.Name(), "NONE", lastUpdated, "", "", 0, 0, 0, 0,
+				testRequest.SourceUrl, testRequest.SourceEncoding, testRequest.DestEncoding, testRequest.Priority, 90,
+				testRequest.SampleRate, testRequest.Channels, testRequest.CallbackUrl, testRequest.Tenant,
+				testRequest.Caller, testRequest.SourceHeaders))
+	job, err := b.repo.ClaimConversion("test-owner", time.Minute, false)
+	assert.Nil(t, err)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, b.id, job.Id)
+		assert.Equal(t, *testRequest, job.Request)
+	}
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s (.+) FOR UPDATE SKIP LOCKED", tableName)).
+		WithArgs(enums.CONVERTING.Name(), "test-owner", AnyTime{}, AnyTime{}, enums.QUEUED.Name()).
+		WillReturnRows(sqlmock.NewRows(jobColumnNames))
+	job, err = b.repo.ClaimConversion("test-owner", time.Minute, false)
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s (.+) FOR UPDATE SKIP LOCKED", tableName)).
+		WithArgs(enums.CONVERTING.Name(), "test-owner", AnyTime{}, AnyTime{}, enums.QUEUED.Name()).
+		WillReturnError(testingError)
+	job, err = b.repo.ClaimConversion("test-owner", time.Minute, false)
+	assert.Nil(t, job)
+	assert.NotNil(t, err)
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s (.+) ORDER BY last_updated LIMIT 1 FOR UPDATE SKIP LOCKED", tableName)).
+		WithArgs(enums.CONVERTING.Name(), "test-owner", AnyTime{}, AnyTime{}, enums.QUEUED.Name()).
+		WillReturnRows(sqlmock.NewRows(jobColumnNames))
+	job, err = b.repo.ClaimConversion("test-owner", time.Minute, true)
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+}
+
+func TestFileConverterData_RenewLease(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET lease_expires_at", tableName)).
+		WithArgs(AnyTime{}, b.id, "test-owner", enums.CONVERTING.Name()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	renewed, err := b.repo.RenewLease(b.id, "test-owner", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, renewed)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET lease_expires_at", tableName)).
+		WithArgs(AnyTime{}, b.id, "test-owner", enums.CONVERTING.Name()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	renewed, err = b.repo.RenewLease(b.id, "test-owner", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, renewed)
 }
 
 func TestFileConverterData_GetConversion_Fail(t *testing.T) {
 	b := BeforeEach(t)
 	defer AfterEach(t, b)
-	b.mock.ExpectQuery(fmt.Sprintf("SELECT \\* FROM %s", tableName)).
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", tableName)).
 		WithArgs(b.id).
 		WillReturnError(testingError)
 	res, err := b.repo.GetConversion(b.id)
 	assert.Nil(t, res)
 	assert.NotNil(t, err)
 }
+
+func TestFileConverterData_GetTenantConversion(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	lastUpdated := time.Now()
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s WHERE Id=(.+) AND tenant=", tableName)).
+		WithArgs(b.id, testRequest.Tenant).
+		WillReturnRows(sqlmock.NewRows(jobColumnNames).
+			AddRow(b.id, enums.QUEUED.Name(), "NONE", lastUpdated, "", "", 0, 0, 0, 0,
+				testRequest.SourceUrl, testRequest.SourceEncoding, testRequest.DestEncoding, testRequest.Priority, 90,
+				testRequest.SampleRate, testRequest.Channels, testRequest.CallbackUrl, testRequest.Tenant,
+				testRequest.Caller, testRequest.SourceHeaders))
+	res, err := b.repo.GetTenantConversion(testRequest.Tenant, b.id)
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, *testRequest, res.Request)
+	}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s WHERE Id=(.+) AND tenant=", tableName)).
+		WithArgs(b.id, "other-tenant").
+		WillReturnError(sql.ErrNoRows)
+	res, err = b.repo.GetTenantConversion("other-tenant", b.id)
+	assert.Nil(t, res)
+	assert.NotNil(t, err)
+}
+
+func TestFileConverterData_CacheResult_Success(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	hash, expiresAt := "test-hash", time.Now().Add(time.Hour)
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", cacheTableName)).
+		WithArgs(hash, b.id, expiresAt).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := b.repo.CacheResult(hash, b.id, expiresAt); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestFileConverterData_CacheResult_Fail(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	hash, expiresAt := "test-hash", time.Now().Add(time.Hour)
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", cacheTableName)).
+		WithArgs(hash, b.id, expiresAt).
+		WillReturnError(testingError)
+	if _, err := b.repo.CacheResult(hash, b.id, expiresAt); err == nil {
+		t.Error(errorExpectedError)
+	}
+}
+
+func TestFileConverterData_GetCachedResult_Hit(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	hash, expiresAt := "test-hash", time.Now().Add(time.Hour)
+	columns := []string{"hash", "object_key", "expires_at"}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", cacheTableName)).
+		WithArgs(hash, AnyTime{}).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(hash, b.id, expiresAt))
+	res, err := b.repo.GetCachedResult(hash)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, hash, res.Hash)
+	assert.Equal(t, b.id, res.ObjectKey)
+	assert.Equal(t, expiresAt, res.ExpiresAt)
+}
+
+func TestFileConverterData_GetCachedResult_Miss(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	hash := "test-hash"
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", cacheTableName)).
+		WithArgs(hash, AnyTime{}).
+		WillReturnError(sql.ErrNoRows)
+	res, err := b.repo.GetCachedResult(hash)
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+}
+
+func TestFileConverterData_GetCachedResult_Fail(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	hash := "test-hash"
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", cacheTableName)).
+		WithArgs(hash, AnyTime{}).
+		WillReturnError(testingError)
+	res, err := b.repo.GetCachedResult(hash)
+	assert.Nil(t, res)
+	assert.NotNil(t, err)
+}
+
+func TestFileConverterData_EvictExpiredResults(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("DELETE FROM %s", cacheTableName)).
+		WithArgs(AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	evicted, err := b.repo.EvictExpiredResults()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), evicted)
+}
+
+func TestFileConverterData_SaveIdempotencyKey_Success(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	caller, key, requestHash := "test-caller", "test-key", "test-hash"
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", idempotencyTableName)).
+		WithArgs(caller, key, requestHash, b.id, AnyTime{}, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	saved, err := b.repo.SaveIdempotencyKey(caller, key, requestHash, b.id)
+	assert.Nil(t, err)
+	assert.True(t, saved)
+}
+
+func TestFileConverterData_EvictExpiredIdempotencyKeys(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("DELETE FROM %s WHERE expires_at <= ", idempotencyTableName)).
+		WithArgs(AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	evicted, err := b.repo.EvictExpiredIdempotencyKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), evicted)
+}
+
+func TestFileConverterData_SaveIdempotencyKey_Conflict(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	caller, key, requestHash := "test-caller", "test-key", "test-hash"
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", idempotencyTableName)).
+		WithArgs(caller, key, requestHash, b.id, AnyTime{}, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	saved, err := b.repo.SaveIdempotencyKey(caller, key, requestHash, b.id)
+	assert.Nil(t, err)
+	assert.False(t, saved)
+}
+
+func TestFileConverterData_NewIdempotentRequest(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	caller, key, requestHash := "test-caller", "test-key", "test-hash"
+	b.mock.ExpectBegin()
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", idempotencyTableName)).
+		WithArgs(caller, key, requestHash, b.id, AnyTime{}, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", tableName)).
+		WithArgs(b.id, enums.QUEUED.Name(), "NONE", AnyTime{}, testRequest.SourceUrl, testRequest.SourceEncoding,
+			testRequest.DestEncoding, testRequest.Priority, 90, testRequest.SampleRate, testRequest.Channels,
+			testRequest.CallbackUrl, testRequest.Tenant, testRequest.Caller, testRequest.SourceHeaders).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	b.mock.ExpectCommit()
+	created, err := b.repo.NewIdempotentRequest(b.id, testRequest, caller, key, requestHash)
+	assert.Nil(t, err)
+	assert.True(t, created)
+}
+
+func TestFileConverterData_NewIdempotentRequest_Conflict(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	caller, key, requestHash := "test-caller", "test-key", "test-hash"
+	b.mock.ExpectBegin()
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", idempotencyTableName)).
+		WithArgs(caller, key, requestHash, b.id, AnyTime{}, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	b.mock.ExpectRollback()
+	created, err := b.repo.NewIdempotentRequest(b.id, testRequest, caller, key, requestHash)
+	assert.Nil(t, err)
+	assert.False(t, created, "should not insert the job when the key was already used")
+}
+
+func TestFileConverterData_GetIdempotencyKey_Success(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	caller, key, requestHash, createdAt := "test-caller", "test-key", "test-hash", time.Now()
+	expiresAt := createdAt.Add(IdempotencyKeyTTL)
+	columns := []string{"caller", "key", "request_hash", "job_id", "created_at", "expires_at"}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s (.+) expires_at > ", idempotencyTableName)).
+		WithArgs(caller, key, AnyTime{}).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(caller, key, requestHash, b.id, createdAt, expiresAt))
+	res, err := b.repo.GetIdempotencyKey(caller, key)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, requestHash, res.RequestHash)
+	assert.Equal(t, b.id, res.JobId)
+	assert.Equal(t, createdAt, res.CreatedAt)
+	assert.Equal(t, expiresAt, res.ExpiresAt)
+}
+
+func TestFileConverterData_GetIdempotencyKey_Missing(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", idempotencyTableName)).
+		WithArgs("test-caller", "test-key", AnyTime{}).
+		WillReturnError(sql.ErrNoRows)
+	res, err := b.repo.GetIdempotencyKey("test-caller", "test-key")
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+}
+
+func TestFileConverterData_DeleteIdempotencyKey(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("DELETE FROM %s", idempotencyTableName)).
+		WithArgs("test-caller", "test-key").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := b.repo.DeleteIdempotencyKey("test-caller", "test-key"); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestFileConverterData_NewWebhookDelivery(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectQuery(fmt.Sprintf("INSERT INTO %s (.+) RETURNING id", webhookTableName)).
+		WithArgs(b.id, testRequest.CallbackUrl, "{}", enums.DELIVERY_PENDING.Name(), AnyTime{}, AnyTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	id, err := b.repo.NewWebhookDelivery(b.id, testRequest.CallbackUrl, "{}", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), id)
+}
+
+func TestFileConverterData_RecordWebhookAttempt(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s", webhookTableName)).
+		WithArgs(enums.DELIVERY_FAILED.Name(), 503, "test-message", AnyTime{}, AnyTime{}, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := b.repo.RecordWebhookAttempt(7, enums.DELIVERY_FAILED, 503, "test-message", time.Now()); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+var webhookColumnNames = []string{"id", "job_id", "url", "payload", "status", "attempts", "response_code", "error",
+	"created_at", "last_attempt", "next_attempt"}
+
+func TestFileConverterData_ClaimUndeliveredWebhooks(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	createdAt := time.Now()
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s SET next_attempt=(.+) RETURNING (.+) ORDER BY id", webhookTableName)).
+		WithArgs(AnyTime{}, b.id, enums.DELIVERY_FAILED.Name(), enums.DELIVERY_PENDING.Name(), AnyTime{}).
+		WillReturnRows(sqlmock.NewRows(webhookColumnNames).
+			AddRow(7, b.id, testRequest.CallbackUrl, "{}", enums.DELIVERY_FAILED.Name(), 5, 503, "test-message",
+				createdAt, createdAt, createdAt))
+	deliveries, err := b.repo.ClaimUndeliveredWebhooks(b.id, time.Now())
+	assert.Nil(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, int64(7), deliveries[0].Id)
+		assert.Equal(t, enums.DELIVERY_FAILED.Name(), deliveries[0].Status)
+		assert.Equal(t, 503, deliveries[0].ResponseCode)
+		assert.Equal(t, "{}", deliveries[0].Payload)
+	}
+}
+
+func TestFileConverterData_ClaimAbandonedWebhooks(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	createdAt := time.Now().Add(-time.Hour)
+	b.mock.ExpectQuery(fmt.Sprintf("UPDATE %s SET next_attempt=(.+) FOR UPDATE SKIP LOCKED", webhookTableName)).
+		WithArgs(AnyTime{}, enums.DELIVERY_PENDING.Name(), AnyTime{}, 10).
+		WillReturnRows(sqlmock.NewRows(webhookColumnNames).
+			AddRow(7, b.id, testRequest.CallbackUrl, "{}", enums.DELIVERY_PENDING.Name(), 2, 503, "test-message",
+				createdAt, createdAt, createdAt))
+	deliveries, err := b.repo.ClaimAbandonedWebhooks(time.Now(), 10)
+	assert.Nil(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, int64(7), deliveries[0].Id)
+		assert.Equal(t, 2, deliveries[0].Attempts)
+	}
+}
+
+func TestFileConverterData_CreateApiKey(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("INSERT INTO %s", apiKeyTableName)).
+		WithArgs(b.id, "test-name", "test-tenant", "test-hash", AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if _, err := b.repo.CreateApiKey(b.id, "test-name", "test-tenant", "test-hash"); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestFileConverterData_GetApiKey(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	createdAt := time.Now()
+	columns := []string{"id", "name", "tenant", "enabled", "created_at", "last_used"}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", apiKeyTableName)).
+		WithArgs("test-hash").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(b.id, "test-name", "test-tenant", true, createdAt, nil))
+	key, err := b.repo.GetApiKey("test-hash")
+	assert.Nil(t, err)
+	if assert.NotNil(t, key) {
+		assert.Equal(t, b.id, key.Id)
+		assert.Equal(t, "test-name", key.Name)
+		assert.Equal(t, "test-tenant", key.Tenant)
+		assert.True(t, key.Enabled)
+		assert.Equal(t, createdAt, key.CreatedAt)
+		assert.True(t, key.LastUsed.IsZero(), "an unused key has no last use")
+	}
+	b.mock.ExpectQuery(fmt.Sprintf("SELECT (.+) FROM %s", apiKeyTableName)).
+		WithArgs("missing-hash").
+		WillReturnError(sql.ErrNoRows)
+	key, err = b.repo.GetApiKey("missing-hash")
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+}
+
+func TestFileConverterData_SetApiKeyEnabled(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET enabled", apiKeyTableName)).
+		WithArgs(false, b.id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	updated, err := b.repo.SetApiKeyEnabled(b.id, false)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET enabled", apiKeyTableName)).
+		WithArgs(true, "missing-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	updated, err = b.repo.SetApiKeyEnabled("missing-id", true)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+}
+
+func TestFileConverterData_RecordApiKeyUse(t *testing.T) {
+	b := BeforeEach(t)
+	defer AfterEach(t, b)
+	b.mock.ExpectExec(fmt.Sprintf("UPDATE %s SET last_used", apiKeyTableName)).
+		WithArgs(AnyTime{}, b.id, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	recorded, err := b.repo.RecordApiKeyUse(b.id)
+	assert.Nil(t, err)
+	assert.True(t, recorded)
+}
@@ -0,0 +1,273 @@
+// A job queue backed by the convert_jobs table, so that several instances of the service can share work.
+// Workers claim queued rows with SELECT ... FOR UPDATE SKIP LOCKED and hold a lease on each job they run,
+// renewing it until the job finishes. A job whose lease expires was abandoned by a crashed worker and is claimed again
+package converterservice
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	db "github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaseTimeout = time.Minute
+	defaultPollInterval = time.Second
+)
+
+// Identifies the instance when none is configured
+func defaultInstanceId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "converter"
+	}
+	return hostname
+}
+
+// Suffixes the instance id, so that processes sharing an id never hold each other's leases
+func uniqueOwner(instanceId string) string {
+	return fmt.Sprintf("%s/%s", instanceId, uuid.New().String())
+}
+
+type DurableJobQueueConfiguration struct {
+	Concurrency  int
+	Db           db.FileConverterRepository
+	// Builds the job to run for a claimed row, failing rows that can no longer be run
+	NewJob       func(job *db.ConvertJob) (FileConverterJob, error)
+	// How long a claimed job may go without a lease renewal before another worker takes it over
+	LeaseTimeout time.Duration
+	// How often idle workers look for queued jobs
+	PollInterval time.Duration
+	// Identifies this queue as the holder of the leases it takes. Defaults to the hostname and a random suffix
+	Owner        string
+	// Stops a running job whose lease was taken over by another worker, so that it does not run twice
+	LeaseLost    func(id string)
+	// The number of jobs claimed by priority before the oldest job is claimed whatever its priority
+	StarvationLimit int
+}
+
+type durableJobQueue struct {
+	repo         db.FileConverterRepository
+	newJob       func(job *db.ConvertJob) (FileConverterJob, error)
+	leaseLost    func(id string)
+	// Identifies this queue as the holder of the leases it takes
+	owner        string
+	concurrency  int
+	leaseTimeout time.Duration
+	pollInterval time.Duration
+	lock         sync.Mutex
+	running      bool
+	stopAll      chan bool
+	// Wakes an idle worker when a job is enqueued, rather than waiting for the next poll
+	wake         chan bool
+	waitGroup    *sync.WaitGroup
+	// The jobs being run, keyed by id
+	current      map[string]FileConverterJob
+	starvationLimit int
+	// The number of jobs claimed by priority since the oldest job was last claimed, guarded by lock
+	claimedByPriority int
+}
+
+func NewDurableJobQueue(config *DurableJobQueueConfiguration) FileConverterJobQueue {
+	leaseTimeout := config.LeaseTimeout
+	if leaseTimeout <= 0 {
+		leaseTimeout = defaultLeaseTimeout
+	}
+	pollInterval := config.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	owner := config.Owner
+	if owner == "" {
+		owner = uniqueOwner(defaultInstanceId())
+	}
+	starvationLimit := config.StarvationLimit
+	if starvationLimit <= 0 {
+		starvationLimit = defaultStarvationLimit
+	}
+	return &durableJobQueue{
+		repo: config.Db,
+		newJob: config.NewJob,
+		leaseLost: config.LeaseLost,
+		owner: owner,
+		concurrency: config.Concurrency,
+		leaseTimeout: leaseTimeout,
+		pollInterval: pollInterval,
+		stopAll: make(chan bool),
+		wake: make(chan bool, config.Concurrency),
+		waitGroup: &sync.WaitGroup{},
+		current: make(map[string]FileConverterJob),
+		starvationLimit: starvationLimit,
+	}
+}
+
+/*
+ * The job has already been stored as QUEUED, so it is left for whichever worker claims it first.
+ * Enqueue only wakes one of this queue's idle workers
+ */
+func (q *durableJobQueue) Enqueue(job FileConverterJob) error {
+	if !q.Running() {
+		return errors.New("queue is shutdown")
+	}
+	select {
+	case q.wake <- true:
+	default:
+	}
+	return nil
+}
+
+func (q *durableJobQueue) Start() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.running {
+		return errors.New("queue is already running")
+	}
+	for i := 0; i < q.concurrency; i++ {
+		q.waitGroup.Add(1)
+		go q.work()
+	}
+	q.running = true
+	return nil
+}
+
+func (q *durableJobQueue) Stop(gracePeriod time.Duration) []FileConverterJob {
+	q.lock.Lock()
+	if !q.running {
+		q.lock.Unlock()
+		return nil
+	}
+	q.running = false
+	close(q.stopAll)
+	q.lock.Unlock()
+	finished := make(chan bool)
+	go func() {
+		q.waitGroup.Wait()
+		close(finished)
+	}()
+	select {
+	case <- finished:
+		return nil
+	case <- time.After(gracePeriod):
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var unfinished []FileConverterJob
+	for _, job := range q.current {
+		unfinished = append(unfinished, job)
+	}
+	return unfinished
+}
+
+func (q *durableJobQueue) Running() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.running
+}
+
+/*
+ * Claims and runs jobs until the queue is stopped, waiting for the poll interval
+ * or an enqueued job whenever there is nothing to claim
+ */
+func (q *durableJobQueue) work() {
+	defer q.waitGroup.Done()
+	for {
+		select {
+		case <- q.stopAll:
+			return
+		default:
+		}
+		if q.claim() {
+			continue
+		}
+		select {
+		case <- q.stopAll:
+			return
+		case <- q.wake:
+		case <- time.After(q.pollInterval):
+		}
+	}
+}
+
+/*
+ * Claims the next job and runs it. After starvationLimit jobs are claimed by priority, the oldest job is claimed
+ * whatever its priority, so that low priority jobs are not starved. Returns false when there was no job to claim
+ */
+func (q *durableJobQueue) claim() bool {
+	q.lock.Lock()
+	oldestFirst := q.claimedByPriority >= q.starvationLimit
+	q.lock.Unlock()
+	row, err := q.repo.ClaimConversion(q.owner, q.leaseTimeout, oldestFirst)
+	if err != nil {
+		log.Printf("failed to claim a job, encountered %v", err)
+		return false
+	}
+	if row == nil {
+		return false
+	}
+	q.lock.Lock()
+	if oldestFirst {
+		q.claimedByPriority = 0
+	} else {
+		q.claimedByPriority++
+	}
+	q.lock.Unlock()
+	job, err := q.newJob(row)
+	if err != nil {
+		log.Printf("could not run %s, encountered %v", row.Id, err)
+		return true
+	}
+	q.run(job)
+	return true
+}
+
+/*
+ * Runs the job, renewing its lease until it finishes
+ */
+func (q *durableJobQueue) run(job FileConverterJob) {
+	q.setRunningJob(job.Id(), job)
+	defer q.setRunningJob(job.Id(), nil)
+	done := make(chan bool)
+	go q.holdLease(job.Id(), done)
+	job.Start()
+	close(done)
+}
+
+/*
+ * Renews the lease on a job three times per lease timeout, so that a single missed renewal
+ * does not let another worker take the job over. If the lease is lost anyway, the job is stopped
+ */
+func (q *durableJobQueue) holdLease(id string, done chan bool) {
+	ticker := time.NewTicker(q.leaseTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- done:
+			return
+		case <- ticker.C:
+			renewed, err := q.repo.RenewLease(id, q.owner, q.leaseTimeout)
+			if err != nil {
+				log.Printf("failed to renew lease on %s, encountered %v", id, err)
+			} else if !renewed {
+				log.Printf("lease on %s is no longer held, stopping it", id)
+				if q.leaseLost != nil {
+					q.leaseLost(id)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (q *durableJobQueue) setRunningJob(id string, job FileConverterJob) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if job == nil {
+		delete(q.current, id)
+		return
+	}
+	q.current[id] = job
+}
@@ -0,0 +1,254 @@
+package converterservice_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/mocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// A job claimed from the database, which completes its row once released
+type claimedJob struct {
+	id      string
+	owner   string
+	repo    *mocks.MockFileConverterRepo
+	ran     chan string
+	release chan bool
+}
+
+func (c *claimedJob) Start() {
+	c.ran <- c.id
+	if c.release != nil {
+		<- c.release
+	}
+	c.repo.CompleteConversion(c.id, c.owner, "test-url")
+}
+
+func (c *claimedJob) Priority() enums.Priority {
+	return enums.NORMAL
+}
+
+func (c *claimedJob) Id() string {
+	return c.id
+}
+
+// Each test queue claims jobs under its own owner, as separate instances would
+var testQueues int
+
+func newTestDurableJobQueue(repo *mocks.MockFileConverterRepo, concurrency int, ran chan string,
+	release chan bool) converterservice.FileConverterJobQueue {
+	testQueues++
+	owner := fmt.Sprintf("test-queue-%d", testQueues)
+	return converterservice.NewDurableJobQueue(&converterservice.DurableJobQueueConfiguration{
+		Concurrency: concurrency,
+		Db: repo,
+		NewJob: func(job *db.ConvertJob) (converterservice.FileConverterJob, error) {
+			if job.Request.SourceUrl == "" {
+				repo.FailConversion(job.Id, owner, enums.INVALID_REQUEST, "missing source url")
+				return nil, errors.New("missing source url")
+			}
+			return &claimedJob{id: job.Id, owner: owner, repo: repo, ran: ran, release: release}, nil
+		},
+		LeaseTimeout: 30 * time.Millisecond,
+		Owner: owner,
+		PollInterval: 5 * time.Millisecond,
+	})
+}
+
+func queueRow(repo *mocks.MockFileConverterRepo, id string, priority enums.Priority) {
+	repo.NewRequest(id, &db.ConversionRequest{SourceUrl: "test-url", Priority: priority.Name()})
+}
+
+func receive(t *testing.T, ran chan string) string {
+	select {
+	case id := <- ran:
+		return id
+	case <- time.After(time.Second):
+		t.Fatal("timed out waiting for a job to run")
+		return ""
+	}
+}
+
+func TestDurableJobQueue_PriorityOrder(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "low", enums.LOW)
+	queueRow(repo, "normal-1", enums.NORMAL)
+	queueRow(repo, "high", enums.HIGH)
+	queueRow(repo, "normal-2", enums.NORMAL)
+	ran := make(chan string, 4)
+	queue := newTestDurableJobQueue(repo, 1, ran, nil)
+	assert.Nil(t, queue.Start())
+	defer queue.Stop(0)
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, receive(t, ran))
+	}
+	assert.Equal(t, []string{"high", "normal-1", "normal-2", "low"}, order)
+}
+
+func TestDurableJobQueue_StarvationLimit(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "low", enums.LOW)
+	for i := 1; i <= 4; i++ {
+		queueRow(repo, fmt.Sprintf("high-%d", i), enums.HIGH)
+	}
+	ran := make(chan string, 5)
+	queue := converterservice.NewDurableJobQueue(&converterservice.DurableJobQueueConfiguration{
+		Concurrency: 1,
+		Db: repo,
+		NewJob: func(job *db.ConvertJob) (converterservice.FileConverterJob, error) {
+			return &claimedJob{id: job.Id, owner: "test-starvation", repo: repo, ran: ran}, nil
+		},
+		Owner: "test-starvation",
+		PollInterval: 5 * time.Millisecond,
+		StarvationLimit: 2,
+	})
+	assert.Nil(t, queue.Start())
+	defer queue.Stop(0)
+	var order []string
+	for i := 0; i < 5; i++ {
+		order = append(order, receive(t, ran))
+	}
+	assert.Equal(t, []string{"high-1", "high-2", "low", "high-3", "high-4"}, order,
+		"the oldest job should be claimed once the limit is reached")
+}
+
+func TestDurableJobQueue_SharedAcrossQueues(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	ran := make(chan string, 40)
+	first, second := newTestDurableJobQueue(repo, 2, ran, nil), newTestDurableJobQueue(repo, 2, ran, nil)
+	assert.Nil(t, first.Start())
+	assert.Nil(t, second.Start())
+	defer first.Stop(0)
+	defer second.Stop(0)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("job-%d", i)
+		queueRow(repo, id, enums.NORMAL)
+		assert.Nil(t, first.Enqueue(&claimedJob{id: id}))
+	}
+	runs := map[string]int{}
+	for i := 0; i < 20; i++ {
+		runs[receive(t, ran)]++
+	}
+	assert.Len(t, runs, 20)
+	for id, count := range runs {
+		assert.Equal(t, 1, count, id)
+	}
+	select {
+	case id := <- ran:
+		t.Errorf("%s ran twice", id)
+	case <- time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDurableJobQueue_ReclaimsExpiredLease(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "abandoned", enums.NORMAL)
+	queueRow(repo, "held", enums.NORMAL)
+	repo.Data["abandoned"].Status = enums.CONVERTING.Name()
+	repo.Leases["abandoned"] = &mocks.Lease{Owner: "crashed", ExpiresAt: time.Now().Add(-time.Second)}
+	repo.Data["held"].Status = enums.CONVERTING.Name()
+	repo.Leases["held"] = &mocks.Lease{Owner: "alive", ExpiresAt: time.Now().Add(time.Hour)}
+	ran := make(chan string, 2)
+	queue := newTestDurableJobQueue(repo, 1, ran, nil)
+	assert.Nil(t, queue.Start())
+	defer queue.Stop(0)
+	assert.Equal(t, "abandoned", receive(t, ran))
+	select {
+	case id := <- ran:
+		t.Errorf("claimed %s while its lease was held", id)
+	case <- time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDurableJobQueue_RenewsLease(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "long-running", enums.NORMAL)
+	ran, release := make(chan string, 2), make(chan bool)
+	first, second := newTestDurableJobQueue(repo, 1, ran, release), newTestDurableJobQueue(repo, 1, ran, release)
+	assert.Nil(t, first.Start())
+	defer first.Stop(0)
+	assert.Equal(t, "long-running", receive(t, ran))
+	assert.Nil(t, second.Start())
+	defer second.Stop(0)
+	select {
+	case id := <- ran:
+		t.Errorf("%s was taken over while its lease was being renewed", id)
+	case <- time.After(100 * time.Millisecond):
+	}
+	close(release)
+}
+
+func TestDurableJobQueue_SkipsRejectedJobs(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	repo.NewRequest("invalid", &db.ConversionRequest{})
+	ran := make(chan string, 1)
+	queue := newTestDurableJobQueue(repo, 1, ran, nil)
+	assert.Nil(t, queue.Start())
+	assert.Eventually(t, func() bool {
+		job, _ := repo.GetConversion("invalid")
+		return job.Status == enums.FAILED.Name()
+	}, time.Second, 5 * time.Millisecond)
+	queue.Stop(0)
+	job, _ := repo.GetConversion("invalid")
+	assert.Equal(t, enums.INVALID_REQUEST.Name(), job.ErrorCode)
+}
+
+func TestDurableJobQueue_Stop_GracePeriod(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "unfinished", enums.NORMAL)
+	ran, release := make(chan string, 1), make(chan bool)
+	queue := newTestDurableJobQueue(repo, 1, ran, release)
+	assert.Nil(t, queue.Start())
+	assert.Equal(t, "unfinished", receive(t, ran))
+	unfinished := queue.Stop(20 * time.Millisecond)
+	if assert.Len(t, unfinished, 1) {
+		assert.Equal(t, "unfinished", unfinished[0].Id())
+	}
+	assert.False(t, queue.Running())
+	assert.NotNil(t, queue.Enqueue(&claimedJob{id: "late"}))
+	close(release)
+}
+
+func TestDurableJobQueue_LeaseLost(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	queueRow(repo, "taken-over", enums.NORMAL)
+	ran, release, lost := make(chan string, 1), make(chan bool), make(chan string, 1)
+	queue := converterservice.NewDurableJobQueue(&converterservice.DurableJobQueueConfiguration{
+		Concurrency: 1,
+		Db: repo,
+		LeaseLost: func(id string) {
+			select {
+			case lost <- id:
+			default:
+			}
+		},
+		NewJob: func(job *db.ConvertJob) (converterservice.FileConverterJob, error) {
+			return &claimedJob{id: job.Id, owner: "stale", repo: repo, ran: ran, release: release}, nil
+		},
+		LeaseTimeout: 30 * time.Millisecond,
+		Owner: "stale",
+		PollInterval: 5 * time.Millisecond,
+	})
+	assert.Nil(t, queue.Start())
+	defer queue.Stop(0)
+	assert.Equal(t, "taken-over", receive(t, ran))
+	repo.SetLeaseOwner("taken-over", "other")
+	select {
+	case id := <- lost:
+		assert.Equal(t, "taken-over", id)
+	case <- time.After(time.Second):
+		t.Fatal("timed out waiting for the lost lease to be reported")
+	}
+	close(release)
+	completed, err := repo.CompleteConversion("taken-over", "stale", "test-url")
+	assert.Nil(t, err)
+	assert.False(t, completed)
+	job, _ := repo.GetConversion("taken-over")
+	assert.Equal(t, enums.CONVERTING.Name(), job.Status)
+}
@@ -0,0 +1,29 @@
+package enums
+
+// The state of a webhook delivery
+const (
+	DELIVERY_PENDING deliveryStatus = iota
+	DELIVERED
+	DELIVERY_FAILED
+)
+
+var deliveryStatusName = []string{
+	"PENDING",
+	"DELIVERED",
+	"FAILED",
+}
+
+type deliveryStatus int
+
+type DeliveryStatus interface {
+	Name()  string
+	Value() int
+}
+
+func (d deliveryStatus) Name() string {
+	return deliveryStatusName[d]
+}
+
+func (d deliveryStatus) Value() int {
+	return int(d)
+}
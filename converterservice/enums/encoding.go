@@ -5,43 +5,52 @@ import (
 	"errors"
 )
 
+// Declared in the order of the format registry and the protobuf enum
 const (
 	WAV encoding = iota
 	MP4
 	MP3
 	FLAC
+	OGG
+	OPUS
+	AAC
+	M4A
+	AIFF
+	ALAC
+	WEBM
+	PCM
+	ULAW
+	ALAW
+	GSM
+	AMR_NB
 )
-var encodingsName = []string{
-	"WAV",
-	"MP4",
-	"MP3",
-	"FLAC",
-}
-var encodings = []encoding{
-	WAV,
-	MP4,
-	MP3,
-	FLAC,
-}
+
+var errUnsupportedEncoding = errors.New("unsupported audio encoding")
 
 type encoding int
 
 type Encoding interface {
-	Name()  string
-	Value() int
+	Name()   string
+	Value()  int
+	Format() *Format
 }
 
 func (c encoding) Name() string {
-	return encodingsName[c]
+	return formats[c].Name
 }
 
 func (c encoding) Value() int {
 	return int(c)
 }
 
+// The registry entry for the encoding
+func (c encoding) Format() *Format {
+	return formats[c]
+}
+
 func EncodingFromEnumValue(enumVal int) (encoding, error) {
-	if enumVal >= len(encodings) {
-		return -1, errors.New("unsupported audio encoding")
+	if enumVal < 0 || enumVal >= len(formats) {
+		return -1, errUnsupportedEncoding
 	}
-	return encodings[enumVal], nil
-}
\ No newline at end of file
+	return encoding(enumVal), nil
+}
@@ -1,6 +1,7 @@
 package enums
 
 import (
+	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -34,6 +35,18 @@ func TestEncoding_Name(t *testing.T) {
 	assert.Equal(t, "MP4", MP4.Name())
 	assert.Equal(t, "MP3", MP3.Name())
 	assert.Equal(t, "FLAC", FLAC.Name())
+	assert.Equal(t, "OGG", OGG.Name())
+	assert.Equal(t, "OPUS", OPUS.Name())
+	assert.Equal(t, "AAC", AAC.Name())
+	assert.Equal(t, "M4A", M4A.Name())
+	assert.Equal(t, "AIFF", AIFF.Name())
+	assert.Equal(t, "ALAC", ALAC.Name())
+	assert.Equal(t, "WEBM", WEBM.Name())
+	assert.Equal(t, "PCM", PCM.Name())
+	assert.Equal(t, "ULAW", ULAW.Name())
+	assert.Equal(t, "ALAW", ALAW.Name())
+	assert.Equal(t, "GSM", GSM.Name())
+	assert.Equal(t, "AMR_NB", AMR_NB.Name())
 }
 
 func TestEncoding_Value(t *testing.T) {
@@ -41,16 +54,140 @@ func TestEncoding_Value(t *testing.T) {
 	assert.Equal(t, 1, MP4.Value())
 	assert.Equal(t, 2, MP3.Value())
 	assert.Equal(t, 3, FLAC.Value())
+	assert.Equal(t, 4, OGG.Value())
+	assert.Equal(t, 5, OPUS.Value())
+	assert.Equal(t, 6, AAC.Value())
+	assert.Equal(t, 7, M4A.Value())
+	assert.Equal(t, 8, AIFF.Value())
+	assert.Equal(t, 9, ALAC.Value())
+	assert.Equal(t, 10, WEBM.Value())
+	assert.Equal(t, 11, PCM.Value())
+	assert.Equal(t, 12, ULAW.Value())
+	assert.Equal(t, 13, ALAW.Value())
+	assert.Equal(t, 14, GSM.Value())
+	assert.Equal(t, 15, AMR_NB.Value())
+}
+
+func TestEncoding_Format(t *testing.T) {
+	assert.Equal(t, "m4a", MP4.Format().Extension)
+	assert.Equal(t, "m4a", ALAC.Format().Extension)
+	assert.Equal(t, "amr", AMR_NB.Format().Extension)
+	assert.Equal(t, "audio/mpeg", MP3.Format().MimeType)
+	assert.Equal(t, "audio/mp4", MP4.Format().MimeType)
+	assert.Equal(t, "application/octet-stream", PCM.Format().MimeType)
+	assert.Equal(t, "ipod", ALAC.Format().Muxer)
+	assert.Equal(t, "alac", ALAC.Format().Codec)
+	assert.Equal(t, 8000, ULAW.Format().SampleRate)
+	assert.Equal(t, 1, ULAW.Format().Channels)
+}
+
+func TestFormats(t *testing.T) {
+	assert.Len(t, Formats(), len(pb.Encoding_name))
+	for i, format := range Formats() {
+		assert.Equal(t, pb.Encoding(i), format.Encoding)
+		assert.Equal(t, pb.Encoding_name[int32(i)], format.Name)
+		assert.NotEmpty(t, format.Extension)
+		assert.NotEmpty(t, format.MimeType)
+		assert.NotEmpty(t, format.Demuxer)
+		assert.NotEmpty(t, format.Muxer)
+		assert.NotEmpty(t, format.Codec)
+	}
+}
+
+func TestFormat_Supports(t *testing.T) {
+	assert.True(t, MP3.Format().Supports(SampleRateOption))
+	assert.True(t, MP3.Format().Supports(ChannelsOption))
+	assert.False(t, GSM.Format().Supports(SampleRateOption))
+	assert.False(t, PCM.Format().Supports(ChannelsOption))
+}
+
+func TestEncodingFromName(t *testing.T) {
+	encoding, err := EncodingFromName("opus")
+	assert.Nil(t, err)
+	assert.Equal(t, OPUS, encoding)
+	encoding, err = EncodingFromName("AMR-NB")
+	assert.Nil(t, err)
+	assert.Equal(t, AMR_NB, encoding)
+	_, err = EncodingFromName("MIDI")
+	assert.NotNil(t, err)
 }
 
 func TestFromEnumToEncoding(t *testing.T) {
-	for _, encoding := range encodings {
+	for _, encoding := range []encoding{WAV, MP4, MP3, FLAC, OGG, OPUS, AAC, M4A, AIFF, ALAC, WEBM, PCM, ULAW, ALAW, GSM, AMR_NB} {
 		s, err := EncodingFromEnumValue(encoding.Value())
 		assert.Equal(t, encoding, s)
 		assert.Nil(t, err)
 	}
-	_, err := EncodingFromEnumValue(6)
+	_, err := EncodingFromEnumValue(len(formats))
+	assert.NotNil(t, err)
+	_, err = EncodingFromEnumValue(-1)
+	assert.NotNil(t, err)
+}
+
+
+func TestPriority_Name(t *testing.T) {
+	assert.Equal(t, "NORMAL", NORMAL.Name())
+	assert.Equal(t, "LOW", LOW.Name())
+	assert.Equal(t, "HIGH", HIGH.Name())
+}
+
+func TestPriority_Rank(t *testing.T) {
+	assert.Less(t, LOW.Rank(), NORMAL.Rank())
+	assert.Less(t, NORMAL.Rank(), HIGH.Rank())
+	for _, p := range priorities {
+		assert.Less(t, p.Rank(), PriorityLevels())
+	}
+}
+
+func TestPriorityFromEnumValue(t *testing.T) {
+	for _, p := range priorities {
+		s, err := PriorityFromEnumValue(p.Value())
+		assert.Equal(t, p, s)
+		assert.Nil(t, err)
+	}
+	_, err := PriorityFromEnumValue(6)
 	assert.NotNil(t, err)
+	_, err = PriorityFromEnumValue(-1)
+	assert.NotNil(t, err)
+}
+
+func TestErrorCode_Name(t *testing.T) {
+	assert.Equal(t, "NO_ERROR", NO_ERROR.Name())
+	assert.Equal(t, "DOWNLOAD_FAILED", DOWNLOAD_FAILED.Name())
+	assert.Equal(t, "UNSUPPORTED_INPUT", UNSUPPORTED_INPUT.Name())
+	assert.Equal(t, "CONVERSION_FAILED", CONVERSION_FAILED.Name())
+	assert.Equal(t, "UPLOAD_FAILED", UPLOAD_FAILED.Name())
+	assert.Equal(t, "PRESIGN_FAILED", PRESIGN_FAILED.Name())
+	assert.Equal(t, "SOURCE_TOO_LARGE", SOURCE_TOO_LARGE.Name())
+	assert.Equal(t, "SOURCE_TOO_LONG", SOURCE_TOO_LONG.Name())
 }
 
+func TestErrorCodeFromEnumValue(t *testing.T) {
+	for _, code := range errorCodes {
+		c, err := ErrorCodeFromEnumValue(code.Value())
+		assert.Equal(t, code, c)
+		assert.Nil(t, err)
+	}
+	_, err := ErrorCodeFromEnumValue(len(errorCodes))
+	assert.NotNil(t, err)
+}
 
+func TestPriorityFromName(t *testing.T) {
+	for _, p := range priorities {
+		s, err := PriorityFromName(p.Name())
+		assert.Equal(t, p, s)
+		assert.Nil(t, err)
+	}
+	_, err := PriorityFromName("URGENT")
+	assert.NotNil(t, err)
+}
+
+func TestStatusFromName(t *testing.T) {
+	for _, s := range statuses {
+		found, err := StatusFromName(s.Name())
+		assert.Equal(t, s, found)
+		assert.Nil(t, err)
+	}
+	_, err := StatusFromName("PAUSED")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,71 @@
+package enums
+
+import (
+	"errors"
+)
+
+// Declared in the order of the protobuf enum, so that NO_ERROR is the default
+const (
+	NO_ERROR errorCode = iota
+	INVALID_REQUEST
+	DOWNLOAD_FAILED
+	UNSUPPORTED_INPUT
+	CONVERSION_FAILED
+	TIMEOUT
+	UPLOAD_FAILED
+	PRESIGN_FAILED
+	INTERNAL
+	SOURCE_TOO_LARGE
+	SOURCE_TOO_LONG
+)
+
+var errorCodeName = []string{
+	"NO_ERROR",
+	"INVALID_REQUEST",
+	"DOWNLOAD_FAILED",
+	"UNSUPPORTED_INPUT",
+	"CONVERSION_FAILED",
+	"TIMEOUT",
+	"UPLOAD_FAILED",
+	"PRESIGN_FAILED",
+	"INTERNAL",
+	"SOURCE_TOO_LARGE",
+	"SOURCE_TOO_LONG",
+}
+
+var errorCodes = []errorCode{
+	NO_ERROR,
+	INVALID_REQUEST,
+	DOWNLOAD_FAILED,
+	UNSUPPORTED_INPUT,
+	CONVERSION_FAILED,
+	TIMEOUT,
+	UPLOAD_FAILED,
+	PRESIGN_FAILED,
+	INTERNAL,
+	SOURCE_TOO_LARGE,
+	SOURCE_TOO_LONG,
+}
+
+type errorCode int
+
+// A machine-readable reason that a job failed
+type ErrorCode interface {
+	Name()  string
+	Value() int
+}
+
+func (e errorCode) Name() string {
+	return errorCodeName[e]
+}
+
+func (e errorCode) Value() int {
+	return int(e)
+}
+
+func ErrorCodeFromEnumValue(enumVal int) (errorCode, error) {
+	if enumVal < 0 || enumVal >= len(errorCodes) {
+		return -1, errors.New("unrecognized error code")
+	}
+	return errorCodes[enumVal], nil
+}
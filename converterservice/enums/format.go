@@ -0,0 +1,162 @@
+// The registry of supported audio formats
+package enums
+
+import (
+	"github.com/reggiemcdonald/grpc-audio-converter/pb"
+	"strings"
+)
+
+// An option a request may set on the converted audio
+type Option string
+
+const (
+	SampleRateOption Option = "sampleRate"
+	ChannelsOption   Option = "channels"
+)
+
+// The options accepted by formats that do not fix the audio layout
+var layoutOptions = []Option{SampleRateOption, ChannelsOption}
+
+// The sample rates accepted by encoders that restrict them
+var (
+	mp3SampleRates  = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000}
+	aacSampleRates  = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000, 64000, 88200, 96000}
+	opusSampleRates = []int{8000, 12000, 16000, 24000, 48000}
+	narrowband      = []int{8000}
+)
+
+// Describes how an encoding is named, stored and converted
+type Format struct {
+	// The protobuf enum value
+	Encoding   pb.Encoding
+	Name       string
+	// Other names the encoding is accepted by, in upper case
+	Aliases    []string
+	// The file extension, without a leading period
+	Extension  string
+	MimeType   string
+	// The ffmpeg demuxer, muxer and default codec
+	Demuxer    string
+	Muxer      string
+	Codec      string
+	// The sample rate and channel count the format requires, or zero when it accepts any
+	SampleRate int
+	Channels   int
+	// The sample rates the encoder accepts, or empty when it accepts any
+	SampleRates []int
+	// The range of encoder bitrates in bits per second, or zero for uncompressed and lossless formats
+	MinBitrate  int
+	MaxBitrate  int
+	MaxChannels int
+	// Set for formats without a header, whose layout must be given when reading them
+	Headerless bool
+	// The options a request may set when converting to the format
+	Options    []Option
+}
+
+/*
+ * The registry of formats, indexed by encoding value.
+ * MPEG-4 audio is given the audio-only m4a extension, and ALAC is stored in the same container.
+ * Raw PCM has no header describing its layout, so it has no audio MIME type.
+ * Telephony formats are narrowband, so are always 8 kHz mono
+ */
+var formats = []*Format{
+	{Encoding: pb.Encoding_WAV, Name: "WAV", Extension: "wav", MimeType: "audio/wav",
+		Demuxer: "wav", Muxer: "wav", Codec: "pcm_s16le", Options: layoutOptions,
+		MaxChannels: 8},
+	{Encoding: pb.Encoding_MP4, Name: "MP4", Extension: "m4a", MimeType: "audio/mp4",
+		Demuxer: "mp4", Muxer: "mp4", Codec: "aac", Options: layoutOptions,
+		SampleRates: aacSampleRates, MinBitrate: 32000, MaxBitrate: 512000, MaxChannels: 8},
+	{Encoding: pb.Encoding_MP3, Name: "MP3", Extension: "mp3", MimeType: "audio/mpeg",
+		Demuxer: "mp3", Muxer: "mp3", Codec: "libmp3lame", Options: layoutOptions,
+		SampleRates: mp3SampleRates, MinBitrate: 8000, MaxBitrate: 320000, MaxChannels: 2},
+	{Encoding: pb.Encoding_FLAC, Name: "FLAC", Extension: "flac", MimeType: "audio/flac",
+		Demuxer: "flac", Muxer: "flac", Codec: "flac", Options: layoutOptions,
+		MaxChannels: 8},
+	{Encoding: pb.Encoding_OGG, Name: "OGG", Extension: "ogg", MimeType: "audio/ogg",
+		Demuxer: "ogg", Muxer: "ogg", Codec: "libvorbis", Options: layoutOptions,
+		MinBitrate: 45000, MaxBitrate: 500000, MaxChannels: 8},
+	{Encoding: pb.Encoding_OPUS, Name: "OPUS", Extension: "opus", MimeType: "audio/ogg",
+		Demuxer: "ogg", Muxer: "opus", Codec: "libopus", Options: layoutOptions,
+		SampleRates: opusSampleRates, MinBitrate: 6000, MaxBitrate: 510000, MaxChannels: 8},
+	{Encoding: pb.Encoding_AAC, Name: "AAC", Extension: "aac", MimeType: "audio/aac",
+		Demuxer: "aac", Muxer: "adts", Codec: "aac", Options: layoutOptions,
+		SampleRates: aacSampleRates, MinBitrate: 32000, MaxBitrate: 512000, MaxChannels: 8},
+	{Encoding: pb.Encoding_M4A, Name: "M4A", Extension: "m4a", MimeType: "audio/mp4",
+		Demuxer: "mp4", Muxer: "ipod", Codec: "aac", Options: layoutOptions,
+		SampleRates: aacSampleRates, MinBitrate: 32000, MaxBitrate: 512000, MaxChannels: 8},
+	{Encoding: pb.Encoding_AIFF, Name: "AIFF", Extension: "aiff", MimeType: "audio/aiff",
+		Demuxer: "aiff", Muxer: "aiff", Codec: "pcm_s16be", Options: layoutOptions,
+		MaxChannels: 8},
+	{Encoding: pb.Encoding_ALAC, Name: "ALAC", Extension: "m4a", MimeType: "audio/mp4",
+		Demuxer: "mp4", Muxer: "ipod", Codec: "alac", Options: layoutOptions,
+		MaxChannels: 8},
+	{Encoding: pb.Encoding_WEBM, Name: "WEBM", Extension: "webm", MimeType: "audio/webm",
+		Demuxer: "webm", Muxer: "webm", Codec: "libopus", Options: layoutOptions,
+		SampleRates: opusSampleRates, MinBitrate: 6000, MaxBitrate: 510000, MaxChannels: 8},
+	{Encoding: pb.Encoding_PCM, Name: "PCM", Extension: "pcm", MimeType: "application/octet-stream",
+		Demuxer: "s16le", Muxer: "s16le", Codec: "pcm_s16le", SampleRate: 44100, Channels: 2, Headerless: true,
+		SampleRates: []int{44100}, MaxChannels: 2},
+	{Encoding: pb.Encoding_ULAW, Name: "ULAW", Extension: "wav", MimeType: "audio/wav",
+		Demuxer: "wav", Muxer: "wav", Codec: "pcm_mulaw", SampleRate: 8000, Channels: 1,
+		SampleRates: narrowband, MinBitrate: 64000, MaxBitrate: 64000, MaxChannels: 1},
+	{Encoding: pb.Encoding_ALAW, Name: "ALAW", Extension: "wav", MimeType: "audio/wav",
+		Demuxer: "wav", Muxer: "wav", Codec: "pcm_alaw", SampleRate: 8000, Channels: 1,
+		SampleRates: narrowband, MinBitrate: 64000, MaxBitrate: 64000, MaxChannels: 1},
+	{Encoding: pb.Encoding_GSM, Name: "GSM", Extension: "gsm", MimeType: "audio/x-gsm",
+		Demuxer: "gsm", Muxer: "gsm", Codec: "libgsm", SampleRate: 8000, Channels: 1,
+		SampleRates: narrowband, MinBitrate: 13000, MaxBitrate: 13000, MaxChannels: 1},
+	{Encoding: pb.Encoding_AMR_NB, Name: "AMR_NB", Aliases: []string{"AMR-NB"}, Extension: "amr", MimeType: "audio/amr",
+		Demuxer: "amr", Muxer: "amr", Codec: "libopencore_amrnb", SampleRate: 8000, Channels: 1,
+		SampleRates: narrowband, MinBitrate: 4750, MaxBitrate: 12200, MaxChannels: 1},
+}
+
+// Returns every registered format
+func Formats() []*Format {
+	return formats
+}
+
+/*
+ * Returns true when a request converting to the format may set the option
+ */
+func (f *Format) Supports(option Option) bool {
+	for _, supported := range f.Options {
+		if supported == option {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns true when the encoder accepts the sample rate
+ */
+func (f *Format) SupportsSampleRate(sampleRate int) bool {
+	if len(f.SampleRates) == 0 {
+		return true
+	}
+	for _, supported := range f.SampleRates {
+		if supported == sampleRate {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the encoding with the name or alias, ignoring case
+ */
+func EncodingFromName(name string) (encoding, error) {
+	name = strings.ToUpper(name)
+	for i, format := range formats {
+		if format.Name == name {
+			return encoding(i), nil
+		}
+		for _, alias := range format.Aliases {
+			if alias == name {
+				return encoding(i), nil
+			}
+		}
+	}
+	return -1, errUnsupportedEncoding
+}
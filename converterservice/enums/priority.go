@@ -0,0 +1,72 @@
+package enums
+
+import (
+	"errors"
+)
+
+// Declared in the order of the protobuf enum, so that NORMAL is the default
+const (
+	NORMAL priority = iota
+	LOW
+	HIGH
+)
+
+var priorityName = []string{
+	"NORMAL",
+	"LOW",
+	"HIGH",
+}
+
+// The dispatch order of each priority, where a greater rank is dispatched first
+var priorityRank = []int{
+	1,
+	0,
+	2,
+}
+
+var priorities = []priority{
+	NORMAL,
+	LOW,
+	HIGH,
+}
+
+type priority int
+
+type Priority interface {
+	Name()  string
+	Value() int
+	Rank()  int
+}
+
+func (p priority) Name() string {
+	return priorityName[p]
+}
+
+func (p priority) Value() int {
+	return int(p)
+}
+
+func (p priority) Rank() int {
+	return priorityRank[p]
+}
+
+// The number of distinct priority ranks
+func PriorityLevels() int {
+	return len(priorities)
+}
+
+func PriorityFromName(name string) (priority, error) {
+	for _, p := range priorities {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return -1, errors.New("unrecognized priority")
+}
+
+func PriorityFromEnumValue(enumVal int) (priority, error) {
+	if enumVal < 0 || enumVal >= len(priorities) {
+		return -1, errors.New("unrecognized priority")
+	}
+	return priorities[enumVal], nil
+}
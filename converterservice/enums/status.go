@@ -45,4 +45,13 @@ func StatusFromEnumValue(enumVal int) (status, error) {
 		return -1, errors.New("unrecognized status")
 	}
 	return statuses[enumVal], nil
-}
\ No newline at end of file
+}
+
+func StatusFromName(name string) (status, error) {
+	for _, s := range statuses {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return -1, errors.New("unrecognized status")
+}
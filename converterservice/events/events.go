@@ -0,0 +1,123 @@
+// Publishes job status transitions for other services to react to
+package events
+
+import (
+	"encoding/json"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"log"
+	"sync"
+	"time"
+)
+
+// The channel that the Postgres publisher notifies
+const DefaultChannel = "convert_job_events"
+
+// A change in the status of a job
+type Event struct {
+	JobId     string    `json:"jobId"`
+	// Empty when the job was just created
+	OldStatus string    `json:"oldStatus,omitempty"`
+	NewStatus string    `json:"newStatus"`
+	Timestamp time.Time `json:"timestamp"`
+	// The presigned URLs of the job's output, once it has completed
+	Urls      []string  `json:"urls,omitempty"`
+}
+
+type EventPublisher interface {
+	Publish(event *Event) error
+}
+
+/*
+ * Publishes the transition of a job from one status to another, logging rather than returning failures
+ * so that a missing subscriber never fails a job. A nil from marks a new job, and a nil publisher publishes nothing
+ */
+func Publish(publisher EventPublisher, jobId string, from enums.Status, to enums.Status, urls ...string) {
+	if publisher == nil {
+		return
+	}
+	event := &Event{
+		JobId: jobId,
+		NewStatus: to.Name(),
+		Timestamp: time.Now(),
+		Urls: urls,
+	}
+	if from != nil {
+		event.OldStatus = from.Name()
+	}
+	if err := publisher.Publish(event); err != nil {
+		log.Printf("failed to publish %s event for %s, encountered %v", to.Name(), jobId, err)
+	}
+}
+
+// Publishes events with Postgres NOTIFY, so that any connection that has run LISTEN on the channel receives them
+type postgresEventPublisher struct {
+	db      db.DatabaseConnection
+	channel string
+}
+
+// An empty channel uses DefaultChannel
+func NewPostgresEventPublisher(conn db.DatabaseConnection, channel string) EventPublisher {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	return &postgresEventPublisher{
+		db: conn,
+		channel: channel,
+	}
+}
+
+/*
+ * Notifies the channel with the event as a JSON payload
+ */
+func (p *postgresEventPublisher) Publish(event *Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("SELECT pg_notify($1, $2)", p.channel, string(payload))
+	return err
+}
+
+// Keeps published events in memory, for tests and for subscribers within the process
+type MemoryEventPublisher struct {
+	lock        sync.Mutex
+	events      []*Event
+	subscribers []chan *Event
+}
+
+func NewMemoryEventPublisher() *MemoryEventPublisher {
+	return &MemoryEventPublisher{}
+}
+
+/*
+ * Records the event and sends it to each subscriber. Subscribers whose buffer is full miss the event
+ */
+func (m *MemoryEventPublisher) Publish(event *Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, event)
+	for _, subscriber := range m.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+// Returns the events that have been published, oldest first
+func (m *MemoryEventPublisher) Events() []*Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*Event(nil), m.events...)
+}
+
+// Returns a channel that receives the events published from now on
+func (m *MemoryEventPublisher) Subscribe(buffer int) <-chan *Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	subscriber := make(chan *Event, buffer)
+	m.subscribers = append(m.subscribers, subscriber)
+	return subscriber
+}
@@ -0,0 +1,84 @@
+// Tests the event publishers
+package events
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// Matches a JSON payload holding the expected event, ignoring its timestamp
+type eventPayload struct {
+	expected Event
+}
+
+func (e eventPayload) Match(v driver.Value) bool {
+	payload, ok := v.(string)
+	if !ok {
+		return false
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(payload), &event); err != nil || event.Timestamp.IsZero() {
+		return false
+	}
+	event.Timestamp = e.expected.Timestamp
+	return assert.ObjectsAreEqual(e.expected, event)
+}
+
+func TestPostgresEventPublisher_Publish(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer conn.Close()
+	publisher := NewPostgresEventPublisher(conn, "")
+	expected := Event{
+		JobId: "test-id",
+		OldStatus: enums.CONVERTING.Name(),
+		NewStatus: enums.COMPLETED.Name(),
+		Urls: []string{"test-url"},
+	}
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_notify($1, $2)")).
+		WithArgs(DefaultChannel, eventPayload{expected}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	Publish(publisher, "test-id", enums.CONVERTING, enums.COMPLETED, "test-url")
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_notify($1, $2)")).
+		WithArgs("test-channel", eventPayload{Event{JobId: "test-id", NewStatus: enums.QUEUED.Name()}}).
+		WillReturnError(errors.New("testing error"))
+	err = NewPostgresEventPublisher(conn, "test-channel").Publish(&Event{
+		JobId: "test-id",
+		NewStatus: enums.QUEUED.Name(),
+		Timestamp: time.Now(),
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMemoryEventPublisher(t *testing.T) {
+	publisher := NewMemoryEventPublisher()
+	subscriber := publisher.Subscribe(1)
+	Publish(publisher, "test-id", nil, enums.QUEUED)
+	Publish(publisher, "test-id", enums.QUEUED, enums.CONVERTING)
+	published := publisher.Events()
+	if assert.Len(t, published, 2) {
+		assert.Empty(t, published[0].OldStatus, "new jobs have no old status")
+		assert.Equal(t, enums.QUEUED.Name(), published[0].NewStatus)
+		assert.Equal(t, enums.QUEUED.Name(), published[1].OldStatus)
+		assert.Equal(t, enums.CONVERTING.Name(), published[1].NewStatus)
+		assert.False(t, published[1].Timestamp.Before(published[0].Timestamp))
+	}
+	assert.Equal(t, published[0], <- subscriber)
+	select {
+	case event := <- subscriber:
+		t.Errorf("a full subscriber should miss events, received %v", event)
+	default:
+	}
+}
+
+func TestPublish_NilPublisher(t *testing.T) {
+	Publish(nil, "test-id", nil, enums.QUEUED)
+}
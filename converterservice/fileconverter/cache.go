@@ -0,0 +1,33 @@
+package fileconverter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// How often cache entries whose objects have expired are evicted
+const cacheEvictionInterval = time.Hour
+
+/*
+ * Combines the digest of the source bytes with the normalized conversion parameters,
+ * so that the same source converted with different settings has a different address
+ */
+func ContentAddress(sourceDigest []byte, req *FileConversionRequest) string {
+	digest := sha256.New()
+	digest.Write(sourceDigest)
+	digest.Write([]byte(conversionParameters(req)))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+/*
+ * Returns the conversion parameters in a canonical form.
+ * Parameters that do not change the converted bytes, such as the temp file extension, are excluded.
+ * The tenant is included so that tenants never share cached objects
+ */
+func conversionParameters(req *FileConversionRequest) string {
+	sampleRate, channels := req.outputLayout()
+	return fmt.Sprintf("tenant=%s;src=%s;dest=%s;rate=%d;channels=%d",
+		req.Tenant, req.SourceEncoding.Name(), req.DestEncoding.Name(), sampleRate, channels)
+}
@@ -0,0 +1,133 @@
+package fileconverter
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"os/exec"
+	"strings"
+)
+
+// The demuxers, muxers and encoders that an ffmpeg build supports
+type Capabilities struct {
+	Demuxers map[string]bool
+	Muxers   map[string]bool
+	Encoders map[string]bool
+}
+
+// Discovers what the installed ffmpeg can read and write
+type CapabilityProber interface {
+	Probe() (*Capabilities, error)
+}
+
+// The default capability prober, which lists the formats and encoders of the ffmpeg on the path
+type ffmpegCapabilityProber struct {}
+
+func NewCapabilityProber() CapabilityProber {
+	return &ffmpegCapabilityProber{}
+}
+
+/*
+ * Runs ffmpeg to list its formats and encoders
+ */
+func (p *ffmpegCapabilityProber) Probe() (*Capabilities, error) {
+	formats, err := exec.Command(ffmpeg, "-hide_banner", "-formats").Output()
+	if err != nil {
+		return nil, err
+	}
+	encoders, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+	capabilities := &Capabilities{
+		Encoders: parseEncoders(encoders),
+	}
+	capabilities.Demuxers, capabilities.Muxers = parseFormats(formats)
+	return capabilities, nil
+}
+
+/*
+ * Returns the flags and name columns of each row in an ffmpeg listing,
+ * which follow a legend that ends in a line of dashes
+ */
+func listingRows(listing []byte) [][2]string {
+	var rows [][2]string
+	inLegend := true
+	scanner := bufio.NewScanner(bytes.NewReader(listing))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if inLegend {
+			inLegend = len(fields) != 1 || strings.Trim(fields[0], "-") != ""
+			continue
+		}
+		if len(fields) >= 2 {
+			rows = append(rows, [2]string{fields[0], fields[1]})
+		}
+	}
+	return rows
+}
+
+/*
+ * Parses the output of ffmpeg -formats, where D marks a demuxer and E a muxer.
+ * A row may name several formats separated by commas
+ */
+func parseFormats(listing []byte) (map[string]bool, map[string]bool) {
+	demuxers, muxers := map[string]bool{}, map[string]bool{}
+	for _, row := range listingRows(listing) {
+		for _, name := range strings.Split(row[1], ",") {
+			if strings.Contains(row[0], "D") {
+				demuxers[name] = true
+			}
+			if strings.Contains(row[0], "E") {
+				muxers[name] = true
+			}
+		}
+	}
+	return demuxers, muxers
+}
+
+/*
+ * Parses the output of ffmpeg -encoders, keeping only audio encoders
+ */
+func parseEncoders(listing []byte) map[string]bool {
+	encoders := map[string]bool{}
+	for _, row := range listingRows(listing) {
+		if strings.HasPrefix(row[0], "A") {
+			encoders[row[1]] = true
+		}
+	}
+	return encoders
+}
+
+/*
+ * Returns capabilities that can read and write every registered format, for when ffmpeg
+ * is not run locally and the formats are checked wherever it is
+ */
+func RegisteredCapabilities() *Capabilities {
+	capabilities := &Capabilities{
+		Demuxers: map[string]bool{},
+		Muxers: map[string]bool{},
+		Encoders: map[string]bool{},
+	}
+	for _, format := range enums.Formats() {
+		capabilities.Demuxers[format.Demuxer] = true
+		capabilities.Muxers[format.Muxer] = true
+		capabilities.Encoders[format.Codec] = true
+	}
+	return capabilities
+}
+
+/*
+ * Returns true when ffmpeg can read the format. Nil capabilities are unknown, so nothing can be read
+ */
+func (c *Capabilities) CanRead(format *enums.Format) bool {
+	return c != nil && c.Demuxers[format.Demuxer]
+}
+
+/*
+ * Returns true when ffmpeg can encode and write the format. Nil capabilities are unknown,
+ * so nothing can be written
+ */
+func (c *Capabilities) CanWrite(format *enums.Format) bool {
+	return c != nil && c.Muxers[format.Muxer] && c.Encoders[format.Codec]
+}
@@ -0,0 +1,76 @@
+package fileconverter
+
+import (
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const testFormatsListing = `File formats:
+ D. = Demuxing supported
+ .E = Muxing supported
+ --
+ D  aac             raw ADTS AAC (Advanced Audio Coding)
+  E adts            ADTS AAC (Advanced Audio Coding)
+ DE flac            raw FLAC
+  E ipod            iPod H.264 MP4 (MPEG-4 Part 14)
+ D  mov,mp4,m4a,3gp,3g2,mj2 QuickTime / MOV
+ DE mp3             MP3 (MPEG audio layer 3)
+  E mp4             MP4 (MPEG-4 Part 14)
+ DE wav             WAV / WAVE (Waveform Audio)
+`
+
+const testEncodersListing = `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10
+ A....D aac                  AAC (Advanced Audio Coding)
+ A....D alac                 ALAC (Apple Lossless Audio Codec)
+ A....D flac                 FLAC (Free Lossless Audio Codec)
+ A..... pcm_s16le            PCM signed 16-bit little-endian
+`
+
+func TestParseFormats(t *testing.T) {
+	demuxers, muxers := parseFormats([]byte(testFormatsListing))
+	assert.Equal(t, map[string]bool{
+		"aac": true, "flac": true, "mov": true, "mp4": true, "m4a": true, "3gp": true,
+		"3g2": true, "mj2": true, "mp3": true, "wav": true,
+	}, demuxers)
+	assert.Equal(t, map[string]bool{
+		"adts": true, "flac": true, "ipod": true, "mp3": true, "mp4": true, "wav": true,
+	}, muxers)
+}
+
+func TestParseEncoders(t *testing.T) {
+	assert.Equal(t, map[string]bool{
+		"aac": true, "alac": true, "flac": true, "pcm_s16le": true,
+	}, parseEncoders([]byte(testEncodersListing)))
+}
+
+func TestCapabilities(t *testing.T) {
+	demuxers, muxers := parseFormats([]byte(testFormatsListing))
+	capabilities := &Capabilities{
+		Demuxers: demuxers,
+		Muxers: muxers,
+		Encoders: parseEncoders([]byte(testEncodersListing)),
+	}
+	assert.True(t, capabilities.CanRead(enums.M4A.Format()))
+	assert.True(t, capabilities.CanWrite(enums.ALAC.Format()))
+	assert.True(t, capabilities.CanWrite(enums.WAV.Format()))
+	// mp3 can be read, but libmp3lame is not built in
+	assert.True(t, capabilities.CanRead(enums.MP3.Format()))
+	assert.False(t, capabilities.CanWrite(enums.MP3.Format()))
+	assert.False(t, capabilities.CanRead(enums.OGG.Format()))
+	var unknown *Capabilities
+	assert.False(t, unknown.CanRead(enums.OGG.Format()))
+	assert.False(t, unknown.CanWrite(enums.OGG.Format()))
+}
+
+func TestRegisteredCapabilities(t *testing.T) {
+	capabilities := RegisteredCapabilities()
+	for _, format := range enums.Formats() {
+		assert.True(t, capabilities.CanRead(format), "should read %s", format.Name)
+		assert.True(t, capabilities.CanWrite(format), "should write %s", format.Name)
+	}
+}
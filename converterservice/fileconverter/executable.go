@@ -1,8 +1,10 @@
 package fileconverter
 
 import (
+	"errors"
 	"io"
 	"os/exec"
+	"strings"
 )
 
 // A wrapper for exec.Cmd
@@ -13,6 +15,9 @@ type Executable interface {
 	// Waits for the command to finish executing.
 	// Analogous to cmd.Wait()
 	Wait()   error
+	// Kills the running command, causing Wait to return.
+	// Analogous to cmd.Process.Kill()
+	Kill()   error
 	// A getter for stdout
 	Stdout() io.Writer
 	// Sets the stdout stream
@@ -30,7 +35,9 @@ type Executable interface {
 }
 
 type defaultExecutable struct {
-	cmd *exec.Cmd
+	cmd     *exec.Cmd
+	// Values scrubbed from String, such as source header credentials
+	secrets []string
 }
 
 // Returns a new executable with the given cmd
@@ -40,6 +47,14 @@ func newDefaultExecutable(command string, args ...string) Executable {
 	}
 }
 
+// Returns a new executable with the given cmd that never prints the secrets
+func newRedactedExecutable(secrets []string, command string, args ...string) Executable {
+	return &defaultExecutable{
+		cmd: exec.Command(command, args...),
+		secrets: secrets,
+	}
+}
+
 func (e *defaultExecutable) Start() error {
 	if err := e.cmd.Start(); err != nil {
 		return err
@@ -54,6 +69,13 @@ func (e *defaultExecutable) Wait() error {
 	return nil
 }
 
+func (e *defaultExecutable) Kill() error {
+	if e.cmd.Process == nil {
+		return errors.New("command has not been started")
+	}
+	return e.cmd.Process.Kill()
+}
+
 func (e *defaultExecutable) Stdout() io.Writer {
 	return e.cmd.Stdout
 }
@@ -79,5 +101,11 @@ func (e *defaultExecutable) SetStderr(stderr io.Writer) {
 }
 
 func (e *defaultExecutable) String() string {
-	return e.cmd.String()
+	printed := e.cmd.String()
+	for _, secret := range e.secrets {
+		if secret != "" {
+			printed = strings.ReplaceAll(printed, secret, redacted)
+		}
+	}
+	return printed
 }
\ No newline at end of file
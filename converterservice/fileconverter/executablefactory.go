@@ -1,15 +1,38 @@
 package fileconverter
 
-import encodings "github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+import "strconv"
 
 const (
-	ffmpeg      = "ffmpeg"
-	formatFlag  = "-f"
-	inputFlag   = "-i"
-	mapFlag     = "-map"
-	audioStream = "0:0"
+	ffmpeg         = "ffmpeg"
+	formatFlag     = "-f"
+	inputFlag      = "-i"
+	mapFlag        = "-map"
+	audioStream    = "0:0"
+	codecFlag      = "-c:a"
+	sampleRateFlag = "-ar"
+	channelsFlag   = "-ac"
+	noStatsFlag    = "-nostats"
+	progressFlag   = "-progress"
+	protocolWhitelistFlag = "-protocol_whitelist"
+	fileProtocol   = "file"
+	// Progress is written to stdout as key=value lines, leaving stderr for errors
+	progressPipe   = "pipe:1"
 )
 
+/*
+ * Returns the sample rate and channel arguments, omitting those that are zero
+ */
+func layoutArgs(sampleRate int, channels int) []string {
+	var args []string
+	if sampleRate > 0 {
+		args = append(args, sampleRateFlag, strconv.Itoa(sampleRate))
+	}
+	if channels > 0 {
+		args = append(args, channelsFlag, strconv.Itoa(channels))
+	}
+	return args
+}
+
 // A command factory
 type ExecutableFactory interface {
 	// Creates the appropriate file conversion command
@@ -25,53 +48,28 @@ func newDefaultExecutableFactory() ExecutableFactory {
 }
 
 /*
- * Returns a pointer to the command object
- */
-func commandForDestEncoding(job *ConversionAttributes) Executable {
-	return newDefaultExecutable(ffmpeg,
-		formatFlag,
-		job.Request.SourceEncoding.Name(),
-		inputFlag,
-		job.Request.SourceUrl,
-		mapFlag,
-		audioStream,
-		formatFlag,
-		job.Request.DestEncoding.Name(),
-		job.TmpFile)
-}
-
-/*
- * Creates a command object for conversions to MP4.
- * Note: MPEG-4 is the container type, and M4A specifies audio only
- * so we force the extension to be the audio type
+ * Returns the arguments to ffmpeg that read the source and write the temp file,
+ * selecting the demuxer, codec, muxer and output layout for each encoding.
+ * The source has already been fetched, so ffmpeg may only read local files
  */
-func commandForMP4(job *ConversionAttributes) Executable {
-	const m4a string = "m4a"
-	job.TmpFile = newTempFilePath(job.Request.Id, m4a, job.Request.IncludeExtension)
-	return commandForDestEncoding(job)
-}
-
-/*
- * Creates a command object for codecs that do not require special circumstances
- */
-func defaultCommand(job *ConversionAttributes) Executable {
-	job.TmpFile = newTempFilePath(job.Request.Id, job.Request.DestEncoding.Name(), job.Request.IncludeExtension)
-	return commandForDestEncoding(job)
+func conversionArgs(job *ConversionAttributes) []string {
+	src := job.Request.SourceEncoding.Format()
+	dest := job.Request.DestEncoding.Format()
+	args := []string{noStatsFlag, progressFlag, progressPipe, formatFlag, src.Demuxer}
+	if src.Headerless {
+		args = append(args, layoutArgs(src.SampleRate, src.Channels)...)
+	}
+	args = append(args, protocolWhitelistFlag, fileProtocol, inputFlag, job.SourceFile, mapFlag, audioStream, codecFlag, dest.Codec)
+	args = append(args, layoutArgs(job.Request.outputLayout())...)
+	return append(args, formatFlag, dest.Muxer, job.TmpFile)
 }
 
 /*
- * Selects the appropriate command to be created
+ * Selects the appropriate command to be created.
+ * The temp file takes the extension of the destination encoding, so that MPEG-4 audio is written as m4a.
+ * Source header values are scrubbed from the printed command
  */
-func (e *defaultExecutableFactory) Build(job *ConversionAttributes) (cmd Executable) {
-	switch job.Request.DestEncoding {
-	case encodings.MP4:
-		cmd = commandForMP4(job)
-	default:
-		cmd = defaultCommand(job)
-	}
-	return cmd
+func (e *defaultExecutableFactory) Build(job *ConversionAttributes) Executable {
+	job.TmpFile = newTempFilePath(job.Request.Id, job.Request.DestEncoding.Format().Extension, job.Request.IncludeExtension)
+	return newRedactedExecutable(job.Request.SourceHeaders.values(), ffmpeg, conversionArgs(job)...)
 }
-
-
-
-
@@ -20,6 +20,7 @@ func trimCommand(command string) (string, error) {
 func TestDefaultExecutableFactory_Build(t *testing.T) {
 	factory := newDefaultExecutableFactory()
 	sourceUrl := "test-url"
+	sourceFile := "/tmp/test-id.source"
 	sourceEncoding := enums.MP3
 	id := "test-id"
 	includeExtension := true
@@ -34,6 +35,7 @@ func TestDefaultExecutableFactory_Build(t *testing.T) {
 				Id: id,
 				IncludeExtension: includeExtension,
 			},
+			SourceFile: sourceFile,
 		}
 		cmd := factory.Build(job)
 		// Should not have changed request
@@ -43,20 +45,16 @@ func TestDefaultExecutableFactory_Build(t *testing.T) {
 		assert.Equal(t, id, job.Request.Id)
 		assert.True(t, job.Request.IncludeExtension)
 		// Check the command
-		assert.Equal(t,
-			fmt.Sprintf("/tmp/%s.%s", id, strings.ToLower(job.Request.DestEncoding.Name())),
-			job.TmpFile)
+		assert.Equal(t, fmt.Sprintf("/tmp/%s.wav", id), job.TmpFile)
 		command, err := trimCommand(cmd.String())
 		if err != nil {
 			t.Error("command does not match")
 		}
 		assert.Equal(t,
 			fmt.Sprintf(
-				"ffmpeg -f %s -i %s -map 0:0 -f %s %s",
-				sourceEncoding.Name(),
-				sourceUrl,
-				destEncoding.Name(),
-				fmt.Sprintf("/tmp/%s.%s", id, strings.ToLower(destEncoding.Name()))),
+				"ffmpeg -nostats -progress pipe:1 -f mp3 -protocol_whitelist file -i %s -map 0:0 -c:a pcm_s16le -f wav /tmp/%s.wav",
+				sourceFile,
+				id),
 				command)
 	})
 	// test MP4
@@ -70,6 +68,7 @@ func TestDefaultExecutableFactory_Build(t *testing.T) {
 				Id: id,
 				IncludeExtension: includeExtension,
 			},
+			SourceFile: sourceFile,
 		}
 		cmd := factory.Build(job)
 		// Should not have changed request
@@ -85,11 +84,67 @@ func TestDefaultExecutableFactory_Build(t *testing.T) {
 		}
 		assert.Equal(t,
 			fmt.Sprintf(
-				"ffmpeg -f %s -i %s -map 0:0 -f %s %s",
-				sourceEncoding.Name(),
-				sourceUrl,
-				destEncoding.Name(),
-				fmt.Sprintf("/tmp/%s.m4a", id)),
+				"ffmpeg -nostats -progress pipe:1 -f mp3 -protocol_whitelist file -i %s -map 0:0 -c:a aac -f mp4 /tmp/%s.m4a",
+				sourceFile,
+				id),
 			commandString)
 	})
+	// formats with their own codec and muxer
+	tests := []struct {
+		source   enums.Encoding
+		dest     enums.Encoding
+		expected string
+	}{
+		{enums.MP3, enums.OPUS, "-f mp3 -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a libopus -f opus /tmp/test-id.opus"},
+		{enums.FLAC, enums.ALAC, "-f flac -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a alac -f ipod /tmp/test-id.m4a"},
+		{enums.OGG, enums.AAC, "-f ogg -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a aac -f adts /tmp/test-id.aac"},
+		{enums.WEBM, enums.AIFF, "-f webm -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a pcm_s16be -f aiff /tmp/test-id.aiff"},
+		{enums.PCM, enums.M4A, "-f s16le -ar 44100 -ac 2 -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a aac -f ipod /tmp/test-id.m4a"},
+		{enums.M4A, enums.PCM, "-f mp4 -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a pcm_s16le -ar 44100 -ac 2 -f s16le /tmp/test-id.pcm"},
+		{enums.MP3, enums.ULAW, "-f mp3 -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a pcm_mulaw -ar 8000 -ac 1 -f wav /tmp/test-id.wav"},
+		{enums.WAV, enums.ALAW, "-f wav -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a pcm_alaw -ar 8000 -ac 1 -f wav /tmp/test-id.wav"},
+		{enums.WAV, enums.GSM, "-f wav -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a libgsm -ar 8000 -ac 1 -f gsm /tmp/test-id.gsm"},
+		{enums.AMR_NB, enums.MP3, "-f amr -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a libmp3lame -f mp3 /tmp/test-id.mp3"},
+		{enums.FLAC, enums.AMR_NB, "-f flac -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a libopencore_amrnb -ar 8000 -ac 1 -f amr /tmp/test-id.amr"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s->%s", test.source.Name(), test.dest.Name()), func(t *testing.T) {
+			job := &ConversionAttributes{
+				Request: &FileConversionRequest{
+					SourceUrl: sourceUrl,
+					SourceEncoding: test.source,
+					DestEncoding: test.dest,
+					Id: id,
+					IncludeExtension: includeExtension,
+				},
+				SourceFile: sourceFile,
+			}
+			command, err := trimCommand(factory.Build(job).String())
+			if err != nil {
+				t.Error("command does not match")
+			}
+			assert.Equal(t, "ffmpeg -nostats -progress pipe:1 " + test.expected, command)
+		})
+	}
+}
+
+func TestDefaultExecutableFactory_Build_Layout(t *testing.T) {
+	job := &ConversionAttributes{
+		Request: &FileConversionRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: enums.WAV,
+			DestEncoding: enums.MP3,
+			Id: "test-id",
+			SampleRate: 22050,
+			Channels: 1,
+		},
+		SourceFile: "/tmp/test-id.source",
+	}
+	command, err := trimCommand(newDefaultExecutableFactory().Build(job).String())
+	if err != nil {
+		t.Error("command does not match")
+	}
+	assert.Equal(t,
+		"ffmpeg -nostats -progress pipe:1 -f wav -protocol_whitelist file -i /tmp/test-id.source -map 0:0 -c:a libmp3lame -ar 22050 -ac 1 -f mp3 /tmp/test-id",
+		command)
 }
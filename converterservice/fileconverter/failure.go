@@ -0,0 +1,144 @@
+package fileconverter
+
+import (
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// The number of trailing bytes of ffmpeg's stderr kept for classifying failures
+const stderrTailSize = 4096
+
+// The most lines and bytes of ffmpeg's stderr included in a failure message
+const (
+	stderrExcerptLines = 5
+	stderrExcerptSize  = 512
+)
+
+// Fragments of ffmpeg's stderr that indicate the source is not audio ffmpeg can read
+var unsupportedInputErrors = []string{
+	"Invalid data found when processing input",
+	"could not find codec parameters",
+	"Unknown input format",
+	"does not contain any stream",
+	"matches no streams",
+}
+
+// Returned by steps that are not run because the converter was stopped
+var errStopped = permanentFailure(enums.INTERNAL, "converter was stopped")
+
+// Returned by retries that are not run because another worker took over the job
+var errLeaseLost = permanentFailure(enums.INTERNAL, "job is no longer held by this converter")
+
+// A failed step of a conversion job
+type jobFailure struct {
+	code      enums.ErrorCode
+	message   string
+	transient bool
+}
+
+func (f *jobFailure) Error() string {
+	return f.message
+}
+
+// Creates a failure that may succeed if the step is retried, such as a network error
+func transientFailure(code enums.ErrorCode, format string, args ...interface{}) *jobFailure {
+	return &jobFailure{
+		code: code,
+		message: fmt.Sprintf(format, args...),
+		transient: true,
+	}
+}
+
+// Creates a failure that will not succeed if the step is retried, such as invalid input audio
+func permanentFailure(code enums.ErrorCode, format string, args ...interface{}) *jobFailure {
+	return &jobFailure{
+		code: code,
+		message: fmt.Sprintf(format, args...),
+		transient: false,
+	}
+}
+
+func containsAny(s string, fragments []string) bool {
+	for _, fragment := range fragments {
+		if strings.Contains(s, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Classifies a failed ffmpeg run using its stderr. ffmpeg only reads the copy of the source already
+ * fetched to a temp file, so its failures are permanent and are never download failures
+ */
+func classifyConversionFailure(err error, stderr string) *jobFailure {
+	reason := ffmpegExitReason(err, stderr)
+	switch {
+	case containsAny(stderr, unsupportedInputErrors):
+		return permanentFailure(enums.UNSUPPORTED_INPUT, "unsupported input audio, %s", reason)
+	default:
+		return permanentFailure(enums.CONVERSION_FAILED, "conversion failed, %s", reason)
+	}
+}
+
+/*
+ * Describes how ffmpeg exited, including the exit code when there is one and an excerpt of stderr
+ */
+func ffmpegExitReason(err error, stderr string) string {
+	reason := fmt.Sprintf("ffmpeg failed: %v", err)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		reason = fmt.Sprintf("ffmpeg exited with code %d", exitErr.ExitCode())
+	}
+	if excerpt := stderrExcerpt(stderr); excerpt != "" {
+		reason = fmt.Sprintf("%s: %s", reason, excerpt)
+	}
+	return reason
+}
+
+/*
+ * Returns the last lines of stderr, where ffmpeg reports the error that stopped it
+ */
+func stderrExcerpt(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if len(lines) > stderrExcerptLines {
+		lines = lines[len(lines) - stderrExcerptLines:]
+	}
+	excerpt := strings.Join(lines, "\n")
+	if len(excerpt) > stderrExcerptSize {
+		excerpt = excerpt[len(excerpt) - stderrExcerptSize:]
+	}
+	return excerpt
+}
+
+// A writer that keeps the last bytes written to it
+type stderrTail struct {
+	lock sync.Mutex
+	buff []byte
+	size int
+}
+
+func newStderrTail(size int) *stderrTail {
+	return &stderrTail{
+		buff: make([]byte, 0, size),
+		size: size,
+	}
+}
+
+func (s *stderrTail) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buff = append(s.buff, p...)
+	if overflow := len(s.buff) - s.size; overflow > 0 {
+		s.buff = append(s.buff[:0], s.buff[overflow:]...)
+	}
+	return len(p), nil
+}
+
+func (s *stderrTail) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return string(s.buff)
+}
@@ -0,0 +1,43 @@
+package fileconverter
+
+import (
+	"errors"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestClassifyConversionFailure(t *testing.T) {
+	err := errors.New("exit status 1")
+	tests := []struct {
+		stderr    string
+		code      enums.ErrorCode
+		transient bool
+	}{
+		{"/tmp/test: I/O error", enums.CONVERSION_FAILED, false},
+		{"/tmp/test: No such file or directory", enums.CONVERSION_FAILED, false},
+		{"pipe:: Invalid data found when processing input", enums.UNSUPPORTED_INPUT, false},
+		{"Conversion failed!", enums.CONVERSION_FAILED, false},
+		{"", enums.CONVERSION_FAILED, false},
+	}
+	for _, test := range tests {
+		failure := classifyConversionFailure(err, test.stderr)
+		assert.Equal(t, test.code, failure.code, test.stderr)
+		assert.Equal(t, test.transient, failure.transient, test.stderr)
+		assert.Contains(t, failure.message, test.stderr)
+	}
+}
+
+func TestStderrExcerpt(t *testing.T) {
+	assert.Equal(t, "", stderrExcerpt(" \n"))
+	assert.Equal(t, "4\n5\n6\n7\n8", stderrExcerpt("1\n2\n3\n4\n5\n6\n7\n8\n"))
+	assert.Len(t, stderrExcerpt(strings.Repeat("a", 2 * stderrExcerptSize)), stderrExcerptSize)
+}
+
+func TestStderrTail(t *testing.T) {
+	tail := newStderrTail(8)
+	_, _ = tail.Write([]byte("0123"))
+	_, _ = tail.Write([]byte("456789"))
+	assert.Equal(t, "23456789", tail.String())
+}
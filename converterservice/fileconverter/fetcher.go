@@ -0,0 +1,333 @@
+package fileconverter
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest connecting to a source may take
+const fetchDialTimeout = 30 * time.Second
+
+// The suffix of the temp file a source is fetched to
+const sourceFileSuffix = "source"
+
+// The context key holding the source headers of a fetch, so that redirects can drop them
+type sourceHeadersKey struct{}
+
+// The context key holding the function called before each retry of a fetch
+type fetchRetryKey struct{}
+
+// Downloads sources so that ffmpeg only reads local files
+type SourceFetcher interface {
+	// Downloads the request's source to the file at path, replacing anything already there.
+	// The download is abandoned when the context is done
+	Fetch(ctx context.Context, req *FileConversionRequest, path string) (*FetchedSource, error)
+}
+
+// A source that has been downloaded to a local file
+type FetchedSource struct {
+	Path   string
+	Size   int64
+	// The SHA-256 of the source bytes
+	Digest []byte
+}
+
+// Returned when the source server responds with a status other than the content
+type errFetchStatus struct {
+	status string
+	code   int
+}
+
+func (e errFetchStatus) Error() string {
+	return fmt.Sprintf("unexpected response %s fetching source", e.status)
+}
+
+// The default source fetcher, which downloads sources over HTTP
+type httpSourceFetcher struct {
+	client      *http.Client
+	limits      tenantInputLimits
+	retryPolicy RetryPolicy
+}
+
+/*
+ * Downloads are limited by the deadline of the context they are fetched with. Every connection and redirect
+ * is checked against the source policy, so a host cannot pass the policy and then resolve to a private address.
+ * Source headers are not sent on redirects to another host
+ */
+func newHttpSourceFetcher(limits tenantInputLimits, sourcePolicy *SourcePolicy, retry RetryPolicy) SourceFetcher {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	dialer := &net.Dialer{Timeout: fetchDialTimeout, Control: sourcePolicy.dialControl}
+	return &httpSourceFetcher{
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				stripSourceHeaders(req, via)
+				return sourcePolicy.checkRedirect(req, via)
+			},
+		},
+		limits: limits,
+		retryPolicy: retry,
+	}
+}
+
+// The progress of a download, kept between attempts so that an interrupted download can be resumed
+type sourceDownload struct {
+	file      *os.File
+	digest    hash.Hash
+	size      int64
+	limit     int64
+	// Identifies the version of the source being downloaded, so that a source that changes is fetched again
+	validator string
+}
+
+/*
+ * Downloads the source, resuming from the bytes already received when an attempt fails transiently.
+ * Sources over the tenant's size limit are rejected by their Content-Length, or once the limit has been read
+ */
+func (h *httpSourceFetcher) Fetch(ctx context.Context, req *FileConversionRequest, path string) (*FetchedSource, error) {
+	return fetchToFile(ctx, req, path, h.limits.forTenant(req.Tenant).MaxBytes, h.retryPolicy,
+		func(download *sourceDownload) error {
+			return h.resume(ctx, download, req)
+		})
+}
+
+/*
+ * Returns a context whose fetches call retried before each retry, so that the retry can be recorded on the job.
+ * The fetch is abandoned with the error retried returns, if any
+ */
+func withFetchRetryHook(ctx context.Context, retried func() error) context.Context {
+	return context.WithValue(ctx, fetchRetryKey{}, retried)
+}
+
+/*
+ * Downloads the source to the file at path, calling resume until it succeeds, fails permanently
+ * or the context is done. Each call continues from the bytes already received, or starts over when it cannot
+ */
+func fetchToFile(ctx context.Context, req *FileConversionRequest, path string, limit int64, retry RetryPolicy,
+	resume func(download *sourceDownload) error) (*FetchedSource, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	download := &sourceDownload{
+		file: file,
+		digest: sha256.New(),
+		limit: limit,
+	}
+	for attempt := 1; ; attempt++ {
+		err := resume(download)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !isTransientFetchError(err) || attempt >= retry.MaxAttempts {
+			return nil, err
+		}
+		delay := retry.backoff(attempt)
+		log.Printf("fetching source for %s failed after %d bytes, retrying in %v: %v", req.Id, download.size, delay, err)
+		select {
+		case <- time.After(delay):
+		case <- ctx.Done():
+			return nil, ctx.Err()
+		}
+		if retried, ok := ctx.Value(fetchRetryKey{}).(func() error); ok {
+			if err := retried(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &FetchedSource{
+		Path: path,
+		Size: download.size,
+		Digest: download.digest.Sum(nil),
+	}, nil
+}
+
+/*
+ * Requests the rest of the source and appends it to the file. The source is requested from the start
+ * when nothing has been received, when it has no validator or when the server ignores the range
+ */
+func (h *httpSourceFetcher) resume(ctx context.Context, d *sourceDownload, req *FileConversionRequest) error {
+	ctx = context.WithValue(ctx, sourceHeadersKey{}, req.SourceHeaders)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, req.SourceUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.SourceHeaders.apply(request.Header)
+	resuming := d.resuming()
+	if resuming {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.size))
+		request.Header.Set("If-Range", d.validator)
+	} else if err := d.reset(); err != nil {
+		return err
+	}
+	res, err := h.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case resuming && res.StatusCode == http.StatusPartialContent:
+		if err := d.checkResumedAt(res.Header.Get("Content-Range")); err != nil {
+			return err
+		}
+	case res.StatusCode == http.StatusOK:
+		if err := d.restart(validator(res.Header), res.ContentLength); err != nil {
+			return err
+		}
+	default:
+		return errFetchStatus{status: res.Status, code: res.StatusCode}
+	}
+	return d.append(res.Body)
+}
+
+/*
+ * Removes the source headers from a redirect to a host or scheme other than the source's, so that
+ * credentials for the source are not sent to wherever it redirects, nor downgraded from https to http
+ */
+func stripSourceHeaders(req *http.Request, via []*http.Request) {
+	headers, _ := req.Context().Value(sourceHeadersKey{}).(SourceHeaders)
+	if len(via) == 0 || (strings.EqualFold(req.URL.Host, via[0].URL.Host) &&
+		strings.EqualFold(req.URL.Scheme, via[0].URL.Scheme)) {
+		return
+	}
+	for name := range headers {
+		req.Header.Del(name)
+	}
+}
+
+/*
+ * Returns true when bytes have been received and the source can be validated, so the rest can be requested
+ */
+func (d *sourceDownload) resuming() bool {
+	return d.size > 0 && d.validator != ""
+}
+
+/*
+ * Checks that a resumed response starts where the download stopped, starting over on the next attempt if not
+ */
+func (d *sourceDownload) checkResumedAt(contentRange string) error {
+	if start := rangeStart(contentRange); start != d.size {
+		d.validator = ""
+		return fmt.Errorf("source resumed from byte %d instead of %d", start, d.size)
+	}
+	return nil
+}
+
+/*
+ * Starts the download over with a response for the whole source, rejecting it if its length is over the limit.
+ * A negative length is unknown
+ */
+func (d *sourceDownload) restart(validator string, contentLength int64) error {
+	if err := d.reset(); err != nil {
+		return err
+	}
+	d.validator = validator
+	if d.limit > 0 && contentLength > d.limit {
+		return errSourceTooLarge{d.limit}
+	}
+	return nil
+}
+
+/*
+ * Appends the body to the file and the digest, stopping once the size limit has been passed
+ */
+func (d *sourceDownload) append(body io.Reader) error {
+	if d.limit > 0 {
+		body = io.LimitReader(body, d.limit+1-d.size)
+	}
+	read, err := io.Copy(io.MultiWriter(d.file, d.digest), body)
+	d.size += read
+	if d.limit > 0 && d.size > d.limit {
+		return errSourceTooLarge{d.limit}
+	}
+	return err
+}
+
+/*
+ * Discards the bytes received so far
+ */
+func (d *sourceDownload) reset() error {
+	d.size = 0
+	d.digest.Reset()
+	if err := d.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := d.file.Seek(0, io.SeekStart)
+	return err
+}
+
+/*
+ * Returns the value to send as If-Range when resuming, or the empty string when the source cannot be
+ * resumed safely. Weak ETags cannot be used with If-Range
+ */
+func validator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+/*
+ * Returns the first byte of a Content-Range such as "bytes 100-199/200", or -1 when it cannot be parsed
+ */
+func rangeStart(contentRange string) int64 {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return -1
+	}
+	dash := strings.Index(contentRange, "-")
+	if dash < 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(contentRange[len("bytes "):dash], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+/*
+ * Returns true when the download may succeed if it is resumed, such as after a dropped connection
+ * or a server error. Sources that are too large, not allowed, missing, unparseable or that redirect
+ * too many times are not retried. A source that changed while it was resumed is retried from the start
+ */
+func isTransientFetchError(err error) bool {
+	var status errFetchStatus
+	if errors.As(err, &status) {
+		return isTransientFetchStatus(status.code)
+	}
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return isTransientFetchStatus(requestFailure.StatusCode()) ||
+			requestFailure.StatusCode() == http.StatusPreconditionFailed
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return false
+	}
+	var tooLarge errSourceTooLarge
+	var notAllowed errSourceNotAllowed
+	return !errors.As(err, &tooLarge) && !errors.As(err, &notAllowed) && !errors.Is(err, errTooManyRedirects)
+}
+
+func isTransientFetchStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
@@ -0,0 +1,277 @@
+package fileconverter
+
+import (
+	"context"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A retry policy that retries immediately
+var testFetchRetry = RetryPolicy{MaxAttempts: 3}
+
+func testSourceFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fetcher")
+	assert.Nil(t, err)
+	return filepath.Join(dir, "test-id.source")
+}
+
+/*
+ * Serves the content with Range support, dropping the connection halfway through the first response
+ */
+func interruptedSource(t *testing.T, content []byte, etag string, requests *[]*http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		w.Header().Set("ETag", etag)
+		if len(*requests) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			assert.Nil(t, err)
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestHttpSourceFetcher_Fetch(t *testing.T) {
+	content := []byte(strings.Repeat("test-source", 1000))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	path := testSourceFile(t)
+	req := &FileConversionRequest{SourceUrl: server.URL, SourceEncoding: enums.MP3, DestEncoding: enums.WAV}
+	source, err := fetcher.Fetch(context.Background(), req, path)
+	assert.Nil(t, err)
+	digest := sha256.Sum256(content)
+	assert.Equal(t, &FetchedSource{Path: path, Size: int64(len(content)), Digest: digest[:]}, source)
+	fetched, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, content, fetched)
+	req.SourceUrl = server.URL + "/missing"
+	_, err = fetcher.Fetch(context.Background(), req, path)
+	assert.Equal(t, http.StatusNotFound, err.(errFetchStatus).code)
+}
+
+func TestHttpSourceFetcher_ResumesInterruptedDownload(t *testing.T) {
+	content := []byte(strings.Repeat("test-source", 1000))
+	var requests []*http.Request
+	server := interruptedSource(t, content, `"test-etag"`, &requests)
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	path := testSourceFile(t)
+	source, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: server.URL}, path)
+	assert.Nil(t, err)
+	digest := sha256.Sum256(content)
+	assert.Equal(t, digest[:], source.Digest, "should hash the bytes of both responses")
+	fetched, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, content, fetched)
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "bytes="+strconv.Itoa(len(content)/2)+"-", requests[1].Header.Get("Range"))
+	assert.Equal(t, `"test-etag"`, requests[1].Header.Get("If-Range"))
+}
+
+func TestHttpSourceFetcher_RetryHook(t *testing.T) {
+	content := []byte(strings.Repeat("test-source", 1000))
+	var requests []*http.Request
+	server := interruptedSource(t, content, `"test-etag"`, &requests)
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	retries := 0
+	ctx := withFetchRetryHook(context.Background(), func() error {
+		retries++
+		return nil
+	})
+	_, err := fetcher.Fetch(ctx, &FileConversionRequest{SourceUrl: server.URL}, testSourceFile(t))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, retries, "should report each retry")
+	requests = nil
+	ctx = withFetchRetryHook(context.Background(), func() error {
+		return errLeaseLost
+	})
+	_, err = fetcher.Fetch(ctx, &FileConversionRequest{SourceUrl: server.URL}, testSourceFile(t))
+	assert.Equal(t, errLeaseLost, err, "should abandon the download when the retry cannot be recorded")
+	assert.Len(t, requests, 1)
+}
+
+func TestHttpSourceFetcher_PermanentErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	_, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: server.URL}, testSourceFile(t))
+	assert.True(t, errors.Is(err, errTooManyRedirects))
+	assert.False(t, isTransientFetchError(err), "should not retry a source that redirects too many times")
+	assert.Equal(t, maxRedirects, requests, "should not fetch again after the redirects run out")
+	_, err = fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: "http://[::1"}, testSourceFile(t))
+	assert.NotNil(t, err)
+	assert.False(t, isTransientFetchError(err), "should not retry a source URL that cannot be parsed")
+}
+
+func TestHttpSourceFetcher_RestartsWithoutValidator(t *testing.T) {
+	content := []byte(strings.Repeat("test-source", 1000))
+	var requests []*http.Request
+	server := interruptedSource(t, content, `W/"weak-etag"`, &requests)
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	path := testSourceFile(t)
+	source, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: server.URL}, path)
+	assert.Nil(t, err)
+	digest := sha256.Sum256(content)
+	assert.Equal(t, digest[:], source.Digest)
+	assert.Equal(t, int64(len(content)), source.Size, "should not keep the bytes of the first response")
+	assert.Empty(t, requests[1].Header.Get("Range"), "weak ETags cannot be used to resume")
+}
+
+func TestHttpSourceFetcher_SizeLimit(t *testing.T) {
+	source := strings.Repeat("a", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Flushing before writing the body leaves the response without a Content-Length
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(source))
+	}))
+	defer server.Close()
+	path := testSourceFile(t)
+	req := &FileConversionRequest{SourceEncoding: enums.MP3, DestEncoding: enums.WAV, Tenant: "test-tenant"}
+	for _, urlPath := range []string{"/sized", "/chunked"} {
+		t.Run(urlPath, func(t *testing.T) {
+			req.SourceUrl = server.URL + urlPath
+			fetcher := newHttpSourceFetcher(tenantInputLimits{global: InputLimits{MaxBytes: 99}}, nil,
+				testFetchRetry)
+			_, err := fetcher.Fetch(context.Background(), req, path)
+			assert.Equal(t, errSourceTooLarge{99}, err)
+			fetcher = newHttpSourceFetcher(tenantInputLimits{
+				global: InputLimits{MaxBytes: 99},
+				tenants: map[string]InputLimits{"test-tenant": {MaxBytes: 100}},
+			}, nil, testFetchRetry)
+			fetched, err := fetcher.Fetch(context.Background(), req, path)
+			assert.Nil(t, err, "sources within the tenant's limit should be fetched")
+			assert.Equal(t, int64(100), fetched.Size)
+		})
+	}
+}
+
+func TestHttpSourceFetcher_SourcePolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+			return
+		}
+		w.Write([]byte("test-source"))
+	}))
+	defer server.Close()
+	path := testSourceFile(t)
+	req := &FileConversionRequest{SourceUrl: server.URL, SourceEncoding: enums.MP3, DestEncoding: enums.WAV}
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, &SourcePolicy{}, testFetchRetry)
+	_, err := fetcher.Fetch(context.Background(), req, path)
+	assert.NotNil(t, err, "should not connect to a private address")
+	assert.False(t, isTransientFetchError(err), "should not retry a source that is not allowed")
+	fetcher = newHttpSourceFetcher(tenantInputLimits{}, &SourcePolicy{AllowPrivateAddresses: true},
+		testFetchRetry)
+	_, err = fetcher.Fetch(context.Background(), req, path)
+	assert.Nil(t, err)
+	req.SourceUrl = server.URL + "/redirect"
+	_, err = fetcher.Fetch(context.Background(), req, path)
+	assert.NotNil(t, err, "should not follow redirects to schemes that are not allowed")
+}
+
+func TestHttpSourceFetcher_SourceHeaders(t *testing.T) {
+	var redirected http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = r.Header
+		w.Write([]byte("test-source"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" || r.Header.Get("X-Api-Key") != "test-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/same-host":
+			http.Redirect(w, r, "/source", http.StatusFound)
+		case "/other-host":
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		default:
+			w.Write([]byte("test-source"))
+		}
+	}))
+	defer server.Close()
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	path := testSourceFile(t)
+	req := &FileConversionRequest{
+		SourceUrl: server.URL,
+		SourceHeaders: SourceHeaders{"Authorization": "Bearer test-token", "X-Api-Key": "test-key"},
+	}
+	_, err := fetcher.Fetch(context.Background(), req, path)
+	assert.Nil(t, err, "should send the source headers")
+	req.SourceUrl = server.URL + "/same-host"
+	_, err = fetcher.Fetch(context.Background(), req, path)
+	assert.Nil(t, err, "should send the source headers on redirects to the same host")
+	req.SourceUrl = server.URL + "/other-host"
+	_, err = fetcher.Fetch(context.Background(), req, path)
+	assert.Nil(t, err)
+	assert.NotNil(t, redirected, "should have followed the redirect")
+	assert.Empty(t, redirected.Get("Authorization"), "should not send credentials to another host")
+	assert.Empty(t, redirected.Get("X-Api-Key"), "should not send credentials to another host")
+}
+
+func TestStripSourceHeaders(t *testing.T) {
+	headers := SourceHeaders{"Authorization": "Bearer test-token"}
+	ctx := context.WithValue(context.Background(), sourceHeadersKey{}, headers)
+	source, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/source", nil)
+	for redirect, kept := range map[string]bool{
+		"https://example.com/moved": true,
+		"http://example.com/moved": false,
+		"https://other.example.com/moved": false,
+	} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, redirect, nil)
+		headers.apply(req.Header)
+		stripSourceHeaders(req, []*http.Request{source})
+		assert.Equal(t, kept, req.Header.Get("Authorization") != "", "unexpected headers on redirect to %s", redirect)
+	}
+}
+
+func TestHttpSourceFetcher_Deadline(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		select {
+		case <- release:
+		case <- r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	fetcher := newHttpSourceFetcher(tenantInputLimits{}, nil, testFetchRetry)
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := fetcher.Fetch(ctx, &FileConversionRequest{SourceUrl: server.URL}, testSourceFile(t))
+	assert.Equal(t, context.DeadlineExceeded, err, "should stop at the deadline instead of retrying")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
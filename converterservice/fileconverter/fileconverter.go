@@ -2,35 +2,86 @@
 package fileconverter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"sync"
+	"time"
 )
 
 
 
 type Converter interface {
 	ConvertFile(request *FileConversionRequest)
+	// Kills running conversions, leaving their jobs for recovery instead of failing them
+	Stop()
+	// Abandons the job, which another worker has taken over, without writing its result
+	Cancel(id string)
 }
 
 type ConverterImplementation struct {
 	Db                db.FileConverterRepository
 	ExecutableFactory ExecutableFactory
 	S3service         FileUploader
+	// Downloads sources before they are converted
+	SourceFetcher     SourceFetcher
+	// The longest a conversion may run before it is killed, or zero for no limit
+	JobTimeout        time.Duration
+	Retry             RetryPolicy
+	// How often progress is persisted while a conversion runs
+	ProgressInterval  time.Duration
+	// Notifies callback URLs of finished jobs, or nil to send no webhooks
+	Webhooks          WebhookDispatcher
+	// Publishes each status transition, or nil to publish nothing
+	Events            events.EventPublisher
+	// Reads the duration of sources before they are converted
+	SourceProber      SourceProber
+	// The largest and longest source a job may convert
+	InputLimits       InputLimits
+	// Limits that replace InputLimits for the tenants they are keyed by
+	TenantInputLimits map[string]InputLimits
+	// Which source URLs may be fetched, or nil to fetch any
+	SourcePolicy      *SourcePolicy
+	// Recorded on the jobs this converter starts, so that only their owner recovers them
+	Owner             string
 }
 
 type FileConverter struct {
 	s3Service         FileUploader
 	db                db.FileConverterRepository
 	executableFactory ExecutableFactory
+	sourceFetcher     SourceFetcher
+	sourceProber      SourceProber
+	inputLimits       tenantInputLimits
+	sourcePolicy      *SourcePolicy
+	owner             string
+	jobTimeout        time.Duration
+	retryPolicy       RetryPolicy
+	progressInterval  time.Duration
+	webhooks          WebhookDispatcher
+	events            events.EventPublisher
+	lock              sync.Mutex
+	// Closed when the converter is stopped
+	stopping          chan struct{}
+	stopOnce          sync.Once
+	// The conversions in progress, by job id
+	running           map[string]Executable
+	// Cancels the context of each job in progress, by job id
+	cancels           map[string]context.CancelFunc
 }
 
 type ConversionAttributes struct {
-	Request *FileConversionRequest
-	TmpFile string
+	Request    *FileConversionRequest
+	// Where the source has been fetched to
+	SourceFile string
+	TmpFile    string
 }
 
 // An init function for the file converter
@@ -40,10 +91,208 @@ func New(config *ConverterImplementation) *FileConverter {
 	if factory == nil {
 		factory = newDefaultExecutableFactory()
 	}
-	return &FileConverter{
+	inputLimits := tenantInputLimits{global: config.InputLimits, tenants: config.TenantInputLimits}
+	retryPolicy := config.Retry
+	if retryPolicy.MaxAttempts < 1 {
+		retryPolicy.MaxAttempts = 1
+	}
+	fetcher := config.SourceFetcher
+	if fetcher == nil {
+		fetcher = newSourceFetcher(config, inputLimits, retryPolicy)
+	}
+	prober := config.SourceProber
+	if prober == nil {
+		prober = newSourceProber()
+	}
+	progressInterval := config.ProgressInterval
+	if progressInterval <= 0 {
+		progressInterval = defaultProgressInterval
+	}
+	converter := &FileConverter{
 		s3Service: s3Service,
 		db: config.Db,
 		executableFactory: factory,
+		sourceFetcher: fetcher,
+		sourceProber: prober,
+		inputLimits: inputLimits,
+		sourcePolicy: config.SourcePolicy,
+		owner: config.Owner,
+		jobTimeout: config.JobTimeout,
+		retryPolicy: retryPolicy,
+		progressInterval: progressInterval,
+		webhooks: config.Webhooks,
+		events: config.Events,
+		stopping: make(chan struct{}),
+		running: map[string]Executable{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	if config.Db != nil {
+		go converter.evictExpiredResults(cacheEvictionInterval)
+	}
+	return converter
+}
+
+/*
+ * Returns the default fetcher, which reads s3:// sources with the uploader's S3 client
+ * and other sources over HTTP
+ */
+func newSourceFetcher(config *ConverterImplementation, limits tenantInputLimits, retry RetryPolicy) SourceFetcher {
+	fetcher := &schemeSourceFetcher{
+		http: newHttpSourceFetcher(limits, config.SourcePolicy, retry),
+	}
+	if provider, ok := config.S3service.(s3ClientProvider); ok {
+		fetcher.s3 = newS3SourceFetcher(provider.s3Client(), limits, retry)
+	}
+	return fetcher
+}
+
+/*
+ * Kills the conversions in progress and cancels the jobs' contexts, which abandons downloads and backoffs.
+ * Jobs that fail because they were stopped are not marked FAILED, and no further jobs are started
+ */
+func (f *FileConverter) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stopping)
+	})
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, cancel := range f.cancels {
+		cancel()
+	}
+	for id, cmd := range f.running {
+		log.Printf("stopping conversion of %s", id)
+		if err := cmd.Kill(); err != nil {
+			log.Printf("failed to kill %s, encountered %v", cmd.String(), err)
+		}
+	}
+}
+
+func (f *FileConverter) stopped() bool {
+	select {
+	case <- f.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Tracks the conversion so that it can be killed by Stop. Returns false if the converter is already stopped
+ */
+func (f *FileConverter) track(id string, cmd Executable) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped() {
+		return false
+	}
+	f.running[id] = cmd
+	return true
+}
+
+func (f *FileConverter) untrack(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.running, id)
+}
+
+/*
+ * Returns the time limit for the request, which is the shorter of the requested and service limits.
+ * Zero means there is no limit
+ */
+func (f *FileConverter) timeoutFor(req *FileConversionRequest) time.Duration {
+	timeout := f.jobTimeout
+	if req.Timeout > 0 && (timeout == 0 || req.Timeout < timeout) {
+		timeout = req.Timeout
+	}
+	return timeout
+}
+
+/*
+ * Returns the context a job runs in, whose deadline covers fetching, converting and retrying the job.
+ * The context is cancelled if the job is cancelled, which kills its conversion
+ */
+func (f *FileConverter) jobContext(req *FileConversionRequest) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout := f.timeoutFor(req); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	f.lock.Lock()
+	f.cancels[req.Id] = cancel
+	f.lock.Unlock()
+	return ctx, func() {
+		f.lock.Lock()
+		delete(f.cancels, req.Id)
+		f.lock.Unlock()
+		cancel()
+	}
+}
+
+/*
+ * Cancels the job's context, which kills its conversion and abandons its remaining steps. Its result
+ * is not written, since the job's row is guarded by the owner that now holds it
+ */
+func (f *FileConverter) Cancel(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if cancel, ok := f.cancels[id]; ok {
+		log.Printf("cancelling %s", id)
+		cancel()
+	}
+}
+
+/*
+ * Waits for the command to finish, killing it if it is still running once the context is done
+ */
+func waitWithContext(ctx context.Context, cmd Executable) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if err := cmd.Kill(); err != nil {
+			log.Printf("failed to kill %s, encountered %v", cmd.String(), err)
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Returned when a job is stopped for exceeding its time limit
+type errConversionTimeout struct {
+	timeout time.Duration
+}
+
+func (e errConversionTimeout) Error() string {
+	return fmt.Sprintf("conversion timed out after %v", e.timeout)
+}
+
+/*
+ * Returns the failure for a job whose deadline passed, or nil if it has not
+ */
+func (f *FileConverter) timedOut(ctx context.Context, req *FileConversionRequest) *jobFailure {
+	if ctx.Err() != context.DeadlineExceeded {
+		return nil
+	}
+	return permanentFailure(enums.TIMEOUT, errConversionTimeout{f.timeoutFor(req)}.Error())
+}
+
+/*
+ * Removes the temp file left by a failed conversion, if one was created
+ */
+func removeTempFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove temp file %s, encountered %v", path, err)
 	}
 }
 
@@ -51,9 +300,9 @@ func New(config *ConverterImplementation) *FileConverter {
  * Creates the file path for the temp file created during the conversion process.
  * Includes file extension when includeExtension is set to true
  */
-func newTempFilePath(id string, destEncoding string, includeExtension bool) string {
+func newTempFilePath(id string, extension string, includeExtension bool) string {
 	if includeExtension {
-		return fmt.Sprintf("/tmp/%s.%s", id, strings.ToLower(destEncoding))
+		return fmt.Sprintf("/tmp/%s.%s", id, extension)
 	}
 	return fmt.Sprintf("/tmp/%s", id)
 }
@@ -61,55 +310,338 @@ func newTempFilePath(id string, destEncoding string, includeExtension bool) stri
 
 
 /*
- * Downloads a file at the Request source URL and streams it to ffmpeg for conversion
- * to the requested name
+ * Downloads a file at the Request source URL and has ffmpeg convert the downloaded copy
+ * to the requested name. Steps that fail transiently are retried according to the retry policy,
+ * resuming from the step that failed
  */
 func (f *FileConverter) ConvertFile(req *FileConversionRequest) {
 	id := req.Id
-	if _, err := f.db.StartConversion(id); err != nil {
+	if f.stopped() {
+		log.Printf("converter is stopped, leaving %s queued", id)
+		return
+	}
+	if started, err := f.db.StartConversion(id, f.owner); err != nil {
 		log.Printf("failure updating job status, encounterd %v", err)
 		return
+	} else if !started {
+		log.Printf("%s is no longer queued or held by this converter, leaving it", id)
+		return
+	}
+	events.Publish(f.events, id, enums.QUEUED, enums.CONVERTING)
+	ctx, cancel := f.jobContext(req)
+	defer cancel()
+	if failure := f.checkSource(req); failure != nil {
+		f.fail(id, failure)
+		return
 	}
 	job := &ConversionAttributes{
 		Request: req,
+		SourceFile: newTempFilePath(id, sourceFileSuffix, true),
 	}
-	cmd := f.executableFactory.Build(job)
-	cmd.SetStderr(os.Stderr)
-	if err := cmd.Start(); err != nil {
-		log.Printf("failed to start conversion due to: %v", err)
-		if _, err := f.db.FailConversion(id); err != nil {
-			log.Printf("Failed to update job status, encountered %v", err)
+	defer func() {
+		removeTempFile(job.SourceFile)
+		removeTempFile(job.TmpFile)
+	}()
+	source, failure := f.fetch(ctx, job)
+	if failure != nil && f.stopped() {
+		log.Printf("fetch of %s was stopped, leaving it for recovery", id)
+		return
+	}
+	if failure != nil {
+		f.fail(id, failure)
+		return
+	}
+	if failure := f.checkDuration(job); failure != nil {
+		f.fail(id, failure)
+		return
+	}
+	hash := ContentAddress(source.Digest, req)
+	if f.completeFromCache(req, hash) {
+		return
+	}
+	var (
+		converted bool
+		uploaded  bool
+		url       string
+	)
+	failure = f.withRetries(ctx, req, func() *jobFailure {
+		if !converted {
+			if failure := f.convert(ctx, job); failure != nil {
+				return failure
+			}
+			converted = true
+		}
+		// A stopped job may already have been requeued, so it must not write its result
+		if f.stopped() {
+			return errStopped
+		}
+		if !uploaded {
+			if failure := f.upload(job); failure != nil {
+				return failure
+			}
+			uploaded = true
 		}
+		if f.stopped() {
+			return errStopped
+		}
+		var failure *jobFailure
+		url, failure = f.presign(req.Tenant, id)
+		return failure
+	})
+	if failure != nil && f.stopped() {
+		log.Printf("conversion of %s was stopped, leaving it for recovery", id)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
-		log.Printf("conversion failed, ecnountered %v", err)
-		if _, err := f.db.FailConversion(id); err != nil {
-			log.Printf("Failed to update job Status, encountered %v", err)
+	if failure != nil {
+		f.fail(id, failure)
+		return
+	}
+	if f.stopped() {
+		log.Printf("%s was stopped before it completed, leaving it for recovery", id)
+		return
+	}
+	if completed, err := f.db.CompleteConversion(id, f.owner, url); err != nil {
+		log.Printf("failed to update DB for Id %s, encountered %v", id, err)
+		return
+	} else if !completed {
+		log.Printf("%s is no longer held by this converter, leaving its result unwritten", id)
+		return
+	}
+	log.Printf("%s successfully converted", id)
+	events.Publish(f.events, id, enums.CONVERTING, enums.COMPLETED, url)
+	f.notify(id)
+	f.cacheResult(hash, id)
+}
+
+/*
+ * Marks the job FAILED and notifies subscribers of the failure
+ */
+func (f *FileConverter) fail(id string, failure *jobFailure) {
+	log.Printf("conversion of %s failed, encountered %v", id, failure)
+	if failed, err := f.db.FailConversion(id, f.owner, failure.code, failure.message); err != nil {
+		log.Printf("Failed to update job Status, encountered %v", err)
+		return
+	} else if !failed {
+		log.Printf("%s is no longer held by this converter, leaving its failure unwritten", id)
+		return
+	}
+	events.Publish(f.events, id, enums.CONVERTING, enums.FAILED)
+	f.notify(id)
+}
+
+/*
+ * Checks the source against the policy again before it is fetched, since the host may resolve
+ * differently than it did when the job was created, or the policy may have changed since
+ */
+func (f *FileConverter) checkSource(req *FileConversionRequest) *jobFailure {
+	err := f.sourcePolicy.Check(req.SourceUrl)
+	if _, ok := err.(errSourceNotAllowed); ok {
+		return permanentFailure(enums.INVALID_REQUEST, err.Error())
+	}
+	if err != nil {
+		return permanentFailure(enums.DOWNLOAD_FAILED, err.Error())
+	}
+	return nil
+}
+
+/*
+ * Downloads the job's source, which the fetcher retries itself so that it can resume the download.
+ * Each retry is recorded on the job, and the download is abandoned if another worker takes the job over
+ */
+func (f *FileConverter) fetch(ctx context.Context, job *ConversionAttributes) (*FetchedSource, *jobFailure) {
+	id, attempts := job.Request.Id, 1
+	ctx = withFetchRetryHook(ctx, func() error {
+		attempts++
+		if failure := f.recordAttempt(id, attempts); failure != nil {
+			return failure
 		}
+		return nil
+	})
+	source, err := f.sourceFetcher.Fetch(ctx, job.Request, job.SourceFile)
+	var tooLarge errSourceTooLarge
+	var notAllowed errSourceNotAllowed
+	switch {
+	case err == nil:
+		return source, nil
+	case errors.Is(err, errLeaseLost):
+		return nil, errLeaseLost
+	case f.timedOut(ctx, job.Request) != nil:
+		return nil, f.timedOut(ctx, job.Request)
+	case errors.As(err, &tooLarge):
+		return nil, permanentFailure(enums.SOURCE_TOO_LARGE, tooLarge.Error())
+	case errors.As(err, &notAllowed):
+		return nil, permanentFailure(enums.INVALID_REQUEST, notAllowed.Error())
+	default:
+		return nil, permanentFailure(enums.DOWNLOAD_FAILED, "failed to download source: %v", err)
+	}
+}
+
+/*
+ * Fails sources that are longer than the tenant's duration limit. While a limit is set, sources whose duration
+ * cannot be probed are also failed, since they could be of any length
+ */
+func (f *FileConverter) checkDuration(job *ConversionAttributes) *jobFailure {
+	req := job.Request
+	limit := f.inputLimits.forTenant(req.Tenant).MaxDuration
+	if limit <= 0 {
+		return nil
+	}
+	duration, err := f.sourceProber.Duration(req, job.SourceFile)
+	if err != nil {
+		log.Printf("failed to probe the duration of %s, encountered %v", req.Id, err)
+		return permanentFailure(enums.INVALID_REQUEST,
+			"could not read the duration of the source to check it against the limit of %v", limit)
+	}
+	if duration > limit {
+		return permanentFailure(enums.SOURCE_TOO_LONG, "source is %v long, longer than the limit of %v", duration, limit)
+	}
+	return nil
+}
+
+/*
+ * Sends the webhook for a job that has reached a terminal state
+ */
+func (f *FileConverter) notify(id string) {
+	if f.webhooks == nil {
 		return
 	}
-	file, err := os.Open(job.TmpFile)
+	job, err := f.db.GetConversion(id)
 	if err != nil {
-		log.Fatalf("error preserving tmp file %v", err)
+		log.Printf("failed to get %s for its webhook, encountered %v", id, err)
+		return
 	}
-	if err := f.s3Service.Upload(id, req.DestEncoding.Name(), file); err != nil {
-		log.Printf("failed to upload converted audio to S3, ecnountered %v", err)
+	f.webhooks.Dispatch(job)
+}
+
+/*
+ * Runs ffmpeg for the job, tracking its progress and classifying the failure from its stderr
+ * when it does not succeed
+ */
+func (f *FileConverter) convert(ctx context.Context, job *ConversionAttributes) *jobFailure {
+	cmd := f.executableFactory.Build(job)
+	stderr := newStderrTail(stderrTailSize)
+	progress := newProgressTracker(job.Request.Id, f.db, f.progressInterval)
+	progress.start()
+	defer progress.stop()
+	cmd.SetStdout(progress.progressWriter())
+	cmd.SetStderr(io.MultiWriter(os.Stderr, stderr, progress.probeWriter()))
+	if err := cmd.Start(); err != nil {
+		return permanentFailure(enums.INTERNAL, "failed to start conversion: %v", err)
 	}
-	if err := os.Remove(job.TmpFile); err != nil {
-		panic(err)
+	if !f.track(job.Request.Id, cmd) {
+		if err := cmd.Kill(); err != nil {
+			log.Printf("failed to kill %s, encountered %v", cmd.String(), err)
+		}
+	}
+	defer f.untrack(job.Request.Id)
+	if err := waitWithContext(ctx, cmd); err != nil {
+		removeTempFile(job.TmpFile)
+		if failure := f.timedOut(ctx, job.Request); failure != nil {
+			return failure
+		}
+		return classifyConversionFailure(err, stderr.String())
 	}
-	url, err := f.s3Service.SignedUrl(id)
+	return nil
+}
+
+/*
+ * Uploads the converted audio. Failures are transient unless the bucket rejected the upload outright
+ */
+func (f *FileConverter) upload(job *ConversionAttributes) *jobFailure {
+	file, err := os.Open(job.TmpFile)
 	if err != nil {
-		log.Printf("Failed to generate presigned URL for Id %s", id)
-		if _, err := f.db.FailConversion(id); err != nil {
-			log.Printf("failed to update job Status, encountered %v", err)
+		return permanentFailure(enums.INTERNAL, "converted audio is missing: %v", err)
+	}
+	defer file.Close()
+	if err := f.s3Service.Upload(job.Request.Tenant, job.Request.Id, job.Request.DestEncoding, file); err != nil {
+		if isPermanentUploadError(err) {
+			return permanentFailure(enums.UPLOAD_FAILED, "failed to upload converted audio: %v", err)
 		}
-		return
+		return transientFailure(enums.UPLOAD_FAILED, "failed to upload converted audio: %v", err)
+	}
+	return nil
+}
+
+/*
+ * Presigns a URL to the uploaded audio. Signing happens locally, so failures are permanent
+ */
+func (f *FileConverter) presign(tenant string, id string) (string, *jobFailure) {
+	url, err := f.s3Service.SignedUrl(tenant, id)
+	if err != nil {
+		return "", permanentFailure(enums.PRESIGN_FAILED, "failed to generate presigned URL: %v", err)
+	}
+	return url, nil
+}
+
+/*
+ * Completes the job with a copy of a previously converted object with the same content address. The cached
+ * object may be deleted by the lifecycle rule long before a new presigned URL expires, so the job gets its own
+ * copy that persists as long as the URL. Content addresses include the tenant, so the object is always one
+ * the job's tenant owns. Returns true when the job was completed from the cache
+ */
+func (f *FileConverter) completeFromCache(req *FileConversionRequest, hash string) bool {
+	id := req.Id
+	cached, err := f.db.GetCachedResult(hash)
+	if err != nil {
+		log.Printf("failed to look up cached result for %s, encountered %v", id, err)
+		return false
+	}
+	if cached == nil {
+		return false
 	}
-	if _, err := f.db.CompleteConversion(id, url); err != nil {
+	if err := f.s3Service.Copy(req.Tenant, cached.ObjectKey, id); err != nil {
+		log.Printf("failed to copy cached object %s, encountered %v", cached.ObjectKey, err)
+		return false
+	}
+	url, err := f.s3Service.SignedUrl(req.Tenant, id)
+	if err != nil {
+		log.Printf("failed to presign cached object %s, encountered %v", cached.ObjectKey, err)
+		return false
+	}
+	if f.stopped() {
+		log.Printf("%s was stopped before it completed, leaving it for recovery", id)
+		return true
+	}
+	if completed, err := f.db.CompleteConversion(id, f.owner, url); err != nil {
 		log.Printf("failed to update DB for Id %s, encountered %v", id, err)
+	} else if !completed {
+		log.Printf("%s is no longer held by this converter, leaving its result unwritten", id)
 	} else {
-		log.Printf("%s successfully converted", id)
+		log.Printf("%s completed from cached object %s", id, cached.ObjectKey)
+		events.Publish(f.events, id, enums.CONVERTING, enums.COMPLETED, url)
+		f.notify(id)
+		f.cacheResult(hash, id)
+	}
+	return true
+}
+
+/*
+ * Indexes the uploaded object under its content address for as long as the object persists
+ */
+func (f *FileConverter) cacheResult(hash string, objectKey string) {
+	if _, err := f.db.CacheResult(hash, objectKey, time.Now().Add(objectExpiry)); err != nil {
+		log.Printf("failed to cache result for %s, encountered %v", objectKey, err)
+	}
+}
+
+/*
+ * Evicts the cache entries whose objects have expired, and the idempotency keys that have expired,
+ * once every interval until the converter is stopped
+ */
+func (f *FileConverter) evictExpiredResults(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- ticker.C:
+			if _, err := f.db.EvictExpiredResults(); err != nil {
+				log.Printf("failed to evict expired cache entries, encountered %v", err)
+			}
+			if _, err := f.db.EvictExpiredIdempotencyKeys(); err != nil {
+				log.Printf("failed to evict expired idempotency keys, encountered %v", err)
+			}
+		case <- f.stopping:
+			return
+		}
 	}
 }
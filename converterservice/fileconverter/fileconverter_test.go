@@ -2,13 +2,17 @@
 package fileconverter_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	encodings "github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/mocks"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -24,6 +28,7 @@ func defaultTestingConfiguration() *fileconverter.ConverterImplementation {
 	return &fileconverter.ConverterImplementation{
 		Db: mocks.NewMockFileConverterRepo(),
 		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
 	}
 }
 
@@ -54,10 +59,11 @@ func TestConvertFile_Success(t *testing.T) {
 	config := &fileconverter.ConverterImplementation{
 		Db: repo,
 		ExecutableFactory: executableFactory,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
 		S3service: s3Service,
 	}
 	fileConverter := fileconverter.New(config)
-	success, err := config.Db.NewRequest(req.Id)
+	success, err := config.Db.NewRequest(req.Id, req.Record())
 	assert.True(t, success, "new request should have been successful")
 	assert.Nil(t, err, "should not have errored adding to the repo")
 	fileConverter.ConvertFile(req)
@@ -88,11 +94,12 @@ func TestConvertFile_FailedCmd(t *testing.T) {
 	config := &fileconverter.ConverterImplementation{
 		Db: repo,
 		ExecutableFactory: executableFactory,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
 		S3service: s3Service,
 	}
 	fileConverter := fileconverter.New(config)
 	executableFactory.Success = false
-	success, err := repo.NewRequest(req.Id)
+	success, err := repo.NewRequest(req.Id, req.Record())
 	assert.True(t, success, "should be able to create new request")
 	assert.Nil(t, err, "should not have errored")
 	fileConverter.ConvertFile(req)
@@ -102,12 +109,53 @@ func TestConvertFile_FailedCmd(t *testing.T) {
 	assert.Equal(t, req.Id, convertedJob.Id, "Id should be the same")
 	assert.Equal(t, pb.ConvertFileQueryResponse_FAILED.String(), convertedJob.Status, "should have a failed status")
 	assert.Equal(t, "NONE", convertedJob.CurrUrl, "should have no presigned URL")
+	assert.Equal(t, encodings.INTERNAL.Name(), convertedJob.ErrorCode, "should have a failure code")
+	assert.NotEmpty(t, convertedJob.ErrorMessage, "should have a failure reason")
 	assert.GreaterOrEqual(t, time.Now().Unix(), convertedJob.LastUpdated.Unix(), "should have been updated previously")
 	file, err := os.Open(executableFactory.Data[req.Id].Job.TmpFile)
 	assert.Nil(t, file, "there should be no file in tmp after error")
 	assert.NotNil(t, err, "there should have been an error opening the file")
 }
 
+func TestConvertFile_PublishesEvents(t *testing.T) {
+	for _, succeed := range []bool{true, false} {
+		req := &fileconverter.FileConversionRequest{
+			Id: uuid.New().String(),
+			SourceUrl: "some-source-url",
+			SourceEncoding: encodings.FLAC,
+			DestEncoding: encodings.MP3,
+		}
+		repo := mocks.NewMockFileConverterRepo()
+		executableFactory := mocks.NewMockExecutableFactory()
+		executableFactory.Success = succeed
+		publisher := events.NewMemoryEventPublisher()
+		fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+			Db: repo,
+			ExecutableFactory: executableFactory,
+			SourceFetcher: mocks.NewMockSourceFetcher(),
+			S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+			Events: publisher,
+		})
+		repo.NewRequest(req.Id, req.Record())
+		fileConverter.ConvertFile(req)
+		convertedJob, _ := repo.GetConversion(req.Id)
+		published := publisher.Events()
+		if !assert.Len(t, published, 2) {
+			continue
+		}
+		assert.Equal(t, req.Id, published[0].JobId)
+		assert.Equal(t, encodings.QUEUED.Name(), published[0].OldStatus)
+		assert.Equal(t, encodings.CONVERTING.Name(), published[0].NewStatus)
+		assert.Equal(t, encodings.CONVERTING.Name(), published[1].OldStatus)
+		assert.Equal(t, convertedJob.Status, published[1].NewStatus)
+		if succeed {
+			assert.Equal(t, []string{convertedJob.CurrUrl}, published[1].Urls)
+		} else {
+			assert.Empty(t, published[1].Urls)
+		}
+	}
+}
+
 func TestConvertFile_FailedRepo(t *testing.T) {
 	req := &fileconverter.FileConversionRequest{
 		Id: uuid.New().String(),
@@ -121,6 +169,7 @@ func TestConvertFile_FailedRepo(t *testing.T) {
 	config := &fileconverter.ConverterImplementation{
 		Db: repo,
 		ExecutableFactory: executableFactory,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
 		S3service: s3Service,
 	}
 	fileConverter := fileconverter.New(config)
@@ -148,11 +197,12 @@ func TestConvertFile_FailedS3(t *testing.T) {
 	config := &fileconverter.ConverterImplementation{
 		Db: repo,
 		ExecutableFactory: executableFactory,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
 		S3service: s3Service,
 	}
 	fileConverter := fileconverter.New(config)
 	s3Service.Success = false
-	success, err := repo.NewRequest(req.Id)
+	success, err := repo.NewRequest(req.Id, req.Record())
 	assert.True(t, success, "should be able to create new request")
 	assert.Nil(t, err, "should not have errored")
 	fileConverter.ConvertFile(req)
@@ -161,7 +211,729 @@ func TestConvertFile_FailedS3(t *testing.T) {
 	assert.Nil(t, err, "should not have errored")
 	assert.Equal(t, req.Id, convertedJob.Id, "should have the same ID")
 	assert.Equal(t, pb.ConvertFileQueryResponse_FAILED.String(), convertedJob.Status, "should have a failed status")
+	assert.Equal(t, encodings.UPLOAD_FAILED.Name(), convertedJob.ErrorCode, "should have a failure code")
 	assert.Equal(t, "NONE", convertedJob.CurrUrl, "should have no presigned URL")
 	assert.GreaterOrEqual(t, time.Now().Unix(), convertedJob.LastUpdated.Unix(), "should have recent timestamp")
 }
 
+func TestConvertFile_CacheHit(t *testing.T) {
+	first := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	second := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: first.SourceUrl,
+		SourceEncoding: first.SourceEncoding,
+		DestEncoding: first.DestEncoding,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	s3Service := mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName)
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: s3Service,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	for _, req := range []*fileconverter.FileConversionRequest{first, second} {
+		_, err := repo.NewRequest(req.Id, req.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		fileConverter.ConvertFile(req)
+	}
+	assert.Len(t, repo.Cache, 1, "should have cached the first conversion")
+	assert.NotNil(t, executableFactory.Data[first.Id], "first request should have been converted")
+	assert.Nil(t, executableFactory.Data[second.Id], "second request should not have been converted")
+	convertedJob, err := repo.GetConversion(second.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, pb.ConvertFileQueryResponse_COMPLETED.String(), convertedJob.Status, "status should be complete")
+	assert.Equal(t, 1, s3Service.Copies, "should copy the first request's object")
+	assert.Equal(t,
+		fmt.Sprintf("http://%s.%s/%s/%s", testRegion, testS3Endpoint, testBucketName, second.Id),
+		convertedJob.CurrUrl, "should point at a copy that persists as long as its URL")
+	for _, cached := range repo.Cache {
+		assert.Equal(t, second.Id, cached.ObjectKey, "the cache should point at the newest copy")
+	}
+}
+
+func TestConvertFile_CacheHitCopyFails(t *testing.T) {
+	first := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	second := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: first.SourceUrl,
+		SourceEncoding: first.SourceEncoding,
+		DestEncoding: first.DestEncoding,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	s3Service := mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName)
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: s3Service,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	_, err := repo.NewRequest(first.Id, first.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(first)
+	// The cached object has been deleted, so the cache hit must fall back to converting
+	for _, cached := range repo.Cache {
+		cached.ObjectKey = "deleted"
+	}
+	s3Service.CopyFailures = 1
+	_, err = repo.NewRequest(second.Id, second.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(second)
+	assert.NotNil(t, executableFactory.Data[second.Id], "second request should have been converted")
+	convertedJob, err := repo.GetConversion(second.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, pb.ConvertFileQueryResponse_COMPLETED.String(), convertedJob.Status, "status should be complete")
+	assert.Equal(t,
+		fmt.Sprintf("http://%s.%s/%s/%s", testRegion, testS3Endpoint, testBucketName, second.Id),
+		convertedJob.CurrUrl, "should point at the converted object")
+}
+
+// A repo that fails to mark jobs COMPLETED
+type incompleteRepo struct {
+	*mocks.MockFileConverterRepo
+}
+
+func (r incompleteRepo) CompleteConversion(id string, owner string, url string) (bool, error) {
+	return false, errors.New("failed to complete " + id)
+}
+
+func TestConvertFile_NoCacheWhenNotCompleted(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: incompleteRepo{repo},
+		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	assert.Empty(t, repo.Cache, "should not cache a job that was not completed")
+}
+
+func TestConvertFile_CacheMissOnDifferentParameters(t *testing.T) {
+	first := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	second := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: first.SourceUrl,
+		SourceEncoding: first.SourceEncoding,
+		DestEncoding: encodings.WAV,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	for _, req := range []*fileconverter.FileConversionRequest{first, second} {
+		_, err := repo.NewRequest(req.Id, req.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		fileConverter.ConvertFile(req)
+	}
+	assert.Len(t, repo.Cache, 2, "should have cached both conversions")
+	assert.NotNil(t, executableFactory.Data[second.Id], "second request should have been converted")
+}
+
+func TestConvertFile_TenantsDoNotShareCache(t *testing.T) {
+	first := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+		Tenant: "tenant-a",
+	}
+	second := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: first.SourceUrl,
+		SourceEncoding: first.SourceEncoding,
+		DestEncoding: first.DestEncoding,
+		Tenant: "tenant-b",
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	for _, req := range []*fileconverter.FileConversionRequest{first, second} {
+		_, err := repo.NewRequest(req.Id, req.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		fileConverter.ConvertFile(req)
+	}
+	assert.Len(t, repo.Cache, 2, "should have cached each tenant's conversion")
+	assert.NotNil(t, executableFactory.Data[second.Id], "second tenant's request should have been converted")
+	convertedJob, err := repo.GetConversion(second.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t,
+		fmt.Sprintf("http://%s.%s/%s/tenants/%s/%s", testRegion, testS3Endpoint, testBucketName, second.Tenant, second.Id),
+		convertedJob.CurrUrl, "should point at an object under the tenant's prefix")
+}
+
+func TestConvertFile_DurationLimit(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	prober := mocks.NewMockSourceProber(12 * time.Hour)
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceProber: prober,
+		InputLimits: fileconverter.InputLimits{MaxDuration: time.Hour},
+		TenantInputLimits: map[string]fileconverter.InputLimits{"long-tenant": {MaxDuration: 24 * time.Hour}},
+	})
+	for tenant, expected := range map[string]string{"": "FAILED", "long-tenant": "COMPLETED"} {
+		req := &fileconverter.FileConversionRequest{
+			Id: uuid.New().String(),
+			SourceUrl: "some-source-url",
+			SourceEncoding: encodings.FLAC,
+			DestEncoding: encodings.MP3,
+			Tenant: tenant,
+		}
+		_, err := repo.NewRequest(req.Id, req.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		fileConverter.ConvertFile(req)
+		convertedJob, err := repo.GetConversion(req.Id)
+		assert.Nil(t, err, "err should be nil")
+		assert.Equal(t, expected, convertedJob.Status)
+		if expected == "FAILED" {
+			assert.Equal(t, encodings.SOURCE_TOO_LONG.Name(), convertedJob.ErrorCode)
+			assert.Nil(t, executableFactory.Data[req.Id], "should not have started converting")
+		}
+	}
+	assert.Equal(t, 2, prober.Probes)
+}
+
+func TestConvertFile_DurationUnknown(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	prober := mocks.NewMockSourceProber(time.Minute)
+	prober.Success = false
+	newConverter := func(limits fileconverter.InputLimits) *fileconverter.FileConverter {
+		return fileconverter.New(&fileconverter.ConverterImplementation{
+			Db: repo,
+			ExecutableFactory: executableFactory,
+			SourceFetcher: mocks.NewMockSourceFetcher(),
+			S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+			SourceProber: prober,
+			InputLimits: limits,
+		})
+	}
+	limited, unlimited := newConverter(fileconverter.InputLimits{MaxDuration: time.Hour}), newConverter(fileconverter.InputLimits{})
+	for converter, expected := range map[*fileconverter.FileConverter]string{limited: "FAILED", unlimited: "COMPLETED"} {
+		req := &fileconverter.FileConversionRequest{
+			Id: uuid.New().String(),
+			SourceUrl: "some-source-url",
+			SourceEncoding: encodings.FLAC,
+			DestEncoding: encodings.MP3,
+		}
+		_, err := repo.NewRequest(req.Id, req.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		converter.ConvertFile(req)
+		convertedJob, err := repo.GetConversion(req.Id)
+		assert.Nil(t, err, "err should be nil")
+		assert.Equal(t, expected, convertedJob.Status)
+		if expected == "FAILED" {
+			assert.Equal(t, encodings.INVALID_REQUEST.Name(), convertedJob.ErrorCode,
+				"a source of unknown length should not get past the limit")
+			assert.Nil(t, executableFactory.Data[req.Id], "should not have started converting")
+		}
+	}
+	assert.Equal(t, 1, prober.Probes, "sources should only be probed when a limit applies")
+}
+
+func TestConvertFile_FetchTimeout(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+		Timeout: 50 * time.Millisecond,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	fetcher := mocks.NewMockSourceFetcher()
+	fetcher.Hang = true
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: fetcher,
+		JobTimeout: time.Hour,
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.TIMEOUT.Name(), convertedJob.ErrorCode, "the request timeout should cover the fetch")
+	assert.Nil(t, executableFactory.Data[req.Id], "should not have started converting")
+}
+
+func TestConvertFile_Timeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		jobTimeout time.Duration
+		reqTimeout time.Duration
+	}{
+		{"global timeout", 50 * time.Millisecond, 0},
+		{"request timeout", 0, 50 * time.Millisecond},
+		{"request timeout capped by global", 50 * time.Millisecond, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &fileconverter.FileConversionRequest{
+				Id: uuid.New().String(),
+				SourceUrl: "some-source-url",
+				SourceEncoding: encodings.FLAC,
+				DestEncoding: encodings.MP3,
+				Timeout: test.reqTimeout,
+			}
+			repo := mocks.NewMockFileConverterRepo()
+			executableFactory := mocks.NewMockExecutableFactory()
+			executableFactory.Hang = true
+			fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+				Db: repo,
+				ExecutableFactory: executableFactory,
+				S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+				SourceFetcher: mocks.NewMockSourceFetcher(),
+				JobTimeout: test.jobTimeout,
+			})
+			_, err := repo.NewRequest(req.Id, req.Record())
+			assert.Nil(t, err, "should not have errored adding to the repo")
+			done := make(chan bool)
+			go func() {
+				fileConverter.ConvertFile(req)
+				done <- true
+			}()
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout waiting for the conversion to be killed")
+			}
+			executable := executableFactory.Data[req.Id]
+			assert.True(t, executable.Killed, "executable should have been killed")
+			convertedJob, err := repo.GetConversion(req.Id)
+			assert.Nil(t, err, "err should be nil")
+			assert.Equal(t, pb.ConvertFileQueryResponse_FAILED.String(), convertedJob.Status, "should have a failed status")
+			assert.Equal(t, encodings.TIMEOUT.Name(), convertedJob.ErrorCode, "should have a timeout code")
+			assert.Contains(t, convertedJob.ErrorMessage, "timed out", "should have a timeout reason")
+			file, err := os.Open(executable.Job.TmpFile)
+			assert.Nil(t, file, "there should be no file in tmp after a timeout")
+			assert.NotNil(t, err, "there should have been an error opening the file")
+		})
+	}
+}
+
+func TestConvertFile_Retries(t *testing.T) {
+	tests := []struct {
+		name            string
+		failures        int
+		uploadFailures  int
+		stderr          string
+		status          string
+		attempts        int
+		builds          int
+	}{
+		{"conversion failure", 2, 0, "/tmp/test: I/O error", pb.ConvertFileQueryResponse_FAILED.String(), 1, 1},
+		{"unsupported input", 2, 0, "Invalid data found when processing input", pb.ConvertFileQueryResponse_FAILED.String(), 1, 1},
+		{"transient upload failure", 0, 2, "", pb.ConvertFileQueryResponse_COMPLETED.String(), 3, 1},
+		{"attempts exhausted", 0, 5, "", pb.ConvertFileQueryResponse_FAILED.String(), 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &fileconverter.FileConversionRequest{
+				Id: uuid.New().String(),
+				SourceUrl: "some-source-url",
+				SourceEncoding: encodings.FLAC,
+				DestEncoding: encodings.MP3,
+			}
+			repo := mocks.NewMockFileConverterRepo()
+			executableFactory := mocks.NewMockExecutableFactory()
+			executableFactory.Failures = test.failures
+			executableFactory.StderrOutput = test.stderr
+			s3Service := mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName)
+			s3Service.UploadFailures = test.uploadFailures
+			fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+				Db: repo,
+				ExecutableFactory: executableFactory,
+				S3service: s3Service,
+				SourceFetcher: mocks.NewMockSourceFetcher(),
+				Retry: fileconverter.RetryPolicy{
+					MaxAttempts: 3,
+					InitialBackoff: time.Millisecond,
+				},
+			})
+			_, err := repo.NewRequest(req.Id, req.Record())
+			assert.Nil(t, err, "should not have errored adding to the repo")
+			fileConverter.ConvertFile(req)
+			convertedJob, err := repo.GetConversion(req.Id)
+			assert.Nil(t, err, "err should be nil")
+			assert.Equal(t, test.status, convertedJob.Status, "should have the expected status")
+			assert.Equal(t, test.attempts, convertedJob.Attempts, "should have recorded each attempt")
+			assert.Equal(t, test.builds, executableFactory.Builds[req.Id], "should only convert until successful")
+			file, err := os.Open(executableFactory.Data[req.Id].Job.TmpFile)
+			assert.Nil(t, file, "there should be no file in tmp once finished")
+			assert.NotNil(t, err, "there should have been an error opening the file")
+		})
+	}
+}
+
+func TestConvertFile_Progress(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	executableFactory.StderrOutput = "Input #0, flac, from 'some-source-url':\n  Duration: 00:02:00.00, bitrate: 800 kb/s\n"
+	executableFactory.StdoutOutput = "out_time_us=60000000\nspeed=4x\nprogress=continue\n" +
+		"out_time_us=120000000\nspeed=8x\nprogress=end\n"
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		ProgressInterval: time.Hour,
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, float64(100), convertedJob.Progress.Percent, "should have the final progress")
+	assert.Equal(t, 2 * time.Minute, convertedJob.Progress.Processed, "should have the processed time")
+	assert.Equal(t, float64(8), convertedJob.Progress.Speed, "should have the final speed")
+}
+
+func TestConvertFile_Stop(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	executableFactory.Hang = true
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	done := make(chan bool)
+	go func() {
+		fileConverter.ConvertFile(req)
+		done <- true
+	}()
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if job, _ := repo.GetConversion(req.Id); job != nil && job.Status == encodings.CONVERTING.Name() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the conversion to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fileConverter.Stop()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the conversion to be stopped")
+	}
+	assert.True(t, executableFactory.Data[req.Id].Killed, "executable should have been killed")
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.CONVERTING.Name(), convertedJob.Status, "stopped job should be left for recovery")
+	assert.Empty(t, convertedJob.ErrorCode, "stopped job should not have failed")
+	t.Run("after stop", func(t *testing.T) {
+		next := &fileconverter.FileConversionRequest{
+			Id: uuid.New().String(),
+			SourceUrl: "some-source-url",
+			SourceEncoding: encodings.FLAC,
+			DestEncoding: encodings.MP3,
+		}
+		_, err := repo.NewRequest(next.Id, next.Record())
+		assert.Nil(t, err, "should not have errored adding to the repo")
+		fileConverter.ConvertFile(next)
+		job, err := repo.GetConversion(next.Id)
+		assert.Nil(t, err, "err should be nil")
+		assert.Equal(t, encodings.QUEUED.Name(), job.Status, "no jobs should start once stopped")
+		assert.Nil(t, executableFactory.Data[next.Id], "no executable should have been built")
+	})
+}
+
+func TestConvertFile_StopDuringFetch(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	fetcher := mocks.NewMockSourceFetcher()
+	fetcher.Hang = true
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: fetcher,
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	done := make(chan bool)
+	go func() {
+		fileConverter.ConvertFile(req)
+		done <- true
+	}()
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if job, _ := repo.GetConversion(req.Id); job != nil && job.Status == encodings.CONVERTING.Name() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the conversion to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fileConverter.Stop()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the download to be stopped")
+	}
+	assert.Nil(t, executableFactory.Data[req.Id], "should not have started converting")
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.CONVERTING.Name(), convertedJob.Status, "stopped job should be left for recovery")
+	assert.Empty(t, convertedJob.ErrorCode, "stopped job should not have failed")
+}
+
+func TestConvertFile_Cancel(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	executableFactory.Hang = true
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		Owner: "stale-owner",
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	done := make(chan bool)
+	go func() {
+		fileConverter.ConvertFile(req)
+		done <- true
+	}()
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if job, _ := repo.GetConversion(req.Id); job != nil && job.Status == encodings.CONVERTING.Name() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the conversion to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	repo.SetLeaseOwner(req.Id, "new-owner")
+	fileConverter.Cancel(req.Id)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the conversion to be cancelled")
+	}
+	assert.True(t, executableFactory.Data[req.Id].Killed, "executable should have been killed")
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.CONVERTING.Name(), convertedJob.Status, "the new owner's job should be left alone")
+	assert.Empty(t, convertedJob.ErrorCode, "a stale owner should not fail the job")
+}
+
+// An uploader that stops the converter while the upload is in flight
+type stoppingUploader struct {
+	*mocks.S3FileUploaderMock
+	stop func()
+}
+
+func (u *stoppingUploader) Upload(tenant string, id string, encoding encodings.Encoding, file *os.File) error {
+	u.stop()
+	return u.S3FileUploaderMock.Upload(tenant, id, encoding, file)
+}
+
+func TestConvertFile_StopDuringUpload(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	uploader := &stoppingUploader{S3FileUploaderMock: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName)}
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		S3service: uploader,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+	})
+	uploader.stop = fileConverter.Stop
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	job, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.CONVERTING.Name(), job.Status, "a job stopped during upload may have been requeued, so it should not complete")
+	assert.Equal(t, "NONE", job.CurrUrl)
+}
+
+// An uploader that fails once, after which another worker takes over the job
+type takeoverUploader struct {
+	*mocks.S3FileUploaderMock
+	takeover func()
+}
+
+func (u *takeoverUploader) Upload(tenant string, id string, encoding encodings.Encoding, file *os.File) error {
+	u.takeover()
+	return u.S3FileUploaderMock.Upload(tenant, id, encoding, file)
+}
+
+func TestConvertFile_LeaseLostBeforeRetry(t *testing.T) {
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	repo := mocks.NewMockFileConverterRepo()
+	uploader := &takeoverUploader{
+		S3FileUploaderMock: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		takeover: func() { repo.SetLeaseOwner(req.Id, "new-owner") },
+	}
+	uploader.UploadFailures = 1
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		Owner: "stale-owner",
+		S3service: uploader,
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		Retry: fileconverter.RetryPolicy{
+			MaxAttempts: 3,
+			InitialBackoff: time.Millisecond,
+		},
+	})
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	assert.Equal(t, 1, uploader.Uploads, "should not retry a job another worker took over")
+	job, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.CONVERTING.Name(), job.Status, "the new owner's job should be left alone")
+	assert.Equal(t, 1, job.Attempts, "a stale owner should not record attempts")
+}
+
+func TestConvertFile_FetchRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// Drops the connection before the source is received
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("test"))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("test-source"))
+	}))
+	defer server.Close()
+	repo := mocks.NewMockFileConverterRepo()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourcePolicy: &fileconverter.SourcePolicy{AllowPrivateAddresses: true},
+		Retry: fileconverter.RetryPolicy{
+			MaxAttempts: 3,
+			InitialBackoff: time.Millisecond,
+		},
+	})
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: server.URL,
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	job, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, encodings.COMPLETED.Name(), job.Status)
+	assert.Equal(t, 2, job.Attempts, "should record the retried download")
+}
+
+func TestConvertFile_SourcePolicy(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	executableFactory := mocks.NewMockExecutableFactory()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: executableFactory,
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		SourceProber: mocks.NewMockSourceProber(time.Minute),
+		SourcePolicy: &fileconverter.SourcePolicy{},
+	})
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "http://169.254.169.254/latest/meta-data",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+	}
+	_, err := repo.NewRequest(req.Id, req.Record())
+	assert.Nil(t, err, "should not have errored adding to the repo")
+	fileConverter.ConvertFile(req)
+	convertedJob, err := repo.GetConversion(req.Id)
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, "FAILED", convertedJob.Status)
+	assert.Equal(t, encodings.INVALID_REQUEST.Name(), convertedJob.ErrorCode)
+	assert.Nil(t, executableFactory.Data[req.Id], "should not have fetched the source")
+}
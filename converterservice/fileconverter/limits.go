@@ -0,0 +1,120 @@
+package fileconverter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ffprobe = "ffprobe"
+
+// The longest ffprobe may take to read the header of a source
+const probeTimeout = time.Minute
+
+// Limits on the sources a job may convert. A zero field places no limit
+type InputLimits struct {
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+// The service's input limits, and the limits of tenants that override them
+type tenantInputLimits struct {
+	global  InputLimits
+	tenants map[string]InputLimits
+}
+
+/*
+ * Returns the limits for the tenant. Each limit the tenant sets replaces the service's,
+ * so a tenant may be given a higher or lower limit but never an unlimited one
+ */
+func (l tenantInputLimits) forTenant(tenant string) InputLimits {
+	limits := l.global
+	override := l.tenants[tenant]
+	if override.MaxBytes > 0 {
+		limits.MaxBytes = override.MaxBytes
+	}
+	if override.MaxDuration > 0 {
+		limits.MaxDuration = override.MaxDuration
+	}
+	return limits
+}
+
+// Returned when a source is larger than the size limit
+type errSourceTooLarge struct {
+	limit int64
+}
+
+func (e errSourceTooLarge) Error() string {
+	return fmt.Sprintf("source is larger than the limit of %d bytes", e.limit)
+}
+
+// Reads the duration of a source without converting it
+type SourceProber interface {
+	// Returns the duration of the request's source, which has been fetched to the file at path
+	Duration(req *FileConversionRequest, path string) (time.Duration, error)
+}
+
+// The default source prober, which runs ffprobe on the fetched source
+type ffprobeSourceProber struct {}
+
+func newSourceProber() SourceProber {
+	return &ffprobeSourceProber{}
+}
+
+/*
+ * Returns the arguments to ffprobe that print the duration of the source in seconds,
+ * reading the fetched source with the same demuxer and layout as the conversion
+ */
+func probeArgs(req *FileConversionRequest, path string) []string {
+	src := req.SourceEncoding.Format()
+	args := []string{"-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1",
+		formatFlag, src.Demuxer}
+	if src.Headerless {
+		args = append(args, probeLayoutArgs(src.SampleRate, src.Channels)...)
+	}
+	return append(args, protocolWhitelistFlag, fileProtocol, inputFlag, path)
+}
+
+/*
+ * Returns the raw PCM demuxer's sample rate and channel options, omitting those that are zero.
+ * Unlike ffmpeg, ffprobe does not pass -ar and -ac to the demuxer, so headerless sources would otherwise
+ * be probed as 44.1 kHz mono and their duration misread. The ffmpeg 4.1 image has no -ch_layout option
+ */
+func probeLayoutArgs(sampleRate int, channels int) []string {
+	var args []string
+	if sampleRate > 0 {
+		args = append(args, "-sample_rate", strconv.Itoa(sampleRate))
+	}
+	if channels > 0 {
+		args = append(args, "-channels", strconv.Itoa(channels))
+	}
+	return args
+}
+
+/*
+ * Runs ffprobe on the source, which reads its header rather than decoding it
+ */
+func (p *ffprobeSourceProber) Duration(req *FileConversionRequest, path string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffprobe, probeArgs(req, path)...).Output()
+	if err != nil {
+		return 0, err
+	}
+	return parseProbedDuration(string(out))
+}
+
+/*
+ * Parses the duration printed by ffprobe, which is N/A when it cannot be determined
+ */
+func parseProbedDuration(out string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(out), 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("the duration of the source is unknown")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,44 @@
+package fileconverter
+
+import (
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTenantInputLimits_ForTenant(t *testing.T) {
+	limits := tenantInputLimits{
+		global: InputLimits{MaxBytes: 100, MaxDuration: time.Hour},
+		tenants: map[string]InputLimits{"test-tenant": {MaxDuration: 2 * time.Hour}},
+	}
+	assert.Equal(t, InputLimits{MaxBytes: 100, MaxDuration: time.Hour}, limits.forTenant("other-tenant"))
+	assert.Equal(t, InputLimits{MaxBytes: 100, MaxDuration: 2 * time.Hour}, limits.forTenant("test-tenant"),
+		"limits the tenant does not set should be the service's")
+}
+
+func TestProbeArgs(t *testing.T) {
+	req := &FileConversionRequest{SourceUrl: "test-url", SourceEncoding: enums.MP3}
+	assert.Equal(t, []string{"-v", "error", "-show_entries", "format=duration", "-of",
+		"default=noprint_wrappers=1:nokey=1", "-f", "mp3", "-protocol_whitelist", "file", "-i", "/tmp/test-id.source"},
+	probeArgs(req, "/tmp/test-id.source"))
+}
+
+func TestProbeArgs_Headerless(t *testing.T) {
+	req := &FileConversionRequest{SourceUrl: "test-url", SourceEncoding: enums.PCM}
+	assert.Equal(t, []string{"-v", "error", "-show_entries", "format=duration", "-of",
+		"default=noprint_wrappers=1:nokey=1", "-f", "s16le", "-sample_rate", "44100", "-channels", "2",
+		"-protocol_whitelist", "file", "-i", "/tmp/test-id.source"},
+	probeArgs(req, "/tmp/test-id.source"))
+	assert.Equal(t, []string{"-sample_rate", "8000", "-channels", "2"}, probeLayoutArgs(8000, 2),
+		"should use the demuxer's options rather than -ar and -ac")
+	assert.Empty(t, probeLayoutArgs(0, 0))
+}
+
+func TestParseProbedDuration(t *testing.T) {
+	duration, err := parseProbedDuration("43200.500000\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 12*time.Hour+500*time.Millisecond, duration)
+	_, err = parseProbedDuration("N/A\n")
+	assert.NotNil(t, err)
+}
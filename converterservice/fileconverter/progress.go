@@ -0,0 +1,190 @@
+package fileconverter
+
+import (
+	"bytes"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often progress is persisted while a conversion runs, unless configured otherwise
+const defaultProgressInterval = 2 * time.Second
+
+// Matches the input duration that ffmpeg reports on stderr once it has probed the source
+var durationPattern = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// Splits the bytes written to it into lines, calling onLine for each complete line
+type lineWriter struct {
+	partial []byte
+	onLine  func(line string)
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		end := bytes.IndexByte(l.partial, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		l.onLine(strings.TrimSpace(string(l.partial[:end])))
+		l.partial = l.partial[end+1:]
+	}
+}
+
+/*
+ * Tracks the progress ffmpeg reports on stdout against the input duration it reports on stderr,
+ * persisting updates no more often than the interval. Updates are persisted off the writers, so that
+ * a slow database never stalls ffmpeg's output
+ */
+type progressTracker struct {
+	id        string
+	repo      db.FileConverterRepository
+	interval  time.Duration
+	lock      sync.Mutex
+	duration  time.Duration
+	processed time.Duration
+	speed     float64
+	lastSaved time.Time
+	// Holds the latest update that has not been persisted yet
+	updates   chan *db.Progress
+	persisted chan struct{}
+}
+
+func newProgressTracker(id string, repo db.FileConverterRepository, interval time.Duration) *progressTracker {
+	return &progressTracker{
+		id: id,
+		repo: repo,
+		interval: interval,
+		updates: make(chan *db.Progress, 1),
+		persisted: make(chan struct{}),
+	}
+}
+
+/*
+ * Clears the progress of any earlier attempt, then persists updates until stopped
+ */
+func (p *progressTracker) start() {
+	p.update(&db.Progress{})
+	go p.persist()
+}
+
+/*
+ * Waits for the last update to be persisted. No updates may be saved once stopped
+ */
+func (p *progressTracker) stop() {
+	close(p.updates)
+	<-p.persisted
+}
+
+func (p *progressTracker) persist() {
+	defer close(p.persisted)
+	for progress := range p.updates {
+		p.update(progress)
+	}
+}
+
+func (p *progressTracker) update(progress *db.Progress) {
+	if _, err := p.repo.UpdateProgress(p.id, progress); err != nil {
+		log.Printf("failed to update progress for %s, encountered %v", p.id, err)
+	}
+}
+
+// Returns a writer for ffmpeg's stdout, where it writes progress when run with -progress pipe:1
+func (p *progressTracker) progressWriter() io.Writer {
+	return &lineWriter{onLine: p.onProgressLine}
+}
+
+// Returns a writer for ffmpeg's stderr, where it reports the duration of the input
+func (p *progressTracker) probeWriter() io.Writer {
+	return &lineWriter{onLine: p.onProbeLine}
+}
+
+/*
+ * Parses the input duration from a line of ffmpeg's stderr
+ */
+func parseDuration(line string) (time.Duration, bool) {
+	match := durationPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), true
+}
+
+func (p *progressTracker) onProbeLine(line string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.duration > 0 {
+		return
+	}
+	if duration, ok := parseDuration(line); ok {
+		p.duration = duration
+	}
+}
+
+/*
+ * Handles a key=value line of ffmpeg's progress output. Each block of progress ends with a progress key
+ */
+func (p *progressTracker) onProgressLine(line string) {
+	pair := strings.SplitN(line, "=", 2)
+	if len(pair) != 2 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch key, value := pair[0], pair[1]; key {
+	// out_time_ms is also in microseconds, and is all that older ffmpeg builds report
+	case "out_time_us", "out_time_ms":
+		if micros, err := strconv.ParseInt(value, 10, 64); err == nil && micros >= 0 {
+			p.processed = time.Duration(micros) * time.Microsecond
+		}
+	case "speed":
+		if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+			p.speed = speed
+		}
+	case "progress":
+		p.save(value == "end")
+	}
+}
+
+/*
+ * Queues the progress to be persisted if the interval has passed since the last update, or if it is the
+ * final update
+ */
+func (p *progressTracker) save(final bool) {
+	now := time.Now()
+	if !final && now.Sub(p.lastSaved) < p.interval {
+		return
+	}
+	p.lastSaved = now
+	progress := &db.Progress{
+		Percent: p.percent(),
+		Processed: p.processed,
+		Speed: p.speed,
+	}
+	// Replaces an update that has not been persisted yet, since only the latest matters
+	select {
+	case <-p.updates:
+	default:
+	}
+	p.updates <- progress
+}
+
+/*
+ * Returns the percent of the input that has been converted, or zero if the duration is unknown
+ */
+func (p *progressTracker) percent() float64 {
+	if p.duration <= 0 {
+		return 0
+	}
+	return math.Min(float64(p.processed)/float64(p.duration)*100, 100)
+}
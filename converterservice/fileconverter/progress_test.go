@@ -0,0 +1,78 @@
+package fileconverter
+
+import (
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Records the progress persisted for a job, blocking each update until it is released
+type slowProgressRepo struct {
+	db.FileConverterRepository
+	release chan struct{}
+	saved   []db.Progress
+}
+
+func (r *slowProgressRepo) UpdateProgress(id string, progress *db.Progress) (bool, error) {
+	<-r.release
+	r.saved = append(r.saved, *progress)
+	return true, nil
+}
+
+func TestParseDuration(t *testing.T) {
+	duration, ok := parseDuration("  Duration: 01:02:03.50, start: 0.000000, bitrate: 1411 kb/s")
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour + 2 * time.Minute + 3500 * time.Millisecond, duration)
+	_, ok = parseDuration("  Duration: N/A, start: 0.000000, bitrate: N/A")
+	assert.False(t, ok)
+}
+
+func TestLineWriter(t *testing.T) {
+	lines := make([]string, 0)
+	writer := &lineWriter{onLine: func(line string) {
+		lines = append(lines, line)
+	}}
+	_, _ = writer.Write([]byte("speed=1."))
+	_, _ = writer.Write([]byte("5x\nprogress=cont"))
+	assert.Equal(t, []string{"speed=1.5x"}, lines)
+	_, _ = writer.Write([]byte("inue\n"))
+	assert.Equal(t, []string{"speed=1.5x", "progress=continue"}, lines)
+}
+
+func TestProgressTracker_Percent(t *testing.T) {
+	tracker := newProgressTracker("test-id", nil, time.Second)
+	tracker.onProgressLine("out_time_us=30000000")
+	assert.Zero(t, tracker.percent(), "percent should be zero until the duration is known")
+	tracker.onProbeLine("  Duration: 00:01:00.00, start: 0.000000, bitrate: 1411 kb/s")
+	assert.Equal(t, float64(50), tracker.percent())
+	tracker.onProgressLine("out_time_us=90000000")
+	assert.Equal(t, float64(100), tracker.percent(), "percent should not exceed 100")
+	tracker.onProgressLine("speed=N/A")
+	assert.Zero(t, tracker.speed)
+	tracker.onProgressLine("speed=2.5x")
+	assert.Equal(t, 2.5, tracker.speed)
+}
+
+func TestProgressTracker_Persist(t *testing.T) {
+	repo := &slowProgressRepo{release: make(chan struct{}, 1)}
+	tracker := newProgressTracker("test-id", repo, 0)
+	repo.release <- struct{}{}
+	tracker.start()
+	written := make(chan struct{})
+	go func() {
+		writer := tracker.progressWriter()
+		_, _ = writer.Write([]byte("out_time_us=30000000\nprogress=continue\n"))
+		_, _ = writer.Write([]byte("out_time_us=60000000\nprogress=end\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writing progress should not wait for it to be persisted")
+	}
+	close(repo.release)
+	tracker.stop()
+	assert.Equal(t, db.Progress{}, repo.saved[0], "should clear the progress of earlier attempts first")
+	assert.Equal(t, time.Minute, repo.saved[len(repo.saved)-1].Processed, "should persist the final progress")
+}
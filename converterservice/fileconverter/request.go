@@ -2,8 +2,12 @@ package fileconverter
 
 import (
 	"errors"
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
 	encodings "github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
+	"net/url"
+	"time"
 )
 
 type FileConversionRequest struct {
@@ -12,6 +16,18 @@ type FileConversionRequest struct {
 	DestEncoding     encodings.Encoding
 	Id               string
 	IncludeExtension bool
+	Priority         encodings.Priority
+	// The requested limit on conversion time, or zero to use the service limit
+	Timeout          time.Duration
+	// The requested output sample rate and channel count, or zero to keep the source's
+	SampleRate       int
+	Channels         int
+	// Where webhook events for the job are sent, or empty for none
+	CallbackUrl      string
+	// The tenant that owns the job, or empty when it was created without an API key
+	Tenant           string
+	// Sent only when fetching the source. Sealed with a HeaderCipher rather than recorded, see Record
+	SourceHeaders    SourceHeaders
 }
 
 func NewFileConversionRequest(req *pb.ConvertFileRequest, id string) (*FileConversionRequest, error) {
@@ -29,12 +45,145 @@ func NewFileConversionRequest(req *pb.ConvertFileRequest, id string) (*FileConve
 	if err != nil {
 		return nil, err
 	}
-	return &FileConversionRequest{
+	priority, err := encodings.PriorityFromEnumValue(int(req.Priority))
+	if err != nil {
+		return nil, err
+	}
+	sourceHeaders, err := newSourceHeaders(req.SourceHeaders, req.SourceUrl)
+	if err != nil {
+		return nil, err
+	}
+	request := &FileConversionRequest{
 		SourceUrl: req.SourceUrl,
 		SourceEncoding: sourceEncoding,
 		DestEncoding: destEncoding,
 		Id: id,
 		// TODO: Add this as a param to the protobuf
 		IncludeExtension: false,
-	}, nil
-}
\ No newline at end of file
+		Priority: priority,
+		Timeout: time.Duration(req.TimeoutSeconds) * time.Second,
+		SampleRate: int(req.SampleRate),
+		Channels: int(req.Channels),
+		CallbackUrl: req.CallbackUrl,
+		SourceHeaders: sourceHeaders,
+	}
+	if err := request.validateLayout(); err != nil {
+		return nil, err
+	}
+	if err := request.validateCallbackUrl(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+/**
+ * Rebuilds a request persisted by Record, so that an unfinished job can be recovered.
+ * Its source headers are opened separately, since they are sealed in the record
+ */
+func FileConversionRequestFromRecord(id string, record *db.ConversionRequest) (*FileConversionRequest, error) {
+	if record.SourceUrl == "" {
+		return nil, errors.New("request missing required parameter SourceUrl")
+	}
+	sourceEncoding, err := encodings.EncodingFromName(record.SourceEncoding)
+	if err != nil {
+		return nil, err
+	}
+	destEncoding, err := encodings.EncodingFromName(record.DestEncoding)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := encodings.PriorityFromName(record.Priority)
+	if err != nil {
+		return nil, err
+	}
+	request := &FileConversionRequest{
+		SourceUrl: record.SourceUrl,
+		SourceEncoding: sourceEncoding,
+		DestEncoding: destEncoding,
+		Id: id,
+		IncludeExtension: false,
+		Priority: priority,
+		Timeout: record.Timeout,
+		SampleRate: record.SampleRate,
+		Channels: record.Channels,
+		CallbackUrl: record.CallbackUrl,
+		Tenant: record.Tenant,
+	}
+	if err := request.validateLayout(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+/*
+ * Returns the parameters of the request to persist with its job. A missing priority is recorded as NORMAL.
+ * Source headers are left out, and should be sealed into the record with a HeaderCipher
+ */
+func (r *FileConversionRequest) Record() *db.ConversionRequest {
+	priority := encodings.Priority(encodings.NORMAL)
+	if r.Priority != nil {
+		priority = r.Priority
+	}
+	return &db.ConversionRequest{
+		SourceUrl: r.SourceUrl,
+		SourceEncoding: r.SourceEncoding.Name(),
+		DestEncoding: r.DestEncoding.Name(),
+		Priority: priority.Name(),
+		Timeout: r.Timeout,
+		SampleRate: r.SampleRate,
+		Channels: r.Channels,
+		CallbackUrl: r.CallbackUrl,
+		Tenant: r.Tenant,
+	}
+}
+
+/*
+ * Returns the sample rate and channel count for the output, preferring the layout the destination
+ * format requires over the requested one. Zero keeps the source's
+ */
+func (r *FileConversionRequest) outputLayout() (int, int) {
+	format := r.DestEncoding.Format()
+	sampleRate, channels := r.SampleRate, r.Channels
+	if format.SampleRate > 0 {
+		sampleRate = format.SampleRate
+	}
+	if format.Channels > 0 {
+		channels = format.Channels
+	}
+	return sampleRate, channels
+}
+
+/*
+ * Rejects requested options the destination format does not support, unless they match
+ * the layout the format requires, and sample rates or channel counts its encoder cannot produce
+ */
+func (r *FileConversionRequest) validateLayout() error {
+	format := r.DestEncoding.Format()
+	if r.SampleRate > 0 && !format.Supports(encodings.SampleRateOption) && r.SampleRate != format.SampleRate {
+		return fmt.Errorf("%s requires a sample rate of %d Hz", format.Name, format.SampleRate)
+	}
+	if r.Channels > 0 && !format.Supports(encodings.ChannelsOption) && r.Channels != format.Channels {
+		return fmt.Errorf("%s requires %d channel(s)", format.Name, format.Channels)
+	}
+	if r.SampleRate > 0 && !format.SupportsSampleRate(r.SampleRate) {
+		return fmt.Errorf("%s does not support a sample rate of %d Hz", format.Name, r.SampleRate)
+	}
+	if format.MaxChannels > 0 && r.Channels > format.MaxChannels {
+		return fmt.Errorf("%s supports at most %d channel(s)", format.Name, format.MaxChannels)
+	}
+	return nil
+}
+
+/*
+ * Checks that the callback URL, if one was given, is an absolute HTTP or HTTPS URL
+ */
+func (r *FileConversionRequest) validateCallbackUrl() error {
+	if r.CallbackUrl == "" {
+		return nil
+	}
+	callback, err := url.Parse(r.CallbackUrl)
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+		return errors.New("callbackUrl must be an absolute http or https URL")
+	}
+	return nil
+}
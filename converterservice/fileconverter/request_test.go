@@ -1,10 +1,12 @@
 package fileconverter
 
 import (
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNewFileConversionRequest(t *testing.T) {
@@ -22,6 +24,140 @@ func TestNewFileConversionRequest(t *testing.T) {
 	assert.Equal(t, sourceUrl, internalRequest.SourceUrl)
 	assert.Equal(t, enums.WAV, internalRequest.SourceEncoding)
 	assert.Equal(t, enums.MP3, internalRequest.DestEncoding)
+	assert.Equal(t, enums.NORMAL, internalRequest.Priority)
+	assert.Zero(t, internalRequest.Timeout)
 	// TODO: Parameterize this
 	assert.False(t, internalRequest.IncludeExtension)
 }
+
+
+func TestNewFileConversionRequest_Priority(t *testing.T) {
+	req := &pb.ConvertFileRequest{
+		SourceUrl: "test-url",
+		SourceEncoding: pb.Encoding_WAV,
+		DestEncoding: pb.Encoding_MP3,
+		Priority: pb.Priority_HIGH,
+	}
+	internalRequest, err := NewFileConversionRequest(req, "test-id")
+	assert.Nil(t, err)
+	assert.Equal(t, enums.HIGH, internalRequest.Priority)
+	req.Priority = pb.Priority(6)
+	internalRequest, err = NewFileConversionRequest(req, "test-id")
+	assert.Nil(t, internalRequest)
+	assert.NotNil(t, err)
+}
+
+func TestNewFileConversionRequest_Timeout(t *testing.T) {
+	req := &pb.ConvertFileRequest{
+		SourceUrl: "test-url",
+		SourceEncoding: pb.Encoding_WAV,
+		DestEncoding: pb.Encoding_MP3,
+		TimeoutSeconds: 90,
+	}
+	internalRequest, err := NewFileConversionRequest(req, "test-id")
+	assert.Nil(t, err)
+	assert.Equal(t, 90 * time.Second, internalRequest.Timeout)
+}
+
+func TestNewFileConversionRequest_Layout(t *testing.T) {
+	tests := []struct {
+		dest       pb.Encoding
+		sampleRate uint32
+		channels   uint32
+		valid      bool
+	}{
+		{pb.Encoding_MP3, 22050, 1, true},
+		{pb.Encoding_ULAW, 0, 0, true},
+		{pb.Encoding_ALAW, 8000, 1, true},
+		{pb.Encoding_GSM, 16000, 0, false},
+		{pb.Encoding_AMR_NB, 8000, 2, false},
+		{pb.Encoding_PCM, 48000, 0, false},
+		{pb.Encoding_MP3, 96000, 0, false},
+		{pb.Encoding_MP3, 0, 6, false},
+		{pb.Encoding_FLAC, 96000, 6, true},
+	}
+	for _, test := range tests {
+		req := &pb.ConvertFileRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: pb.Encoding_WAV,
+			DestEncoding: test.dest,
+			SampleRate: test.sampleRate,
+			Channels: test.channels,
+		}
+		internalRequest, err := NewFileConversionRequest(req, "test-id")
+		if test.valid {
+			assert.Nil(t, err)
+			assert.Equal(t, int(test.sampleRate), internalRequest.SampleRate)
+			assert.Equal(t, int(test.channels), internalRequest.Channels)
+		} else {
+			assert.Nil(t, internalRequest)
+			assert.NotNil(t, err)
+		}
+	}
+}
+
+func TestNewFileConversionRequest_CallbackUrl(t *testing.T) {
+	for callbackUrl, valid := range map[string]bool{
+		"": true,
+		"https://example.com/hook": true,
+		"http://example.com:8080/hook?source=converter": true,
+		"ftp://example.com/hook": false,
+		"/hook": false,
+		"https://": false,
+	} {
+		req := &pb.ConvertFileRequest{
+			SourceUrl: "test-url",
+			SourceEncoding: pb.Encoding_WAV,
+			DestEncoding: pb.Encoding_MP3,
+			CallbackUrl: callbackUrl,
+		}
+		internalRequest, err := NewFileConversionRequest(req, "test-id")
+		if valid {
+			assert.Nil(t, err, callbackUrl)
+			assert.Equal(t, callbackUrl, internalRequest.CallbackUrl)
+		} else {
+			assert.NotNil(t, err, callbackUrl)
+		}
+	}
+}
+
+func TestNewFileConversionRequest_SourceHeaders(t *testing.T) {
+	req := &pb.ConvertFileRequest{
+		SourceUrl: "https://example.com/test.mp3",
+		SourceEncoding: pb.Encoding_WAV,
+		DestEncoding: pb.Encoding_MP3,
+		SourceHeaders: map[string]string{"authorization": "Bearer test-token"},
+	}
+	request, err := NewFileConversionRequest(req, "test-id")
+	assert.Nil(t, err)
+	assert.Equal(t, SourceHeaders{"Authorization": "Bearer test-token"}, request.SourceHeaders)
+	assert.Nil(t, request.Record().SourceHeaders, "should not record the headers in plaintext")
+	req.SourceHeaders = map[string]string{"Range": "bytes=0-"}
+	_, err = NewFileConversionRequest(req, "test-id")
+	assert.NotNil(t, err, "headers set by the fetcher should be rejected")
+}
+
+func TestFileConversionRequestFromRecord(t *testing.T) {
+	req := &pb.ConvertFileRequest{
+		SourceUrl: "test-url",
+		SourceEncoding: pb.Encoding_FLAC,
+		DestEncoding: pb.Encoding_AMR_NB,
+		Priority: pb.Priority_LOW,
+		TimeoutSeconds: 90,
+		Channels: 1,
+		CallbackUrl: "https://example.com/hook",
+	}
+	original, err := NewFileConversionRequest(req, "test-id")
+	assert.Nil(t, err)
+	recovered, err := FileConversionRequestFromRecord("test-id", original.Record())
+	assert.Nil(t, err)
+	assert.Equal(t, original, recovered)
+	record := original.Record()
+	record.DestEncoding = "MIDI"
+	recovered, err = FileConversionRequestFromRecord("test-id", record)
+	assert.Nil(t, recovered)
+	assert.NotNil(t, err)
+	recovered, err = FileConversionRequestFromRecord("test-id", &db.ConversionRequest{})
+	assert.Nil(t, recovered)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,77 @@
+package fileconverter
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// How the steps of a conversion job are retried after a transient failure
+type RetryPolicy struct {
+	// The most times a job is attempted, including the first attempt. Values below one are treated as one
+	MaxAttempts    int
+	// The delay before the first retry, which doubles for each retry after it
+	InitialBackoff time.Duration
+	// The longest delay between attempts, or zero for no limit
+	MaxBackoff     time.Duration
+}
+
+/*
+ * Returns the delay after the given attempt fails
+ */
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return delay
+}
+
+/*
+ * Runs the attempt until it succeeds, fails permanently or runs out of attempts,
+ * backing off exponentially in between. Each retry is recorded on the job.
+ * Stopping the converter, passing the job's deadline or losing the job to another worker
+ * abandons the remaining attempts
+ */
+func (f *FileConverter) withRetries(ctx context.Context, req *FileConversionRequest, attempt func() *jobFailure) *jobFailure {
+	id := req.Id
+	for n := 1; ; n++ {
+		failure := attempt()
+		if failure == nil || !failure.transient || n >= f.retryPolicy.MaxAttempts {
+			return failure
+		}
+		delay := f.retryPolicy.backoff(n)
+		log.Printf("attempt %d for %s failed, retrying in %v: %v", n, id, delay, failure)
+		select {
+		case <- time.After(delay):
+		case <- f.stopping:
+			return failure
+		case <- ctx.Done():
+			if timedOut := f.timedOut(ctx, req); timedOut != nil {
+				return timedOut
+			}
+			return failure
+		}
+		if failure := f.recordAttempt(id, n + 1); failure != nil {
+			return failure
+		}
+	}
+}
+
+/*
+ * Records the attempt on the job, returning errLeaseLost when another worker has taken the job over
+ */
+func (f *FileConverter) recordAttempt(id string, n int) *jobFailure {
+	if started, err := f.db.StartConversion(id, f.owner); err != nil {
+		log.Printf("failed to record attempt %d for %s, encountered %v", n, id, err)
+	} else if !started {
+		return errLeaseLost
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package fileconverter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		InitialBackoff: time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2 * time.Second, policy.backoff(2))
+	assert.Equal(t, 4 * time.Second, policy.backoff(3))
+	assert.Equal(t, 5 * time.Second, policy.backoff(4))
+	assert.Equal(t, 5 * time.Second, policy.backoff(50))
+	policy.MaxBackoff = 0
+	assert.Equal(t, 8 * time.Second, policy.backoff(4))
+}
@@ -0,0 +1,131 @@
+package fileconverter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"net/http"
+	"strings"
+)
+
+// The scheme of sources read directly from a bucket, as s3://bucket/key
+const s3Scheme = "s3"
+
+// Implemented by the uploaders, so that s3:// sources are read with the same session as uploads
+type s3ClientProvider interface {
+	s3Client() s3iface.S3API
+}
+
+func (s *s3FileUploader) s3Client() s3iface.S3API {
+	return s.s3
+}
+
+func (l *localS3Service) s3Client() s3iface.S3API {
+	return l.s3
+}
+
+// Reads s3:// sources with the service's credentials
+type s3SourceFetcher struct {
+	client      s3iface.S3API
+	limits      tenantInputLimits
+	retryPolicy RetryPolicy
+}
+
+func newS3SourceFetcher(client s3iface.S3API, limits tenantInputLimits, retry RetryPolicy) SourceFetcher {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	return &s3SourceFetcher{
+		client: client,
+		limits: limits,
+		retryPolicy: retry,
+	}
+}
+
+// Returns true when the source URL has the s3 scheme
+func isS3Url(rawUrl string) bool {
+	return strings.HasPrefix(strings.ToLower(rawUrl), s3Scheme+":")
+}
+
+/*
+ * Splits an s3://bucket/key URL into its bucket and key. The key is taken as written, without decoding it
+ */
+func parseS3Url(rawUrl string) (string, string, error) {
+	prefix := s3Scheme + "://"
+	if len(rawUrl) <= len(prefix) || !strings.EqualFold(rawUrl[:len(prefix)], prefix) {
+		return "", "", fmt.Errorf("%s is not an s3:// URL", rawUrl)
+	}
+	parts := strings.SplitN(rawUrl[len(prefix):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("expected an s3:// URL with a bucket and a key")
+	}
+	return parts[0], parts[1], nil
+}
+
+/*
+ * Downloads the object, resuming from the bytes already received when an attempt fails transiently.
+ * Resumed requests must match the object's ETag, so an object replaced part way through is fetched again
+ */
+func (s *s3SourceFetcher) Fetch(ctx context.Context, req *FileConversionRequest, path string) (*FetchedSource, error) {
+	bucket, key, err := parseS3Url(req.SourceUrl)
+	if err != nil {
+		return nil, errSourceNotAllowed{err.Error()}
+	}
+	return fetchToFile(ctx, req, path, s.limits.forTenant(req.Tenant).MaxBytes, s.retryPolicy,
+		func(download *sourceDownload) error {
+			return s.resume(ctx, download, bucket, key)
+		})
+}
+
+func (s *s3SourceFetcher) resume(ctx context.Context, d *sourceDownload, bucket string, key string) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key: aws.String(key),
+	}
+	resuming := d.resuming()
+	if resuming {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", d.size))
+		input.IfMatch = aws.String(d.validator)
+	} else if err := d.reset(); err != nil {
+		return err
+	}
+	out, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		var requestFailure awserr.RequestFailure
+		if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusPreconditionFailed {
+			// The object was replaced since the download began
+			d.validator = ""
+		}
+		return err
+	}
+	defer out.Body.Close()
+	if resuming {
+		if err := d.checkResumedAt(aws.StringValue(out.ContentRange)); err != nil {
+			return err
+		}
+	} else if err := d.restart(aws.StringValue(out.ETag), aws.Int64Value(out.ContentLength)); err != nil {
+		return err
+	}
+	return d.append(out.Body)
+}
+
+// Fetches each source with the fetcher for its scheme
+type schemeSourceFetcher struct {
+	http SourceFetcher
+	// Nil when the uploader cannot read from S3
+	s3   SourceFetcher
+}
+
+func (f *schemeSourceFetcher) Fetch(ctx context.Context, req *FileConversionRequest, path string) (*FetchedSource, error) {
+	if !isS3Url(req.SourceUrl) {
+		return f.http.Fetch(ctx, req, path)
+	}
+	if f.s3 == nil {
+		return nil, errSourceNotAllowed{"s3:// sources are not supported by the configured uploader"}
+	}
+	return f.s3.Fetch(ctx, req, path)
+}
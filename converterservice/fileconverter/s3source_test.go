@@ -0,0 +1,106 @@
+package fileconverter
+
+import (
+	"context"
+	"bytes"
+	"crypto/sha256"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Returns an S3 client for a local S3 stand-in at the endpoint
+ */
+func testS3Client(endpoint string) s3iface.S3API {
+	return s3.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("test-region"),
+		Endpoint: aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials: credentials.NewStaticCredentials("test-id", "test-secret", ""),
+		MaxRetries: aws.Int(0),
+	})))
+}
+
+func TestParseS3Url(t *testing.T) {
+	bucket, key, err := parseS3Url("s3://test-bucket/audio/test key.mp3")
+	assert.Nil(t, err)
+	assert.Equal(t, "test-bucket", bucket)
+	assert.Equal(t, "audio/test key.mp3", key)
+	for _, rawUrl := range []string{"s3://test-bucket", "s3://test-bucket/", "s3:///test-key", "https://test-bucket/key"} {
+		_, _, err := parseS3Url(rawUrl)
+		assert.NotNil(t, err, "%s should not parse", rawUrl)
+	}
+}
+
+func TestSourcePolicy_CheckS3(t *testing.T) {
+	policy := &SourcePolicy{Buckets: []string{"test-bucket"}}
+	assert.Nil(t, policy.Check("s3://test-bucket/test-key"))
+	assert.NotNil(t, policy.Check("s3://other-bucket/test-key"), "buckets not in the list should be rejected")
+	assert.NotNil(t, (&SourcePolicy{}).Check("s3://test-bucket/test-key"), "no buckets should be readable by default")
+	httpOnly := &SourcePolicy{Schemes: []string{"http", "https"}, Buckets: []string{"test-bucket"}}
+	assert.NotNil(t, httpOnly.Check("s3://test-bucket/test-key"), "schemes without s3 should turn s3:// sources off")
+	explicit := &SourcePolicy{Schemes: []string{"S3"}, Buckets: []string{"test-bucket"}}
+	assert.Nil(t, explicit.Check("s3://test-bucket/test-key"))
+}
+
+func TestSourcePolicy_CheckOutputBuckets(t *testing.T) {
+	policy := &SourcePolicy{Buckets: []string{"input-bucket", "tenant-bucket"}}
+	assert.Nil(t, policy.CheckOutputBuckets("output-bucket"))
+	assert.NotNil(t, policy.CheckOutputBuckets("output-bucket", "tenant-bucket"),
+		"buckets holding converted audio should not be readable as sources")
+	var unchecked *SourcePolicy
+	assert.Nil(t, unchecked.CheckOutputBuckets("output-bucket"))
+}
+
+func TestS3SourceFetcher_ResumesInterruptedDownload(t *testing.T) {
+	content := []byte(strings.Repeat("test-source", 1000))
+	var requests []*http.Request
+	server := interruptedSource(t, content, `"test-etag"`, &requests)
+	defer server.Close()
+	fetcher := newS3SourceFetcher(testS3Client(server.URL), tenantInputLimits{}, testFetchRetry)
+	path := testSourceFile(t)
+	source, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: "s3://test-bucket/audio/test-key.mp3"}, path)
+	assert.Nil(t, err)
+	digest := sha256.Sum256(content)
+	assert.Equal(t, digest[:], source.Digest)
+	fetched, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, content, fetched)
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "/test-bucket/audio/test-key.mp3", requests[0].URL.Path)
+	assert.NotEmpty(t, requests[0].Header.Get("Authorization"), "should sign requests with the service's credentials")
+	assert.Equal(t, "bytes="+strconv.Itoa(len(content)/2)+"-", requests[1].Header.Get("Range"))
+	assert.Equal(t, `"test-etag"`, requests[1].Header.Get("If-Match"))
+}
+
+func TestS3SourceFetcher_SizeLimit(t *testing.T) {
+	content := []byte(strings.Repeat("a", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	fetcher := newS3SourceFetcher(testS3Client(server.URL), tenantInputLimits{global: InputLimits{MaxBytes: 99}},
+		testFetchRetry)
+	_, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: "s3://test-bucket/test-key"}, testSourceFile(t))
+	assert.Equal(t, errSourceTooLarge{99}, err)
+}
+
+func TestSchemeSourceFetcher(t *testing.T) {
+	fetcher := newSourceFetcher(&ConverterImplementation{}, tenantInputLimits{}, testFetchRetry)
+	_, err := fetcher.Fetch(context.Background(), &FileConversionRequest{SourceUrl: "s3://test-bucket/test-key"}, testSourceFile(t))
+	assert.IsType(t, errSourceNotAllowed{}, err, "s3:// sources need an uploader with an S3 client")
+	uploader := NewLocalFileUploader("test-region", "http://127.0.0.1:1", "test-bucket", nil)
+	fetcher = newSourceFetcher(&ConverterImplementation{S3service: uploader}, tenantInputLimits{}, testFetchRetry)
+	assert.NotNil(t, fetcher.(*schemeSourceFetcher).s3, "should read s3:// sources with the uploader's client")
+}
@@ -0,0 +1,230 @@
+package fileconverter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http/httpguts"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The most headers a request may send with its source
+const maxSourceHeaders = 20
+
+// Replaces the values of source headers wherever they would be printed
+const redacted = "[REDACTED]"
+
+// Headers the fetcher sets itself, or that would change how the source is transferred
+var reservedSourceHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Host",
+	"If-Match",
+	"If-Range",
+	"Range",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Headers sent only when fetching a source, keyed by canonical name. Values are credentials,
+// so printing the headers shows only their names
+type SourceHeaders map[string]string
+
+func (h SourceHeaders) String() string {
+	names := h.names()
+	for i, name := range names {
+		names[i] = name + ": " + redacted
+	}
+	return "map[" + strings.Join(names, " ") + "]"
+}
+
+func (h SourceHeaders) GoString() string {
+	return h.String()
+}
+
+// Returns the header names in order
+func (h SourceHeaders) names() []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the header values, so that they can be scrubbed from anything printed
+func (h SourceHeaders) values() []string {
+	values := make([]string, 0, len(h))
+	for _, value := range h {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Sets the headers on a request for the source
+func (h SourceHeaders) apply(header http.Header) {
+	for name, value := range h {
+		header.Set(name, value)
+	}
+}
+
+/*
+ * Validates the headers requested for the source, returning them with canonical names.
+ * Errors name the offending header but never include a value
+ */
+func newSourceHeaders(headers map[string]string, sourceUrl string) (SourceHeaders, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	if isS3Url(sourceUrl) {
+		return nil, errors.New("sourceHeaders are not supported for s3:// sources")
+	}
+	if len(headers) > maxSourceHeaders {
+		return nil, fmt.Errorf("at most %d sourceHeaders may be sent", maxSourceHeaders)
+	}
+	canonical := make(SourceHeaders, len(headers))
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("source header %q is not a valid header name", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("source header %s has an invalid value", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if containsFold(reservedSourceHeaders, name) {
+			return nil, fmt.Errorf("source header %s is set by the service", name)
+		}
+		if _, ok := canonical[name]; ok {
+			return nil, fmt.Errorf("source header %s was sent more than once", name)
+		}
+		canonical[name] = value
+	}
+	return canonical, nil
+}
+
+// The length of the key id stored before each nonce
+const headerKeyIdSize = 4
+
+// Encrypts source headers persisted with their job, so that credentials are never stored in plaintext
+type HeaderCipher struct {
+	// The key headers are sealed with, followed by retired keys that can still open them
+	keys []headerKey
+}
+
+// An AES-256-GCM key and the id that marks what it sealed
+type headerKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+/*
+ * Creates a cipher that encrypts with AES-256-GCM under the 32 byte key. Headers sealed with any of the old keys
+ * can still be opened, so that the key can be rotated while jobs sealed with the previous one are unfinished
+ */
+func NewHeaderCipher(key []byte, oldKeys ...[]byte) (*HeaderCipher, error) {
+	c := &HeaderCipher{}
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		if len(k) != 32 {
+			return nil, fmt.Errorf("source header key must be 32 bytes, got %d", len(k))
+		}
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(k)
+		c.keys = append(c.keys, headerKey{id: digest[:headerKeyIdSize], aead: aead})
+	}
+	return c, nil
+}
+
+/*
+ * Encrypts the headers for the job, returning the id of the key, the nonce and then the ciphertext. The job id is
+ * authenticated with the headers, so they cannot be moved to another job. Returns nil when there are no headers
+ */
+func (c *HeaderCipher) Seal(id string, headers SourceHeaders) ([]byte, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	if c == nil {
+		return nil, errors.New("sourceHeaders are not supported, since no source header key is configured")
+	}
+	plaintext, err := json.Marshal(map[string]string(headers))
+	if err != nil {
+		return nil, err
+	}
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, key.id...), nonce...)
+	return key.aead.Seal(sealed, nonce, plaintext, []byte(id)), nil
+}
+
+/*
+ * Decrypts headers sealed for the job with the key named by their key id. Headers sealed before key ids were
+ * stored start with the nonce, and are tried with every key. Returns nil when nothing was sealed
+ */
+func (c *HeaderCipher) Open(id string, sealed []byte) (SourceHeaders, error) {
+	if len(sealed) == 0 {
+		return nil, nil
+	}
+	if c == nil {
+		return nil, errors.New("job has sourceHeaders, but no source header key is configured")
+	}
+	plaintext, ok := c.open(id, sealed)
+	if !ok {
+		return nil, errors.New("failed to decrypt sourceHeaders, the key they were sealed with is not configured")
+	}
+	var headers SourceHeaders
+	if err := json.Unmarshal(plaintext, &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+/*
+ * Returns the plaintext of the sealed headers and true if one of the keys opens them
+ */
+func (c *HeaderCipher) open(id string, sealed []byte) ([]byte, bool) {
+	for _, key := range c.keys {
+		if bytes.HasPrefix(sealed, key.id) {
+			if plaintext, ok := key.openNonceAndCiphertext(id, sealed[len(key.id):]); ok {
+				return plaintext, true
+			}
+		}
+	}
+	for _, key := range c.keys {
+		if plaintext, ok := key.openNonceAndCiphertext(id, sealed); ok {
+			return plaintext, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * Decrypts the nonce followed by the ciphertext with the key, returning false if it does not open them
+ */
+func (k headerKey) openNonceAndCiphertext(id string, sealed []byte) ([]byte, bool) {
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, false
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, []byte(id))
+	return plaintext, err == nil
+}
@@ -0,0 +1,121 @@
+package fileconverter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testCredential = "Bearer test-credential"
+
+func testHeaderCipher(t *testing.T) *HeaderCipher {
+	cipher, err := NewHeaderCipher(bytes.Repeat([]byte("k"), 32))
+	assert.Nil(t, err)
+	return cipher
+}
+
+func TestNewSourceHeaders(t *testing.T) {
+	headers, err := newSourceHeaders(map[string]string{"authorization": testCredential, "x-api-key": "test-key"},
+		"https://example.com/test.mp3")
+	assert.Nil(t, err)
+	assert.Equal(t, SourceHeaders{"Authorization": testCredential, "X-Api-Key": "test-key"}, headers)
+	headers, err = newSourceHeaders(nil, "https://example.com/test.mp3")
+	assert.Nil(t, err)
+	assert.Nil(t, headers)
+	tooMany := map[string]string{}
+	for i := 0; i <= maxSourceHeaders; i++ {
+		tooMany["X-Test-"+strconv.Itoa(i)] = testCredential
+	}
+	rejected := []map[string]string{
+		{"Range": "bytes=0-"},
+		{"host": "example.com"},
+		{"Bad Name": testCredential},
+		{"Authorization": testCredential + "\r\nX-Injected: true"},
+		{"authorization": testCredential, "Authorization": testCredential},
+		tooMany,
+	}
+	for _, requested := range rejected {
+		_, err := newSourceHeaders(requested, "https://example.com/test.mp3")
+		if assert.NotNil(t, err, "%v should be rejected", SourceHeaders(requested)) {
+			assert.NotContains(t, err.Error(), testCredential, "errors should not include header values")
+		}
+	}
+	_, err = newSourceHeaders(map[string]string{"Authorization": testCredential}, "s3://test-bucket/test.mp3")
+	assert.NotNil(t, err, "s3:// sources are read with the service's credentials")
+}
+
+func TestSourceHeaders_String(t *testing.T) {
+	headers := SourceHeaders{"Authorization": testCredential, "X-Api-Key": "test-key"}
+	assert.Equal(t, "map[Authorization: [REDACTED] X-Api-Key: [REDACTED]]", headers.String())
+	req := &FileConversionRequest{SourceUrl: "https://example.com/test.mp3", SourceHeaders: headers}
+	for _, format := range []string{"%v", "%+v", "%#v"} {
+		printed := fmt.Sprintf(format, req)
+		assert.NotContains(t, printed, testCredential, "%s should not print header values", format)
+		assert.NotContains(t, printed, "test-key", "%s should not print header values", format)
+	}
+}
+
+func TestHeaderCipher(t *testing.T) {
+	cipher := testHeaderCipher(t)
+	headers := SourceHeaders{"Authorization": testCredential}
+	sealed, err := cipher.Seal("test-id", headers)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte(testCredential)), "should not store the plaintext")
+	opened, err := cipher.Open("test-id", sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, opened)
+	_, err = cipher.Open("other-id", sealed)
+	assert.NotNil(t, err, "headers sealed for one job should not open for another")
+	other, err := NewHeaderCipher(bytes.Repeat([]byte("o"), 32))
+	assert.Nil(t, err)
+	_, err = other.Open("test-id", sealed)
+	assert.NotNil(t, err, "should not open with a different key")
+	sealed, err = cipher.Seal("test-id", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, sealed, "should seal nothing when there are no headers")
+	_, err = NewHeaderCipher([]byte("short-key"))
+	assert.NotNil(t, err)
+	_, err = NewHeaderCipher(bytes.Repeat([]byte("k"), 32), []byte("short-key"))
+	assert.NotNil(t, err)
+	var missing *HeaderCipher
+	_, err = missing.Seal("test-id", headers)
+	assert.NotNil(t, err, "should not store headers without a key")
+	opened, err = missing.Open("test-id", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, opened)
+}
+
+func TestHeaderCipher_Rotation(t *testing.T) {
+	previous := testHeaderCipher(t)
+	headers := SourceHeaders{"Authorization": testCredential}
+	sealed, err := previous.Seal("test-id", headers)
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(sealed, previous.keys[0].id), "should store the id of the key")
+	rotated, err := NewHeaderCipher(bytes.Repeat([]byte("n"), 32), bytes.Repeat([]byte("k"), 32))
+	assert.Nil(t, err)
+	opened, err := rotated.Open("test-id", sealed)
+	assert.Nil(t, err, "should open headers sealed with an old key")
+	assert.Equal(t, headers, opened)
+	resealed, err := rotated.Seal("test-id", headers)
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(resealed, rotated.keys[0].id), "should seal with the new key")
+	_, err = previous.Open("test-id", resealed)
+	assert.NotNil(t, err)
+	// Headers sealed before key ids were stored start with the nonce
+	key := previous.keys[0]
+	nonce := bytes.Repeat([]byte{1}, key.aead.NonceSize())
+	legacy := key.aead.Seal(nonce, nonce, []byte(`{"Authorization":"`+testCredential+`"}`), []byte("test-id"))
+	opened, err = rotated.Open("test-id", legacy)
+	assert.Nil(t, err, "should open headers sealed without a key id")
+	assert.Equal(t, headers, opened)
+}
+
+func TestRedactedExecutable_String(t *testing.T) {
+	cmd := newRedactedExecutable(SourceHeaders{"Authorization": testCredential}.values(), "ffmpeg", "-headers",
+		"Authorization: "+testCredential)
+	assert.False(t, strings.Contains(cmd.String(), testCredential))
+	assert.Contains(t, cmd.String(), "Authorization: [REDACTED]")
+}
@@ -0,0 +1,315 @@
+package fileconverter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The longest resolving a source host may take
+const resolveTimeout = 10 * time.Second
+
+// The most redirects followed when fetching a source
+const maxRedirects = 10
+
+// Returned when a source or webhook redirects more than maxRedirects times
+var errTooManyRedirects = fmt.Errorf("stopped after %d redirects", maxRedirects)
+
+// Loopback, private, link-local and other addresses that are not on the public internet,
+// including the cloud metadata endpoint at 169.254.169.254
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/96",
+	"::ffff:0:0:0/96",
+	"64:ff9b:1::/48",
+	"2001::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// NAT64 and 6to4 addresses embed an IPv4 address, which a dual-stack host may route to. The deprecated
+// IPv4-compatible and translated forms, local-use NAT64 and Teredo are instead never public above
+var (
+	nat64Network     = parseNetworks("64:ff9b::/96")[0]
+	sixToFourNetwork = parseNetworks("2002::/16")[0]
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// Which source URLs jobs may fetch. A nil policy allows any source
+type SourcePolicy struct {
+	// The URL schemes sources may use. Defaults to http and https, and s3 when Buckets are listed
+	Schemes               []string
+	// The hosts sources may be fetched from, or empty for any host. Entries starting with a period
+	// match the subdomains of the domain that follows
+	Hosts                 []string
+	// Allows sources on loopback, private and link-local addresses, such as a file server in development
+	AllowPrivateAddresses bool
+	// The buckets s3:// sources may be read from with the service's credentials, or empty to allow no s3:// sources.
+	// Any tenant may read them, so they must not hold converted audio
+	Buckets               []string
+}
+
+// Returned when a source URL is rejected by the policy
+type errSourceNotAllowed struct {
+	reason string
+}
+
+func (e errSourceNotAllowed) Error() string {
+	return "sourceUrl is not allowed: " + e.reason
+}
+
+func (p *SourcePolicy) schemes() []string {
+	if len(p.Schemes) > 0 {
+		return p.Schemes
+	}
+	if len(p.Buckets) > 0 {
+		return []string{"http", "https", s3Scheme}
+	}
+	return []string{"http", "https"}
+}
+
+/*
+ * Checks the scheme and host of the source URL, then resolves the host and rejects it
+ * if any of its addresses are not public. s3:// sources only need to be in a readable bucket
+ */
+func (p *SourcePolicy) Check(rawUrl string) error {
+	if p == nil {
+		return nil
+	}
+	if isS3Url(rawUrl) {
+		return p.checkS3Url(rawUrl)
+	}
+	source, err := p.checkUrl(rawUrl)
+	if err != nil {
+		return err
+	}
+	return p.checkResolved(source.Hostname())
+}
+
+/*
+ * Checks that a callback URL only resolves to addresses sources may be fetched from, so that webhooks
+ * cannot be aimed at the service's own network. The source schemes and hosts do not apply to callbacks
+ */
+func (p *SourcePolicy) CheckCallback(rawUrl string) error {
+	if p == nil || rawUrl == "" {
+		return nil
+	}
+	callback, err := url.Parse(rawUrl)
+	if err != nil || callback.Hostname() == "" {
+		return errors.New("callbackUrl is not allowed: expected an absolute URL with a host")
+	}
+	if err := p.checkResolved(callback.Hostname()); err != nil {
+		if notAllowed, ok := err.(errSourceNotAllowed); ok {
+			return errors.New("callbackUrl is not allowed: " + notAllowed.reason)
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+ * Resolves the host and rejects it if any of its addresses are not public
+ */
+func (p *SourcePolicy) checkResolved(host string) error {
+	if p.AllowPrivateAddresses {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if err := p.checkAddress(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Checks the scheme and host of the URL without resolving it, returning the parsed URL
+ */
+func (p *SourcePolicy) checkUrl(rawUrl string) (*url.URL, error) {
+	source, err := url.Parse(rawUrl)
+	if err != nil || source.Hostname() == "" {
+		return nil, errSourceNotAllowed{"expected an absolute URL with a host"}
+	}
+	if !containsFold(p.schemes(), source.Scheme) {
+		return nil, errSourceNotAllowed{fmt.Sprintf("scheme %q is not one of %s", source.Scheme,
+			strings.Join(p.schemes(), ", "))}
+	}
+	if len(p.Hosts) > 0 && !p.allowsHost(source.Hostname()) {
+		return nil, errSourceNotAllowed{fmt.Sprintf("host %s is not allowed", source.Hostname())}
+	}
+	return source, nil
+}
+
+/*
+ * Checks that s3:// sources are allowed and that the source names an object in one of the readable buckets
+ */
+func (p *SourcePolicy) checkS3Url(rawUrl string) error {
+	if !containsFold(p.schemes(), s3Scheme) {
+		return errSourceNotAllowed{fmt.Sprintf("scheme %q is not one of %s", s3Scheme, strings.Join(p.schemes(), ", "))}
+	}
+	bucket, _, err := parseS3Url(rawUrl)
+	if err != nil {
+		return errSourceNotAllowed{err.Error()}
+	}
+	for _, allowed := range p.Buckets {
+		if bucket == allowed {
+			return nil
+		}
+	}
+	return errSourceNotAllowed{fmt.Sprintf("bucket %s is not readable", bucket)}
+}
+
+/*
+ * Returns an error if any of the buckets converted audio is stored in can be read as a source,
+ * since any tenant could then read the output of the others
+ */
+func (p *SourcePolicy) CheckOutputBuckets(buckets ...string) error {
+	if p == nil {
+		return nil
+	}
+	for _, bucket := range buckets {
+		for _, readable := range p.Buckets {
+			if bucket == readable {
+				return fmt.Errorf("bucket %s holds converted audio, so it cannot be a source bucket", bucket)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *SourcePolicy) allowsHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range p.Hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *SourcePolicy) checkAddress(ip net.IP) error {
+	if p.AllowPrivateAddresses {
+		return nil
+	}
+	addresses := []net.IP{ip}
+	if ip4 := ip.To4(); ip4 != nil {
+		addresses[0] = ip4
+	} else if embedded := embeddedIPv4(ip); embedded != nil {
+		addresses = append(addresses, embedded)
+	}
+	for _, address := range addresses {
+		for _, network := range nonPublicNetworks {
+			if network.Contains(address) {
+				return errSourceNotAllowed{fmt.Sprintf("%s is not a public address", ip)}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the IPv4 address embedded in a NAT64 or 6to4 address, or nil for other addresses
+ */
+func embeddedIPv4(ip net.IP) net.IP {
+	ip = ip.To16()
+	switch {
+	case ip == nil:
+		return nil
+	case nat64Network.Contains(ip):
+		return ip[12:16]
+	case sixToFourNetwork.Contains(ip):
+		return ip[2:6]
+	}
+	return nil
+}
+
+/*
+ * Checks the address a connection is about to be made to. Used as the Control of a net.Dialer,
+ * so that redirects and hosts that resolve differently after Check are also covered
+ */
+func (p *SourcePolicy) dialControl(network string, address string, c syscall.RawConn) error {
+	if p == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errSourceNotAllowed{fmt.Sprintf("%s is not an IP address", host)}
+	}
+	return p.checkAddress(ip)
+}
+
+/*
+ * Checks each redirect against the policy's schemes and hosts. Addresses are checked when dialing
+ */
+func (p *SourcePolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errTooManyRedirects
+	}
+	if p == nil {
+		return nil
+	}
+	_, err := p.checkUrl(req.URL.String())
+	return err
+}
+
+/*
+ * Checks each redirect of a webhook delivery, which may only lead to another http or https URL.
+ * Addresses are checked when dialing
+ */
+func (p *SourcePolicy) checkCallbackRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errTooManyRedirects
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to %s is not an http or https URL", req.URL.Redacted())
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package fileconverter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSourcePolicy_Check(t *testing.T) {
+	policy := &SourcePolicy{}
+	rejected := []string{
+		"file:///etc/passwd",
+		"gopher://93.184.216.34/",
+		"test-url",
+		"http://127.0.0.1/test.mp3",
+		"http://localhost/test.mp3",
+		"http://10.1.2.3/test.mp3",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/test.mp3",
+		"http://[::ffff:127.0.0.1]/test.mp3",
+		"http://[fd00::1]/test.mp3",
+		"http://0.0.0.0/test.mp3",
+		"http://[64:ff9b::a9fe:a9fe]/test.mp3",
+		"http://[64:ff9b::127.0.0.1]/test.mp3",
+		"http://[2002:a00:1::1]/test.mp3",
+		"http://[2002:c0a8:101::1]/test.mp3",
+		"http://[::10.1.2.3]/test.mp3",
+		"http://[::ffff:0:a9fe:a9fe]/test.mp3",
+		"http://[64:ff9b:1::a00:1]/test.mp3",
+		"http://[2001:0:4136:e378:8000:63bf:3fff:fdd2]/test.mp3",
+	}
+	for _, sourceUrl := range rejected {
+		assert.NotNil(t, policy.Check(sourceUrl), "%s should be rejected", sourceUrl)
+	}
+	assert.Nil(t, policy.Check("https://93.184.216.34/test.mp3"))
+	assert.Nil(t, policy.Check("https://[64:ff9b::5db8:d822]/test.mp3"), "NAT64 addresses of public hosts should be allowed")
+	assert.Nil(t, policy.Check("https://[2002:5db8:d822::1]/test.mp3"), "6to4 addresses of public hosts should be allowed")
+	hosts := &SourcePolicy{Hosts: []string{"93.184.216.34", ".example.com"}}
+	assert.Nil(t, hosts.Check("http://93.184.216.34/test.mp3"))
+	assert.NotNil(t, hosts.Check("http://93.184.216.35/test.mp3"), "hosts not in the list should be rejected")
+	_, err := hosts.checkUrl("http://audio.example.com/test.mp3")
+	assert.Nil(t, err, "subdomains should match entries starting with a period")
+	_, err = hosts.checkUrl("http://example.com.evil.test/test.mp3")
+	assert.NotNil(t, err)
+	private := &SourcePolicy{AllowPrivateAddresses: true}
+	assert.Nil(t, private.Check("http://127.0.0.1/test.mp3"))
+	assert.NotNil(t, private.Check("file:///etc/passwd"), "schemes should still be checked")
+	var unchecked *SourcePolicy
+	assert.Nil(t, unchecked.Check("file:///etc/passwd"), "a nil policy should allow any source")
+}
+
+func TestSourcePolicy_CheckCallback(t *testing.T) {
+	policy := &SourcePolicy{Schemes: []string{"s3"}, Hosts: []string{"audio.example.com"}}
+	for _, callbackUrl := range []string{"hook", "http://127.0.0.1:8080/hook", "http://169.254.169.254/latest"} {
+		assert.NotNil(t, policy.CheckCallback(callbackUrl), "%s should be rejected", callbackUrl)
+	}
+	assert.Nil(t, policy.CheckCallback("https://93.184.216.34/hook"), "source schemes and hosts should not apply")
+	assert.Nil(t, policy.CheckCallback(""), "requests without a callback should be allowed")
+	private := &SourcePolicy{AllowPrivateAddresses: true}
+	assert.Nil(t, private.CheckCallback("http://127.0.0.1:8080/hook"))
+	var unchecked *SourcePolicy
+	assert.Nil(t, unchecked.CheckCallback("http://127.0.0.1:8080/hook"), "a nil policy should allow any callback")
+	redirect, _ := http.NewRequest(http.MethodGet, "file:///etc/passwd", nil)
+	assert.NotNil(t, unchecked.checkCallbackRedirect(redirect, nil), "callbacks may only redirect to http or https")
+}
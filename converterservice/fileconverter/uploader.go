@@ -3,32 +3,76 @@ package fileconverter
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
+// How long converted objects persist in the bucket, matching its lifecycle rule
+const objectExpiry = 24 * time.Hour
+
+// Error codes returned by S3 that will not succeed if the upload is retried
+var permanentUploadErrors = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// Stores converted audio under a prefix for the tenant that owns it
 type FileUploader interface {
-	Upload(id string, encoding string, file *os.File) error
-	SignedUrl(id string) (string, error)
+	Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error
+	// Copies the tenant's object for one job to the object for another, which persists for objectExpiry from now
+	Copy(tenant string, fromId string, toId string) error
+	SignedUrl(tenant string, id string) (string, error)
+}
+
+// The bucket objects are stored in, which tenants may override with their own
+type objectBuckets struct {
+	bucket  string
+	tenants map[string]string
+}
+
+func (b objectBuckets) bucketFor(tenant string) string {
+	if bucket, ok := b.tenants[tenant]; ok {
+		return bucket
+	}
+	return b.bucket
 }
 
 type s3FileUploader struct {
 	s3 *s3.S3
 	uploader *s3manager.Uploader
-	bucket string
+	buckets objectBuckets
 }
 
 type localS3Service struct {
 	s3 *s3.S3
 	uploader *s3manager.Uploader
-	bucket string
+	buckets objectBuckets
+}
+
+/*
+ * Returns the key of a job's object. Each tenant's objects are stored under its own prefix, and
+ * jobs created without a tenant are stored at the root of the bucket
+ */
+func ObjectKey(tenant string, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return fmt.Sprintf("tenants/%s/%s", tenant, id)
 }
 
-func NewS3FileUploader(region string, endpoint string, bucket string) FileUploader {
+/*
+ * The uploaders store objects in bucket, except for tenants mapped to a bucket of their own in tenantBuckets
+ */
+func NewS3FileUploader(region string, endpoint string, bucket string, tenantBuckets map[string]string) FileUploader {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(region),
 		Endpoint: aws.String(endpoint),
@@ -37,11 +81,11 @@ func NewS3FileUploader(region string, endpoint string, bucket string) FileUpload
 	return &s3FileUploader{
 		s3: s3.New(sess),
 		uploader: s3manager.NewUploader(sess),
-		bucket: bucket,
+		buckets: objectBuckets{bucket: bucket, tenants: tenantBuckets},
 	}
 }
 
-func NewLocalFileUploader(region string, endpoint string, bucket string) FileUploader {
+func NewLocalFileUploader(region string, endpoint string, bucket string, tenantBuckets map[string]string) FileUploader {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(region),
 		Endpoint: aws.String(endpoint),
@@ -50,44 +94,73 @@ func NewLocalFileUploader(region string, endpoint string, bucket string) FileUpl
 	return &localS3Service{
 		s3: s3.New(sess),
 		uploader: s3manager.NewUploader(sess),
-		bucket: bucket,
+		buckets: objectBuckets{bucket: bucket, tenants: tenantBuckets},
 	}
 }
 
-func upload(bucket string, id string, encoding string, file *os.File, uploader *s3manager.Uploader) error {
+func upload(bucket string, id string, encoding enums.Encoding, file *os.File, uploader *s3manager.Uploader) error {
 	if _, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(id),
 		Body:   file,
-		ContentType: aws.String(fmt.Sprintf("audio/%s", encoding)),
+		ContentType: aws.String(encoding.Format().MimeType),
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
+/*
+ * Returns true when S3 rejected the upload in a way that retrying will not fix.
+ * Errors without an S3 error code, such as network errors, are not permanent
+ */
+func isPermanentUploadError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return permanentUploadErrors[awsErr.Code()]
+	}
+	return false
+}
+
+func copyObject(bucket string, fromKey string, toKey string, s *s3.S3) error {
+	source := &url.URL{Path: bucket + "/" + fromKey}
+	_, err := s.CopyObject(&s3.CopyObjectInput{
+		Bucket: aws.String(bucket),
+		CopySource: aws.String(source.EscapedPath()),
+		Key: aws.String(toKey),
+	})
+	return err
+}
+
 func signedUrl(bucket string, id string, s *s3.S3) (string, error) {
 	req, _ := s.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key: aws.String(id),
 	})
-	return req.Presign(24 * time.Hour)
+	return req.Presign(objectExpiry)
+}
+
+func (s *s3FileUploader) Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error {
+	return upload(s.buckets.bucketFor(tenant), ObjectKey(tenant, id), encoding, file, s.uploader)
+}
+
+func (s *s3FileUploader) Copy(tenant string, fromId string, toId string) error {
+	return copyObject(s.buckets.bucketFor(tenant), ObjectKey(tenant, fromId), ObjectKey(tenant, toId), s.s3)
 }
 
-func (s *s3FileUploader) Upload(id string, encoding string, file *os.File) error {
-	return upload(s.bucket, id, encoding, file, s.uploader)
+func (s *s3FileUploader) SignedUrl(tenant string, id string) (string, error) {
+	return signedUrl(s.buckets.bucketFor(tenant), ObjectKey(tenant, id), s.s3)
 }
 
-func (s *s3FileUploader) SignedUrl(id string) (string, error) {
-	return signedUrl(s.bucket, id, s.s3)
+func (l *localS3Service) Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error {
+	return upload(l.buckets.bucketFor(tenant), ObjectKey(tenant, id), encoding, file, l.uploader)
 }
 
-func (l *localS3Service) Upload(id string, encoding string, file *os.File) error {
-	return upload(l.bucket, id, encoding, file, l.uploader)
+func (l *localS3Service) Copy(tenant string, fromId string, toId string) error {
+	return copyObject(l.buckets.bucketFor(tenant), ObjectKey(tenant, fromId), ObjectKey(tenant, toId), l.s3)
 }
 
-func (l *localS3Service) SignedUrl(id string) (string, error) {
-	url, err := signedUrl(l.bucket, id, l.s3)
+func (l *localS3Service) SignedUrl(tenant string, id string) (string, error) {
+	url, err := signedUrl(l.buckets.bucketFor(tenant), ObjectKey(tenant, id), l.s3)
 	if err != nil {
 		return url, err
 	}
@@ -0,0 +1,245 @@
+package fileconverter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook request headers
+const (
+	webhookDeliveryHeader  = "X-Converter-Delivery"
+	webhookTimestampHeader = "X-Converter-Timestamp"
+	// The hex HMAC-SHA256 of the timestamp, a period and the body, keyed by the webhook secret
+	webhookSignatureHeader = "X-Converter-Signature"
+)
+
+// The longest a single delivery attempt may take
+const webhookTimeout = 10 * time.Second
+
+// How long past its next attempt a delivery stays claimed, covering the attempt and recording its outcome
+const webhookClaimMargin = 2 * webhookTimeout
+
+// How often pending deliveries abandoned by a stopped instance are picked up, and how many at a time
+const (
+	webhookRedeliveryInterval = 30 * time.Second
+	webhookRedeliveryBatch    = 100
+)
+
+// Notifies callback URLs when jobs reach a terminal state
+type WebhookDispatcher interface {
+	// Records an event for the job's current state and delivers it in the background.
+	// Jobs without a callback URL are ignored
+	Dispatch(job *db.ConvertJob)
+	// Redelivers the job's events that failed or were abandoned, returning how many were retried.
+	// Events that are still being retried are skipped
+	Replay(jobId string) (int, error)
+	// Stops retrying deliveries. Pending deliveries are left to be picked up once their claim expires
+	Stop()
+}
+
+// The event sent to a job's callback URL
+type WebhookEvent struct {
+	Id           string    `json:"id"`
+	Status       string    `json:"status"`
+	Url          string    `json:"url,omitempty"`
+	ErrorCode    string    `json:"errorCode,omitempty"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// The default webhook dispatcher, which POSTs signed events and records each attempt
+type httpWebhookDispatcher struct {
+	db          db.FileConverterRepository
+	client      *http.Client
+	secret      []byte
+	retryPolicy RetryPolicy
+	stopping    chan struct{}
+	stopOnce    sync.Once
+}
+
+/*
+ * Every connection is checked against the source policy, so that callbacks cannot reach private addresses.
+ * Pending deliveries whose claim has expired, such as those interrupted by a restart, are picked up in the
+ * background until the dispatcher is stopped
+ */
+func NewWebhookDispatcher(repo db.FileConverterRepository, secret string, retry RetryPolicy,
+	sourcePolicy *SourcePolicy) WebhookDispatcher {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	dialer := &net.Dialer{Timeout: fetchDialTimeout, Control: sourcePolicy.dialControl}
+	dispatcher := &httpWebhookDispatcher{
+		db: repo,
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: sourcePolicy.checkCallbackRedirect,
+			Timeout: webhookTimeout,
+		},
+		secret: []byte(secret),
+		retryPolicy: retry,
+		stopping: make(chan struct{}),
+	}
+	go dispatcher.redeliverAbandoned(webhookRedeliveryInterval)
+	return dispatcher
+}
+
+func (d *httpWebhookDispatcher) Dispatch(job *db.ConvertJob) {
+	url := job.Request.CallbackUrl
+	if url == "" {
+		return
+	}
+	event := &WebhookEvent{
+		Id: job.Id,
+		Status: job.Status,
+		Timestamp: job.LastUpdated,
+	}
+	if job.Status == enums.COMPLETED.Name() {
+		event.Url = job.CurrUrl
+	} else {
+		event.ErrorCode, event.ErrorMessage = job.ErrorCode, job.ErrorMessage
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to encode webhook event for %s, encountered %v", job.Id, err)
+		return
+	}
+	id, err := d.db.NewWebhookDelivery(job.Id, url, string(payload), claimUntil(0))
+	if err != nil {
+		log.Printf("failed to record webhook delivery for %s, encountered %v", job.Id, err)
+		return
+	}
+	go d.deliver(id, url, payload, 1)
+}
+
+func (d *httpWebhookDispatcher) Replay(jobId string) (int, error) {
+	deliveries, err := d.db.ClaimUndeliveredWebhooks(jobId, claimUntil(0))
+	if err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		go d.deliver(delivery.Id, delivery.Url, []byte(delivery.Payload), 1)
+	}
+	return len(deliveries), nil
+}
+
+func (d *httpWebhookDispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopping)
+	})
+}
+
+// Returns when a delivery whose next attempt is after the wait stops being claimed
+func claimUntil(wait time.Duration) time.Time {
+	return time.Now().Add(wait + webhookClaimMargin)
+}
+
+/*
+ * Resumes the pending deliveries no instance holds, once on start and then every interval,
+ * continuing from the attempts they have already made
+ */
+func (d *httpWebhookDispatcher) redeliverAbandoned(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deliveries, err := d.db.ClaimAbandonedWebhooks(claimUntil(0), webhookRedeliveryBatch)
+		if err != nil {
+			log.Printf("failed to claim abandoned webhook deliveries, encountered %v", err)
+		} else if len(deliveries) > 0 {
+			log.Printf("resuming %d abandoned webhook deliveries", len(deliveries))
+		}
+		for _, delivery := range deliveries {
+			go d.deliver(delivery.Id, delivery.Url, []byte(delivery.Payload), delivery.Attempts + 1)
+		}
+		select {
+		case <- ticker.C:
+		case <- d.stopping:
+			return
+		}
+	}
+}
+
+/*
+ * Sends the event until it is accepted or the retry policy runs out of attempts, starting from the given attempt
+ * and backing off exponentially in between. Every attempt is recorded in the delivery log, and the delivery
+ * stays claimed through each backoff so that no other instance picks it up. If the dispatcher is stopped,
+ * the delivery is left pending for its claim to expire
+ */
+func (d *httpWebhookDispatcher) deliver(id int64, url string, payload []byte, attempt int) {
+	for n := attempt; ; n++ {
+		responseCode, err := d.post(id, url, payload)
+		if err == nil {
+			if _, dbErr := d.db.RecordWebhookAttempt(id, enums.DELIVERED, responseCode, "", time.Now()); dbErr != nil {
+				log.Printf("failed to record webhook delivery %d, encountered %v", id, dbErr)
+			}
+			return
+		}
+		status, backoff := enums.DeliveryStatus(enums.DELIVERY_PENDING), d.retryPolicy.backoff(n)
+		if n >= d.retryPolicy.MaxAttempts {
+			status = enums.DELIVERY_FAILED
+		}
+		if _, dbErr := d.db.RecordWebhookAttempt(id, status, responseCode, err.Error(), claimUntil(backoff)); dbErr != nil {
+			log.Printf("failed to record webhook delivery %d, encountered %v", id, dbErr)
+		}
+		if status == enums.DELIVERY_FAILED {
+			log.Printf("webhook delivery %d to %s failed after %d attempts: %v", id, url, n, err)
+			return
+		}
+		select {
+		case <- time.After(backoff):
+		case <- d.stopping:
+			return
+		}
+	}
+}
+
+/*
+ * Makes a single delivery attempt, returning the response status if one was received.
+ * Any status outside 2xx is an error
+ */
+func (d *httpWebhookDispatcher) post(id int64, url string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(id, 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, SignWebhook(d.secret, timestamp, payload))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected response %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+/*
+ * Returns the signature of a webhook body sent at the given unix timestamp. Signing the timestamp
+ * lets receivers reject old events that are replayed by a third party
+ */
+func SignWebhook(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,184 @@
+// Tests the webhook dispatcher
+package fileconverter_test
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	encodings "github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/mocks"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "test-secret"
+
+var testWebhookRetry = fileconverter.RetryPolicy{
+	MaxAttempts: 3,
+	InitialBackoff: time.Millisecond,
+}
+
+// Receives webhooks, responding with status until it is changed
+type webhookReceiver struct {
+	lock   sync.Mutex
+	status int
+	events []*fileconverter.WebhookEvent
+	valid  []bool
+}
+
+func (w *webhookReceiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	signature := fileconverter.SignWebhook([]byte(testWebhookSecret), req.Header.Get("X-Converter-Timestamp"), body)
+	var event fileconverter.WebhookEvent
+	json.Unmarshal(body, &event)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.events = append(w.events, &event)
+	w.valid = append(w.valid, signature == req.Header.Get("X-Converter-Signature"))
+	res.WriteHeader(w.status)
+}
+
+func (w *webhookReceiver) setStatus(status int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.status = status
+}
+
+func waitForDelivery(t *testing.T, repo *mocks.MockFileConverterRepo, jobId string, status string) *db.WebhookDelivery {
+	var delivery *db.WebhookDelivery
+	assert.Eventually(t, func() bool {
+		deliveries := repo.WebhookDeliveries(jobId)
+		if len(deliveries) == 0 {
+			return false
+		}
+		delivery = deliveries[0]
+		return delivery.Status == status
+	}, time.Second, time.Millisecond, "delivery should be %s", status)
+	return delivery
+}
+
+func TestConvertFile_Webhook(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	repo := mocks.NewMockFileConverterRepo()
+	fileConverter := fileconverter.New(&fileconverter.ConverterImplementation{
+		Db: repo,
+		ExecutableFactory: mocks.NewMockExecutableFactory(),
+		SourceFetcher: mocks.NewMockSourceFetcher(),
+		S3service: mocks.NewMockS3FileUploader(testRegion, testS3Endpoint, testBucketName),
+		Webhooks: fileconverter.NewWebhookDispatcher(repo, testWebhookSecret, testWebhookRetry, nil),
+	})
+	req := &fileconverter.FileConversionRequest{
+		Id: uuid.New().String(),
+		SourceUrl: "some-source-url",
+		SourceEncoding: encodings.FLAC,
+		DestEncoding: encodings.MP3,
+		CallbackUrl: server.URL,
+	}
+	repo.NewRequest(req.Id, req.Record())
+	fileConverter.ConvertFile(req)
+	delivery := waitForDelivery(t, repo, req.Id, encodings.DELIVERED.Name())
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.ResponseCode)
+	job, _ := repo.GetConversion(req.Id)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if assert.Len(t, receiver.events, 1) {
+		assert.True(t, receiver.valid[0], "signature should match the body")
+		assert.Equal(t, req.Id, receiver.events[0].Id)
+		assert.Equal(t, encodings.COMPLETED.Name(), receiver.events[0].Status)
+		assert.Equal(t, job.CurrUrl, receiver.events[0].Url)
+	}
+}
+
+func TestWebhookDispatcher_RetryAndReplay(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	repo := mocks.NewMockFileConverterRepo()
+	dispatcher := fileconverter.NewWebhookDispatcher(repo, testWebhookSecret, testWebhookRetry, nil)
+	repo.NewRequest("failed-job", &db.ConversionRequest{CallbackUrl: server.URL})
+	repo.FailConversion("failed-job", "", encodings.TIMEOUT, "conversion timed out")
+	job, _ := repo.GetConversion("failed-job")
+	dispatcher.Dispatch(job)
+	delivery := waitForDelivery(t, repo, "failed-job", encodings.DELIVERY_FAILED.Name())
+	assert.Equal(t, testWebhookRetry.MaxAttempts, delivery.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.ResponseCode)
+	assert.NotEmpty(t, delivery.Error)
+	receiver.setStatus(http.StatusNoContent)
+	replayed, err := dispatcher.Replay("failed-job")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	waitForDelivery(t, repo, "failed-job", encodings.DELIVERED.Name())
+	replayed, err = dispatcher.Replay("failed-job")
+	assert.Nil(t, err)
+	assert.Zero(t, replayed, "delivered events should not be replayed")
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if assert.Len(t, receiver.events, testWebhookRetry.MaxAttempts + 1) {
+		last := receiver.events[len(receiver.events) - 1]
+		assert.Equal(t, encodings.FAILED.Name(), last.Status)
+		assert.Equal(t, encodings.TIMEOUT.Name(), last.ErrorCode)
+		assert.Empty(t, last.Url)
+	}
+}
+
+func TestWebhookDispatcher_NoCallback(t *testing.T) {
+	repo := mocks.NewMockFileConverterRepo()
+	dispatcher := fileconverter.NewWebhookDispatcher(repo, testWebhookSecret, testWebhookRetry, nil)
+	repo.NewRequest("no-callback", &db.ConversionRequest{})
+	repo.CompleteConversion("no-callback", "", "test-url")
+	job, _ := repo.GetConversion("no-callback")
+	dispatcher.Dispatch(job)
+	assert.Empty(t, repo.WebhookDeliveries("no-callback"))
+}
+
+func TestWebhookDispatcher_SourcePolicy(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	repo := mocks.NewMockFileConverterRepo()
+	dispatcher := fileconverter.NewWebhookDispatcher(repo, testWebhookSecret, testWebhookRetry,
+		&fileconverter.SourcePolicy{})
+	defer dispatcher.Stop()
+	repo.NewRequest("private-callback", &db.ConversionRequest{CallbackUrl: server.URL})
+	repo.CompleteConversion("private-callback", "", "test-url")
+	job, _ := repo.GetConversion("private-callback")
+	dispatcher.Dispatch(job)
+	delivery := waitForDelivery(t, repo, "private-callback", encodings.DELIVERY_FAILED.Name())
+	assert.Zero(t, delivery.ResponseCode, "should not have connected to a private address")
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	assert.Empty(t, receiver.events)
+}
+
+func TestWebhookDispatcher_ResumesAbandoned(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	repo := mocks.NewMockFileConverterRepo()
+	abandoned, _ := repo.NewWebhookDelivery("abandoned-job", server.URL, "{}", time.Now())
+	repo.RecordWebhookAttempt(abandoned, encodings.DELIVERY_PENDING, http.StatusServiceUnavailable, "unavailable",
+		time.Now().Add(-time.Second))
+	inFlight, _ := repo.NewWebhookDelivery("in-flight-job", server.URL, "{}", time.Now().Add(time.Hour))
+	repo.RecordWebhookAttempt(inFlight, encodings.DELIVERY_PENDING, http.StatusServiceUnavailable, "unavailable",
+		time.Now().Add(time.Hour))
+	dispatcher := fileconverter.NewWebhookDispatcher(repo, testWebhookSecret, testWebhookRetry, nil)
+	defer dispatcher.Stop()
+	delivery := waitForDelivery(t, repo, "abandoned-job", encodings.DELIVERED.Name())
+	assert.Equal(t, 2, delivery.Attempts, "should continue from the attempts already made")
+	replayed, err := dispatcher.Replay("in-flight-job")
+	assert.Nil(t, err)
+	assert.Zero(t, replayed, "deliveries that are still being retried should not be replayed")
+	assert.Equal(t, encodings.DELIVERY_PENDING.Name(), repo.WebhookDeliveries("in-flight-job")[0].Status)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	assert.Len(t, receiver.events, 1, "only the abandoned delivery should have been sent")
+}
@@ -0,0 +1,140 @@
+// Idempotency keys for ConvertFile, so that retried requests return the original job
+package converterservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/pb"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"log"
+	"net/http"
+)
+
+// The metadata key that carries an idempotency key
+const idempotencyKeyMetadata = "idempotency-key"
+
+// The scope of idempotency keys sent without an API key
+const anonymousCaller = "anonymous"
+
+var errIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+/*
+ * Returns the first value for the metadata key, or the empty string when it is absent
+ */
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+/*
+ * Returns the idempotency key for the request. The request field takes precedence over metadata
+ */
+func idempotencyKey(ctx context.Context, req *pb.ConvertFileRequest) string {
+	if req.IdempotencyKey != "" {
+		return req.IdempotencyKey
+	}
+	return metadataValue(ctx, idempotencyKeyMetadata)
+}
+
+/*
+ * Returns the identity that idempotency keys are scoped to. Authenticated requests are scoped to their API key.
+ * Unauthenticated requests cannot prove who sent them, so they all share one scope
+ */
+func callerFromContext(ctx context.Context) string {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return "key:" + key.Id
+	}
+	return anonymousCaller
+}
+
+/*
+ * Hashes the request payload, excluding the idempotency key itself. Only the names of source headers
+ * are hashed, so that credentials are not stored. A retry with other header values returns the original
+ * job, which keeps the headers it was created with
+ */
+func requestFingerprint(req *pb.ConvertFileRequest) (string, error) {
+	payload := *req
+	payload.IdempotencyKey = ""
+	if len(req.SourceHeaders) > 0 {
+		payload.SourceHeaders = make(map[string]string, len(req.SourceHeaders))
+		for name := range req.SourceHeaders {
+			payload.SourceHeaders[http.CanonicalHeaderKey(name)] = ""
+		}
+	}
+	encoded, err := json.Marshal(&payload)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+/*
+ * Returns the job the caller created with the idempotency key, or the empty string if the key is unused.
+ * Returns errIdempotencyKeyReused when the key was used with a different payload
+ */
+func (s *ConverterServer) idempotentJob(caller string, key string, fingerprint string) (string, error) {
+	record, err := s.repo.GetIdempotencyKey(caller, key)
+	if err != nil {
+		log.Printf("failed to get idempotency key, encountered %v", err)
+		return "", errors.New("an internal error occurred")
+	}
+	if record == nil {
+		return "", nil
+	}
+	if record.RequestHash != fingerprint {
+		return "", errIdempotencyKeyReused
+	}
+	return record.JobId, nil
+}
+
+/*
+ * Persists the job, claiming the caller's idempotency key in the same transaction when one was sent.
+ * Returns the id of the job for the request, which is the original job when the key was claimed concurrently
+ */
+func (s *ConverterServer) createRequest(id string, record *db.ConversionRequest, caller string, key string,
+	fingerprint string) (string, error) {
+	if key == "" {
+		if _, err := s.repo.NewRequest(id, record); err != nil {
+			log.Printf("failed to create %s, encountered %v", id, err)
+			return "", errors.New("an internal error occurred")
+		}
+		return id, nil
+	}
+	created, err := s.repo.NewIdempotentRequest(id, record, caller, key, fingerprint)
+	if err != nil {
+		log.Printf("failed to create %s, encountered %v", id, err)
+		return "", errors.New("an internal error occurred")
+	}
+	if created {
+		return id, nil
+	}
+	originalId, err := s.idempotentJob(caller, key, fingerprint)
+	if err == nil && originalId == "" {
+		log.Printf("idempotency key for %s was claimed but not found", id)
+		err = errors.New("an internal error occurred")
+	}
+	return originalId, err
+}
+
+/*
+ * Releases the caller's idempotency key after the job it was claimed for could not be queued
+ */
+func (s *ConverterServer) releaseIdempotencyKey(caller string, key string) {
+	if key == "" {
+		return
+	}
+	if _, err := s.repo.DeleteIdempotencyKey(caller, key); err != nil {
+		log.Printf("failed to release idempotency key, encountered %v", err)
+	}
+}
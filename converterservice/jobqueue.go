@@ -5,24 +5,38 @@ package converterservice
 
 import (
 	"errors"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"sync"
+	"time"
 )
 
+// The number of times a waiting job can be passed over for higher priority work before it is dispatched
+const defaultStarvationLimit = 10
+
+// Returned by Enqueue when QueueSize jobs are already waiting
+var errQueueFull = errors.New("too many requests")
+
 type FileConverterJobQueue interface {
 	Enqueue(request FileConverterJob) error
 	Start() error
-	Stop()
+	// Stops dispatching jobs and waits up to the grace period for running jobs to finish.
+	// Returns the jobs that were still running
+	Stop(gracePeriod time.Duration) []FileConverterJob
 	Running() bool
 }
 
 type FileConverterJob interface {
 	Start()
+	Priority() enums.Priority
+	Id() string
 }
 
 type JobQueueConfiguration struct {
 	Concurrency int
+	// The most jobs that may wait to be dispatched, across every priority
 	QueueSize int
+	StarvationLimit int
 }
 
 type worker struct {
@@ -30,16 +44,30 @@ type worker struct {
 	freeChans chan chan FileConverterJob
 	thisChan chan FileConverterJob
 	stopWorker chan bool
+	stopOnce sync.Once
+	lock sync.Mutex
+	// The job the worker is running, or nil when it is idle
+	current FileConverterJob
 }
 
 type jobQueue struct {
 	converter fileconverter.Converter
 	// A channel of channels that contains worker threads
 	readyWorkers chan chan FileConverterJob
-	readyJobs chan FileConverterJob
+	// A channel of jobs for each priority, indexed by rank
+	readyJobs []chan FileConverterJob
+	// The most jobs that may wait in readyJobs, and how many are waiting
+	queueSize int
+	queued int
+	// Guards queued and running
+	lock sync.Mutex
+	// The number of times the jobs waiting in each priority have been passed over
+	skipped []int
+	starvationLimit int
 	running bool
 	stopAll chan bool
 	workers []*worker
+	waitGroup *sync.WaitGroup
 }
 
 func newWorker(waitGroup *sync.WaitGroup, freeChans chan chan FileConverterJob) *worker {
@@ -54,30 +82,44 @@ func newWorker(waitGroup *sync.WaitGroup, freeChans chan chan FileConverterJob)
 func NewJobQueue(config *JobQueueConfiguration) FileConverterJobQueue {
 	waitGroup := &sync.WaitGroup{}
 	readyWorkers := make(chan chan FileConverterJob, config.Concurrency)
-	readyJobs := make(chan FileConverterJob, config.QueueSize)
+	readyJobs := make([]chan FileConverterJob, enums.PriorityLevels())
+	for i, _ := range readyJobs {
+		readyJobs[i] = make(chan FileConverterJob, config.QueueSize)
+	}
 	workers := make([]*worker, config.Concurrency)
 	for i, _ := range workers {
 		workers[i] = newWorker(waitGroup, readyWorkers)
 	}
+	starvationLimit := config.StarvationLimit
+	if starvationLimit <= 0 {
+		starvationLimit = defaultStarvationLimit
+	}
 	return &jobQueue{
 		readyWorkers: readyWorkers,
 		readyJobs: readyJobs,
+		queueSize: config.QueueSize,
+		skipped: make([]int, len(readyJobs)),
+		starvationLimit: starvationLimit,
 		running: false,
 		stopAll: make(chan bool),
 		workers: workers,
+		waitGroup: waitGroup,
 	}
 }
 
 func (q *jobQueue) Enqueue(job FileConverterJob) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 	if !q.running {
 		return errors.New("queue is shutdown")
 	}
-	select {
-	case q.readyJobs <- job:
-		return nil
-	default:
-		return errors.New("too many requests")
+	if q.queued >= q.queueSize {
+		return errQueueFull
 	}
+	// Each level can hold queueSize jobs, so the send cannot block while the count is under the limit
+	q.readyJobs[job.Priority().Rank()] <- job
+	q.queued++
+	return nil
 }
 
 func (q *jobQueue) Start() error {
@@ -87,53 +129,172 @@ func (q *jobQueue) Start() error {
 		}
 	}
 	go q.run()
+	q.lock.Lock()
 	q.running = true
+	q.lock.Unlock()
 	return nil
 }
 
-func (q *jobQueue) Stop() {
+func (q *jobQueue) Stop(gracePeriod time.Duration) []FileConverterJob {
+	q.lock.Lock()
+	if !q.running {
+		q.lock.Unlock()
+		return nil
+	}
 	q.running = false
+	q.lock.Unlock()
+	close(q.stopAll)
+	q.stopWorkers()
+	finished := make(chan bool)
+	go func() {
+		q.waitGroup.Wait()
+		close(finished)
+	}()
+	select {
+	case <- finished:
+		return nil
+	case <- time.After(gracePeriod):
+	}
+	var unfinished []FileConverterJob
 	for _, w := range q.workers {
-		w.stop()
+		if job := w.runningJob(); job != nil {
+			unfinished = append(unfinished, job)
+		}
 	}
+	return unfinished
 }
 
 func (q *jobQueue) Running() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 	return q.running
 }
 
+/*
+ * Waits for a free worker before choosing a job, so that the job
+ * is chosen from everything that was queued in the meantime. The workers are stopped when it returns
+ */
 func (q *jobQueue) run() {
+	defer q.stopWorkers()
 	for {
 		select {
-		case newJob := <- q.readyJobs:
-			availableWorkerChannel := <- q.readyWorkers
-			availableWorkerChannel <- newJob
-		case <- q.stopAll:
-			for _, w := range q.workers {
-				w.stop()
+		case availableWorkerChannel := <- q.readyWorkers:
+			newJob := q.next()
+			if newJob == nil {
+				return
+			}
+			select {
+			case availableWorkerChannel <- newJob:
+			case <- q.stopAll:
+				return
 			}
+		case <- q.stopAll:
+			return
+		}
+	}
+}
+
+/*
+ * Blocks until a job is ready, returning nil if the queue is stopped first
+ */
+func (q *jobQueue) next() FileConverterJob {
+	if job := q.poll(); job != nil {
+		return job
+	}
+	high, normal, low := q.readyJobs[enums.HIGH.Rank()], q.readyJobs[enums.NORMAL.Rank()], q.readyJobs[enums.LOW.Rank()]
+	select {
+	case job := <- high:
+		return q.dispatched(enums.HIGH.Rank(), job)
+	case job := <- normal:
+		return q.dispatched(enums.NORMAL.Rank(), job)
+	case job := <- low:
+		return q.dispatched(enums.LOW.Rank(), job)
+	case <- q.stopAll:
+		return nil
+	}
+}
+
+/*
+ * Returns the highest priority job that is ready without blocking, or nil if there are none.
+ * A priority whose jobs have been passed over starvationLimit times is served first,
+ * so that lower priority work still progresses
+ */
+func (q *jobQueue) poll() FileConverterJob {
+	for rank, jobs := range q.readyJobs {
+		if q.skipped[rank] >= q.starvationLimit && len(jobs) > 0 {
+			return q.dispatched(rank, <- jobs)
 		}
 	}
+	for rank := len(q.readyJobs) - 1; rank >= 0; rank-- {
+		select {
+		case job := <- q.readyJobs[rank]:
+			return q.dispatched(rank, job)
+		default:
+		}
+	}
+	return nil
+}
+
+/*
+ * Records that a job of the rank was taken from the queue, counting a skip for each lower priority
+ * with jobs still waiting
+ */
+func (q *jobQueue) dispatched(rank int, job FileConverterJob) FileConverterJob {
+	q.skipped[rank] = 0
+	for lower := 0; lower < rank; lower++ {
+		if len(q.readyJobs[lower]) > 0 {
+			q.skipped[lower]++
+		}
+	}
+	q.lock.Lock()
+	q.queued--
+	q.lock.Unlock()
+	return job
+}
+
+func (q *jobQueue) stopWorkers() {
+	for _, w := range q.workers {
+		w.stop()
+	}
 }
 
 func (w *worker) start() error {
+	w.waitGroup.Add(1)
 	go w.run()
 	return nil
 }
 
+/*
+ * Signals the worker to exit once it is idle, without waiting for it
+ */
 func (w *worker) stop() {
-	w.stopWorker <- true
+	w.stopOnce.Do(func() {
+		close(w.stopWorker)
+	})
+}
+
+func (w *worker) runningJob() FileConverterJob {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.current
+}
+
+func (w *worker) setRunningJob(job FileConverterJob) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.current = job
 }
 
 func (w *worker) run() {
-	w.waitGroup.Add(1)
+	defer w.waitGroup.Done()
 	for {
 		w.freeChans <- w.thisChan
 		select {
 		case job := <- w.thisChan:
+			w.setRunningJob(job)
 			job.Start()
+			w.setRunningJob(nil)
 		case <- w.stopWorker:
-			w.waitGroup.Done()
 			return
 		}
 	}
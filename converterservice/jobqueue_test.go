@@ -2,9 +2,11 @@ package converterservice_test
 
 import (
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
 	"github.com/stretchr/testify/assert"
 	"log"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,13 +16,56 @@ type mockJob struct {
 	seconds int
 }
 
+// Guards the done flags of mock jobs, which are set by the workers and read by the tests
+var mockJobLock sync.Mutex
+
 func (m *mockJob) Start() {
 	log.Print("starting job...")
 	time.Sleep(time.Duration(m.seconds) * time.Second)
+	mockJobLock.Lock()
 	*m.done = true
+	mockJobLock.Unlock()
 	log.Printf("complete job.")
 }
 
+func (m *mockJob) Priority() enums.Priority {
+	return enums.NORMAL
+}
+
+func (m *mockJob) Id() string {
+	return "mock-job"
+}
+
+// A job that records the order in which it was started
+type orderedJob struct {
+	name     string
+	priority enums.Priority
+	order    *[]string
+	lock     *sync.Mutex
+	started  chan bool
+	release  chan bool
+}
+
+func (o *orderedJob) Start() {
+	o.lock.Lock()
+	*o.order = append(*o.order, o.name)
+	o.lock.Unlock()
+	if o.started != nil {
+		o.started <- true
+	}
+	if o.release != nil {
+		<- o.release
+	}
+}
+
+func (o *orderedJob) Priority() enums.Priority {
+	return o.priority
+}
+
+func (o *orderedJob) Id() string {
+	return o.name
+}
+
 func newTestJobQueueConfig() *converterservice.JobQueueConfiguration {
 	return &converterservice.JobQueueConfiguration{
 		Concurrency: 5,
@@ -38,9 +83,11 @@ func newMockJob(done *bool, seconds int) converterservice.FileConverterJob {
 func check(bools []bool, allDone chan bool) {
 	for {
 		done := true
+		mockJobLock.Lock()
 		for _, b := range bools {
 			done = done && b
 		}
+		mockJobLock.Unlock()
 		if done {
 			allDone <- true
 			return
@@ -65,7 +112,7 @@ func TestJobQueue_Start(t *testing.T) {
 	err := queue.Start()
 	assert.Nil(t, err)
 	assert.True(t, queue.Running())
-	queue.Stop()
+	queue.Stop(0)
 }
 
 func TestJobQueue_Stop(t *testing.T) {
@@ -74,14 +121,14 @@ func TestJobQueue_Stop(t *testing.T) {
 	err := queue.Start()
 	assert.Nil(t, err)
 	assert.True(t, queue.Running())
-	queue.Stop()
+	queue.Stop(0)
 	assert.False(t, queue.Running())
 }
 
 func TestJobQueue_Enqueue_PoolSize(t *testing.T) {
 	config := newTestJobQueueConfig()
 	queue := converterservice.NewJobQueue(config)
-	defer queue.Stop()
+	defer queue.Stop(0)
 	if err := queue.Start(); err != nil {
 		t.Fatal("failed to start queue")
 	}
@@ -102,10 +149,33 @@ func TestJobQueue_Enqueue_PoolSize(t *testing.T) {
 	}
 }
 
+func TestJobQueue_Enqueue_SharedCapacity(t *testing.T) {
+	queue := converterservice.NewJobQueue(&converterservice.JobQueueConfiguration{
+		Concurrency: 1,
+		QueueSize: 2,
+	})
+	defer queue.Stop(0)
+	if err := queue.Start(); err != nil {
+		t.Fatal("failed to start queue")
+	}
+	order, lock := make([]string, 0), &sync.Mutex{}
+	blocker := &orderedJob{name: "blocker", priority: enums.NORMAL, order: &order, lock: lock,
+		started: make(chan bool), release: make(chan bool)}
+	if err := queue.Enqueue(blocker); err != nil {
+		t.Fatal(err)
+	}
+	<- blocker.started
+	assert.Nil(t, queue.Enqueue(&orderedJob{name: "high", priority: enums.HIGH, order: &order, lock: lock}))
+	assert.Nil(t, queue.Enqueue(&orderedJob{name: "normal", priority: enums.NORMAL, order: &order, lock: lock}))
+	assert.NotNil(t, queue.Enqueue(&orderedJob{name: "low", priority: enums.LOW, order: &order, lock: lock}),
+		"the queue size should bound every priority together")
+	blocker.release <- true
+}
+
 func TestJobQueue_Enqueue_MoreJobs(t *testing.T) {
 	config := newTestJobQueueConfig()
 	queue := converterservice.NewJobQueue(config)
-	defer queue.Stop()
+	defer queue.Stop(0)
 	if err := queue.Start(); err != nil {
 		t.Fatal("failed to start queue")
 	}
@@ -129,7 +199,7 @@ func TestJobQueue_Enqueue_MoreJobs(t *testing.T) {
 func TestJobQueue_Enqueue_StagnatedCompletion(t *testing.T) {
 	config := newTestJobQueueConfig()
 	queue := converterservice.NewJobQueue(config)
-	defer queue.Stop()
+	defer queue.Stop(0)
 	if err := queue.Start(); err != nil {
 		t.Fatal("failed to start queue")
 	}
@@ -153,7 +223,7 @@ func TestJobQueue_Enqueue_StagnatedCompletion(t *testing.T) {
 func TestJobQueue_NotOverConcurrency(t *testing.T) {
 	config := newTestJobQueueConfig()
 	queue := converterservice.NewJobQueue(config)
-	defer queue.Stop()
+	defer queue.Stop(0)
 	if err := queue.Start(); err != nil {
 		t.Fatal("failed to start queue")
 	}
@@ -166,10 +236,125 @@ func TestJobQueue_NotOverConcurrency(t *testing.T) {
 	}
 	<- time.After(6 * time.Second)
 	count := 0
+	mockJobLock.Lock()
 	for _, b := range bools {
 		if b {
 			count += 1
 		}
 	}
+	mockJobLock.Unlock()
 	assert.Equal(t, 5, count)
 }
+
+
+/*
+ * Occupies the only worker of the queue, then enqueues the jobs so that they wait together.
+ * Returns the order in which the jobs were started
+ */
+func runOrderedJobs(t *testing.T, starvationLimit int, names []string, priorities []enums.Priority) []string {
+	queue := converterservice.NewJobQueue(&converterservice.JobQueueConfiguration{
+		Concurrency: 1,
+		QueueSize: 100,
+		StarvationLimit: starvationLimit,
+	})
+	defer queue.Stop(0)
+	if err := queue.Start(); err != nil {
+		t.Fatal("failed to start queue")
+	}
+	order, lock := make([]string, 0), &sync.Mutex{}
+	blocker := &orderedJob{
+		name: "blocker",
+		priority: enums.NORMAL,
+		order: &order,
+		lock: lock,
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+	if err := queue.Enqueue(blocker); err != nil {
+		t.Fatal(err)
+	}
+	<- blocker.started
+	for i, name := range names {
+		job := &orderedJob{name: name, priority: priorities[i], order: &order, lock: lock}
+		if err := queue.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocker.release <- true
+	timeout := time.After(3 * time.Second)
+	for {
+		lock.Lock()
+		done := len(order) == len(names) + 1
+		lock.Unlock()
+		if done {
+			break
+		}
+		select {
+		case <- timeout:
+			t.Fatal("timeout waiting for jobs to start")
+		case <- time.After(10 * time.Millisecond):
+		}
+	}
+	return order[1:]
+}
+
+func TestJobQueue_Priority(t *testing.T) {
+	order := runOrderedJobs(t, 10,
+		[]string{"low", "normal", "high"},
+		[]enums.Priority{enums.LOW, enums.NORMAL, enums.HIGH})
+	assert.Equal(t, []string{"high", "normal", "low"}, order)
+}
+
+func TestJobQueue_Priority_FifoWithinLevel(t *testing.T) {
+	order := runOrderedJobs(t, 10,
+		[]string{"first", "second", "third"},
+		[]enums.Priority{enums.HIGH, enums.HIGH, enums.HIGH})
+	assert.Equal(t, []string{"first", "second", "third"}, order)
+}
+
+func TestJobQueue_Priority_StarvationProtection(t *testing.T) {
+	order := runOrderedJobs(t, 2,
+		[]string{"low", "high-1", "high-2", "high-3", "high-4"},
+		[]enums.Priority{enums.LOW, enums.HIGH, enums.HIGH, enums.HIGH, enums.HIGH})
+	assert.Equal(t, []string{"high-1", "high-2", "low", "high-3", "high-4"}, order)
+}
+
+func TestJobQueue_Stop_GracePeriod(t *testing.T) {
+	queue := converterservice.NewJobQueue(&converterservice.JobQueueConfiguration{
+		Concurrency: 2,
+		QueueSize: 100,
+	})
+	if err := queue.Start(); err != nil {
+		t.Fatal("failed to start queue")
+	}
+	order, lock := make([]string, 0), &sync.Mutex{}
+	quick := &orderedJob{name: "quick", priority: enums.NORMAL, order: &order, lock: lock,
+		started: make(chan bool), release: make(chan bool)}
+	slow := &orderedJob{name: "slow", priority: enums.NORMAL, order: &order, lock: lock,
+		started: make(chan bool), release: make(chan bool)}
+	for _, job := range []*orderedJob{quick, slow} {
+		if err := queue.Enqueue(job); err != nil {
+			t.Fatal(err)
+		}
+		<- job.started
+	}
+	waiting := &orderedJob{name: "waiting", priority: enums.NORMAL, order: &order, lock: lock}
+	if err := queue.Enqueue(waiting); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		quick.release <- true
+	}()
+	unfinished := queue.Stop(500 * time.Millisecond)
+	assert.False(t, queue.Running())
+	if assert.Len(t, unfinished, 1) {
+		assert.Equal(t, "slow", unfinished[0].Id())
+	}
+	assert.NotNil(t, queue.Enqueue(waiting), "should not accept jobs once stopped")
+	slow.release <- true
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"quick", "slow"}, order, "queued jobs should not start once stopped")
+}
@@ -0,0 +1,27 @@
+// Mocks CapabilityProber
+package mocks
+
+import (
+	"errors"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
+)
+
+type MockCapabilityProber struct {
+	Success      bool
+	Capabilities *fileconverter.Capabilities
+}
+
+// Creates a prober reporting that every registered format can be read and written
+func NewMockCapabilityProber() *MockCapabilityProber {
+	return &MockCapabilityProber{
+		Success: true,
+		Capabilities: fileconverter.RegisteredCapabilities(),
+	}
+}
+
+func (m *MockCapabilityProber) Probe() (*fileconverter.Capabilities, error) {
+	if m.Success {
+		return m.Capabilities, nil
+	}
+	return nil, errors.New("failed to run ffmpeg")
+}
@@ -7,30 +7,63 @@ import (
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"io"
 	"os"
+	"sync"
 )
 
 type MockExecutableFactory struct {
-	Success bool
-	Data    map[string]*MockExecutable
+	Success      bool
+	// When set, executables do not finish until they are killed
+	Hang         bool
+	// The number of executables that fail before they start succeeding
+	Failures     int
+	// Written to stderr by executables when they finish
+	StderrOutput string
+	// Written to stdout by executables when they finish
+	StdoutOutput string
+	Data         map[string]*MockExecutable
+	Builds       map[string]int
 }
 
 type MockExecutable struct {
-	Success bool
-	Job     *fileconverter.ConversionAttributes
+	Success      bool
+	// When set, the executable starts but fails before finishing
+	FailWait     bool
+	Hang         bool
+	Killed       bool
+	StderrOutput string
+	StdoutOutput string
+	Job          *fileconverter.ConversionAttributes
+	// Guards Killed, since a job may be killed by its context and by Stop at once
+	lock         sync.Mutex
+	kill         chan bool
+	stdout       io.Writer
+	stderr       io.Writer
 }
 
 func NewMockExecutableFactory() *MockExecutableFactory {
 	return &MockExecutableFactory{
 		Success: true,
 		Data: make(map[string]*MockExecutable),
+		Builds: make(map[string]int),
 	}
 }
 
 func (m *MockExecutableFactory) Build(job *fileconverter.ConversionAttributes) fileconverter.Executable {
+	failWait := false
+	if m.Failures > 0 {
+		m.Failures--
+		failWait = true
+	}
 	executable := &MockExecutable{
 		Success: m.Success,
+		FailWait: failWait,
+		Hang: m.Hang,
+		StderrOutput: m.StderrOutput,
+		StdoutOutput: m.StdoutOutput,
 		Job: job,
+		kill: make(chan bool, 1),
 	}
+	m.Builds[job.Request.Id]++
 	job.TmpFile = fmt.Sprintf("/tmp/%s", job.Request.Id)
 	m.Data[job.Request.Id] = executable
 	return executable
@@ -48,17 +81,42 @@ func (m *MockExecutable) Start() error {
 }
 
 func (m *MockExecutable) Wait() error {
-	if m.Success {
+	if m.Hang {
+		<- m.kill
+		return errors.New("signal: killed")
+	}
+	if m.stderr != nil {
+		if _, err := io.WriteString(m.stderr, m.StderrOutput); err != nil {
+			return err
+		}
+	}
+	if m.stdout != nil {
+		if _, err := io.WriteString(m.stdout, m.StdoutOutput); err != nil {
+			return err
+		}
+	}
+	if m.Success && !m.FailWait {
 		return nil
 	}
 	return errors.New("error encountered during wait")
 }
 
+func (m *MockExecutable) Kill() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Killed {
+		m.Killed = true
+		m.kill <- true
+	}
+	return nil
+}
+
 func (m *MockExecutable) Stdout() io.Writer {
 	return bytes.NewBuffer(make([]byte, 1024))
 }
 
 func (m *MockExecutable) SetStdout(stdout io.Writer) {
+	m.stdout = stdout
 }
 
 func (m *MockExecutable) Stdin() io.Reader {
@@ -73,6 +131,7 @@ func (m *MockExecutable) Stderr() io.Writer {
 }
 
 func (m *MockExecutable) SetStderr(stderr io.Writer) {
+	m.stderr = stderr
 }
 
 func (m *MockExecutable) String() string {
@@ -6,46 +6,111 @@ import (
 	"fmt"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"sort"
+	"sync"
 	"time"
 )
 
 type MockFileConverterRepo struct {
-	Data    map[string]*db.ConvertJob
-	Success bool
+	Data            map[string]*db.ConvertJob
+	Cache           map[string]*db.CachedResult
+	IdempotencyKeys map[string]*db.IdempotencyRecord
+	// The leases on converting jobs, keyed by job id
+	Leases          map[string]*Lease
+	Webhooks        map[int64]*db.WebhookDelivery
+	// API keys, keyed by the hash of the key
+	ApiKeys         map[string]*db.ApiKey
+	Success         bool
+	// Guards Data, Cache, IdempotencyKeys and Leases, standing in for the row locks taken by the database
+	lock            sync.Mutex
+	// Guards Webhooks, which are delivered in the background
+	webhookLock     sync.Mutex
+	// Guards ApiKeys, which are read by concurrent requests
+	apiKeyLock      sync.Mutex
+}
+
+// The worker holding a job and when its hold expires
+type Lease struct {
+	Owner     string
+	ExpiresAt time.Time
 }
 
 func NewMockFileConverterRepo() *MockFileConverterRepo {
 	return &MockFileConverterRepo{
-		Data:    make(map[string]*db.ConvertJob),
-		Success: true,
+		Data:            make(map[string]*db.ConvertJob),
+		Cache:           make(map[string]*db.CachedResult),
+		IdempotencyKeys: make(map[string]*db.IdempotencyRecord),
+		Leases:          make(map[string]*Lease),
+		Webhooks:        make(map[int64]*db.WebhookDelivery),
+		ApiKeys:         make(map[string]*db.ApiKey),
+		Success:         true,
 	}
 }
 
-func (m *MockFileConverterRepo) NewRequest(id string) (bool, error) {
+// Returns a copy of the job, as the database would, so that callers never share it with running jobs
+func copyJob(job *db.ConvertJob) *db.ConvertJob {
+	copied := *job
+	return &copied
+}
+
+func idempotencyMapKey(caller string, key string) string {
+	return fmt.Sprintf("%s/%s", caller, key)
+}
+
+func (m *MockFileConverterRepo) NewRequest(id string, request *db.ConversionRequest) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.newRequest(id, request)
+}
+
+func (m *MockFileConverterRepo) newRequest(id string, request *db.ConversionRequest) (bool, error) {
 	if m.Success {
 		m.Data[id] = &db.ConvertJob{
 			Id: id,
 			Status: enums.QUEUED.Name(),
 			CurrUrl: "NONE",
 			LastUpdated: time.Now(),
+			Request: *request,
 		}
 		return true, nil
 	}
 	return false, errors.New(fmt.Sprintf("failed to create request %s", id))
 }
 
-func (m *MockFileConverterRepo) StartConversion(id string) (bool, error) {
+func (m *MockFileConverterRepo) StartConversion(id string, owner string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.Success && m.Data[id] != nil {
 		job := m.Data[id]
+		if job.Status != enums.QUEUED.Name() && (job.Status != enums.CONVERTING.Name() || !m.ownedBy(id, owner)) {
+			return false, nil
+		}
 		job.Status = enums.CONVERTING.Name()
+		job.Attempts++
 		job.LastUpdated = time.Now()
+		if held := m.Leases[id]; held != nil {
+			held.Owner = owner
+		} else {
+			m.Leases[id] = &Lease{Owner: owner}
+		}
 		return true, nil
 	}
 	return false, errors.New(fmt.Sprintf("failed to set status to converting in DB for id %s", id))
 }
 
-func (m *MockFileConverterRepo) CompleteConversion(id string, url string) (bool, error) {
+// Returns true unless the job is converting under another owner
+func (m *MockFileConverterRepo) ownedBy(id string, owner string) bool {
+	held := m.Leases[id]
+	return m.Data[id].Status != enums.CONVERTING.Name() || (held != nil && held.Owner == owner)
+}
+
+func (m *MockFileConverterRepo) CompleteConversion(id string, owner string, url string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.Success && m.Data[id] != nil {
+		if !m.ownedBy(id, owner) {
+			return false, nil
+		}
 		job := m.Data[id]
 		job.CurrUrl = url
 		job.Status = enums.COMPLETED.Name()
@@ -55,19 +120,447 @@ func (m *MockFileConverterRepo) CompleteConversion(id string, url string) (bool,
 	return false, errors.New(fmt.Sprintf("failed to set completion in DB for id %s and url %s", id, url))
 }
 
-func (m *MockFileConverterRepo) FailConversion(id string) (bool, error) {
+func (m *MockFileConverterRepo) RequeueConversion(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to requeue %s", id))
+	}
+	job := m.Data[id]
+	if job == nil || job.Status != enums.CONVERTING.Name() {
+		return false, nil
+	}
+	job.Status = enums.QUEUED.Name()
+	job.LastUpdated = time.Now()
+	return true, nil
+}
+
+func (m *MockFileConverterRepo) FailConversion(id string, owner string, code enums.ErrorCode, message string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.Success && m.Data[id] != nil {
+		if !m.ownedBy(id, owner) {
+			return false, nil
+		}
 		job := m.Data[id]
 		job.Status = enums.FAILED.Name()
+		job.ErrorCode = code.Name()
+		job.ErrorMessage = message
 		job.LastUpdated = time.Now()
 		return true, nil
 	}
 	return false, errors.New(fmt.Sprintf("failed to set failure in DB for Id %s", id))
 }
 
+func (m *MockFileConverterRepo) UpdateProgress(id string, progress *db.Progress) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Success && m.Data[id] != nil {
+		job := m.Data[id]
+		job.Progress = *progress
+		job.LastUpdated = time.Now()
+		return true, nil
+	}
+	return false, errors.New(fmt.Sprintf("failed to update progress in DB for id %s", id))
+}
+
 func (m *MockFileConverterRepo) GetConversion(id string) (*db.ConvertJob, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.Success && m.Data[id] != nil {
-		return m.Data[id], nil
+		return copyJob(m.Data[id]), nil
 	}
 	return nil, errors.New(fmt.Sprintf("could not get job by id %s", id))
 }
+
+func (m *MockFileConverterRepo) GetTenantConversion(tenant string, id string) (*db.ConvertJob, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Success && m.Data[id] != nil && m.Data[id].Request.Tenant == tenant {
+		return copyJob(m.Data[id]), nil
+	}
+	return nil, errors.New(fmt.Sprintf("could not get job by id %s", id))
+}
+
+func (m *MockFileConverterRepo) GetUnfinishedConversions(owner string) ([]*db.ConvertJob, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return nil, errors.New("could not get unfinished jobs")
+	}
+	var jobs []*db.ConvertJob
+	for id, job := range m.Data {
+		owned := m.Leases[id] != nil && m.Leases[id].Owner == owner
+		if job.Status == enums.QUEUED.Name() || (job.Status == enums.CONVERTING.Name() && owned) {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].LastUpdated.Before(jobs[j].LastUpdated)
+	})
+	return jobs, nil
+}
+
+func (m *MockFileConverterRepo) CountActiveConversions(caller string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return 0, errors.New("could not count active jobs")
+	}
+	count := 0
+	for _, job := range m.Data {
+		active := job.Status == enums.QUEUED.Name() || job.Status == enums.CONVERTING.Name()
+		if active && job.Request.Caller == caller {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockFileConverterRepo) ClaimConversion(owner string, lease time.Duration, oldestFirst bool) (*db.ConvertJob, error) {
+	if !m.Success {
+		return nil, errors.New("could not claim a job")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var claimable []*db.ConvertJob
+	for id, job := range m.Data {
+		expired := m.Leases[id] != nil && m.Leases[id].ExpiresAt.Before(time.Now())
+		if job.Status == enums.QUEUED.Name() || (job.Status == enums.CONVERTING.Name() && expired) {
+			claimable = append(claimable, job)
+		}
+	}
+	if len(claimable) == 0 {
+		return nil, nil
+	}
+	sort.Slice(claimable, func(i, j int) bool {
+		iRank, jRank := priorityRank(claimable[i]), priorityRank(claimable[j])
+		if iRank != jRank && !oldestFirst {
+			return iRank > jRank
+		}
+		return claimable[i].LastUpdated.Before(claimable[j].LastUpdated)
+	})
+	job := claimable[0]
+	job.Status = enums.CONVERTING.Name()
+	job.LastUpdated = time.Now()
+	m.Leases[job.Id] = &Lease{
+		Owner: owner,
+		ExpiresAt: time.Now().Add(lease),
+	}
+	return copyJob(job), nil
+}
+
+func priorityRank(job *db.ConvertJob) int {
+	priority, err := enums.PriorityFromName(job.Request.Priority)
+	if err != nil {
+		return enums.NORMAL.Rank()
+	}
+	return priority.Rank()
+}
+
+func (m *MockFileConverterRepo) RenewLease(id string, owner string, lease time.Duration) (bool, error) {
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to renew lease on %s", id))
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, held := m.Data[id], m.Leases[id]
+	if job == nil || held == nil || held.Owner != owner || job.Status != enums.CONVERTING.Name() {
+		return false, nil
+	}
+	held.ExpiresAt = time.Now().Add(lease)
+	return true, nil
+}
+
+/*
+ * Hands the lease on a job to another owner, as if it had expired and been reclaimed elsewhere
+ */
+func (m *MockFileConverterRepo) SetLeaseOwner(id string, owner string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Leases[id] = &Lease{Owner: owner, ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func (m *MockFileConverterRepo) CacheResult(hash string, objectKey string, expiresAt time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Success {
+		m.Cache[hash] = &db.CachedResult{
+			Hash: hash,
+			ObjectKey: objectKey,
+			ExpiresAt: expiresAt,
+		}
+		return true, nil
+	}
+	return false, errors.New(fmt.Sprintf("failed to cache result for hash %s", hash))
+}
+
+func (m *MockFileConverterRepo) GetCachedResult(hash string) (*db.CachedResult, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return nil, errors.New(fmt.Sprintf("could not get cached result for hash %s", hash))
+	}
+	if cached := m.Cache[hash]; cached != nil && cached.ExpiresAt.After(time.Now()) {
+		copied := *cached
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m *MockFileConverterRepo) EvictExpiredResults() (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return 0, errors.New("failed to evict expired cache entries")
+	}
+	var evicted int64
+	for hash, cached := range m.Cache {
+		if !cached.ExpiresAt.After(time.Now()) {
+			delete(m.Cache, hash)
+			evicted++
+		}
+	}
+	return evicted, nil
+}
+
+func (m *MockFileConverterRepo) EvictExpiredIdempotencyKeys() (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return 0, errors.New("failed to evict expired idempotency keys")
+	}
+	var evicted int64
+	for mapKey, record := range m.IdempotencyKeys {
+		if !record.ExpiresAt.After(time.Now()) {
+			delete(m.IdempotencyKeys, mapKey)
+			evicted++
+		}
+	}
+	return evicted, nil
+}
+
+func (m *MockFileConverterRepo) SaveIdempotencyKey(caller string, key string, requestHash string, jobId string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.saveIdempotencyKey(caller, key, requestHash, jobId)
+}
+
+func (m *MockFileConverterRepo) saveIdempotencyKey(caller string, key string, requestHash string, jobId string) (bool, error) {
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to save idempotency key %s", key))
+	}
+	if held := m.IdempotencyKeys[idempotencyMapKey(caller, key)]; held != nil && held.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	m.IdempotencyKeys[idempotencyMapKey(caller, key)] = &db.IdempotencyRecord{
+		Caller: caller,
+		Key: key,
+		RequestHash: requestHash,
+		JobId: jobId,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(db.IdempotencyKeyTTL),
+	}
+	return true, nil
+}
+
+func (m *MockFileConverterRepo) NewIdempotentRequest(id string, request *db.ConversionRequest, caller string,
+	key string, requestHash string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	claimed, err := m.saveIdempotencyKey(caller, key, requestHash, id)
+	if err != nil || !claimed {
+		return false, err
+	}
+	return m.newRequest(id, request)
+}
+
+func (m *MockFileConverterRepo) GetIdempotencyKey(caller string, key string) (*db.IdempotencyRecord, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return nil, errors.New(fmt.Sprintf("could not get idempotency key %s", key))
+	}
+	record := m.IdempotencyKeys[idempotencyMapKey(caller, key)]
+	if record == nil || !record.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (m *MockFileConverterRepo) DeleteIdempotencyKey(caller string, key string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to delete idempotency key %s", key))
+	}
+	delete(m.IdempotencyKeys, idempotencyMapKey(caller, key))
+	return true, nil
+}
+
+func (m *MockFileConverterRepo) NewWebhookDelivery(jobId string, url string, payload string,
+	claimedUntil time.Time) (int64, error) {
+	if !m.Success {
+		return 0, errors.New(fmt.Sprintf("failed to record webhook delivery for %s", jobId))
+	}
+	m.webhookLock.Lock()
+	defer m.webhookLock.Unlock()
+	id := int64(len(m.Webhooks) + 1)
+	m.Webhooks[id] = &db.WebhookDelivery{
+		Id: id,
+		JobId: jobId,
+		Url: url,
+		Payload: payload,
+		Status: enums.DELIVERY_PENDING.Name(),
+		CreatedAt: time.Now(),
+		NextAttempt: claimedUntil,
+	}
+	return id, nil
+}
+
+func (m *MockFileConverterRepo) RecordWebhookAttempt(id int64, status enums.DeliveryStatus, responseCode int,
+	message string, claimedUntil time.Time) (bool, error) {
+	m.webhookLock.Lock()
+	defer m.webhookLock.Unlock()
+	if !m.Success || m.Webhooks[id] == nil {
+		return false, errors.New(fmt.Sprintf("failed to record attempt for webhook delivery %d", id))
+	}
+	delivery := m.Webhooks[id]
+	delivery.Status = status.Name()
+	delivery.Attempts++
+	delivery.ResponseCode = responseCode
+	delivery.Error = message
+	delivery.LastAttempt = time.Now()
+	delivery.NextAttempt = claimedUntil
+	return true, nil
+}
+
+func (m *MockFileConverterRepo) ClaimUndeliveredWebhooks(jobId string, claimedUntil time.Time) ([]*db.WebhookDelivery, error) {
+	if !m.Success {
+		return nil, errors.New(fmt.Sprintf("could not claim webhook deliveries for %s", jobId))
+	}
+	return m.claimWebhooks(claimedUntil, 0, func(delivery *db.WebhookDelivery) bool {
+		return delivery.JobId == jobId && (delivery.Status == enums.DELIVERY_FAILED.Name() || abandoned(delivery))
+	}), nil
+}
+
+func (m *MockFileConverterRepo) ClaimAbandonedWebhooks(claimedUntil time.Time, limit int) ([]*db.WebhookDelivery, error) {
+	if !m.Success {
+		return nil, errors.New("could not claim abandoned webhook deliveries")
+	}
+	return m.claimWebhooks(claimedUntil, limit, abandoned), nil
+}
+
+// Returns true if the delivery is pending and no instance holds its claim
+func abandoned(delivery *db.WebhookDelivery) bool {
+	return delivery.Status == enums.DELIVERY_PENDING.Name() && !delivery.NextAttempt.After(time.Now())
+}
+
+/*
+ * Claims up to limit deliveries that match, oldest first, returning copies. A limit of zero claims every match
+ */
+func (m *MockFileConverterRepo) claimWebhooks(claimedUntil time.Time, limit int,
+	matches func(delivery *db.WebhookDelivery) bool) []*db.WebhookDelivery {
+	m.webhookLock.Lock()
+	defer m.webhookLock.Unlock()
+	var ids []int64
+	for id, delivery := range m.Webhooks {
+		if matches(delivery) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	var deliveries []*db.WebhookDelivery
+	for _, id := range ids {
+		delivery := m.Webhooks[id]
+		delivery.NextAttempt = claimedUntil
+		copied := *delivery
+		deliveries = append(deliveries, &copied)
+	}
+	return deliveries
+}
+
+/*
+ * Returns copies of every delivery recorded for the job, oldest first
+ */
+func (m *MockFileConverterRepo) WebhookDeliveries(jobId string) []*db.WebhookDelivery {
+	m.webhookLock.Lock()
+	defer m.webhookLock.Unlock()
+	var deliveries []*db.WebhookDelivery
+	for _, delivery := range m.Webhooks {
+		if delivery.JobId == jobId {
+			copied := *delivery
+			deliveries = append(deliveries, &copied)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id < deliveries[j].Id
+	})
+	return deliveries
+}
+
+func (m *MockFileConverterRepo) CreateApiKey(id string, name string, tenant string, keyHash string) (bool, error) {
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to create api key %s", id))
+	}
+	m.apiKeyLock.Lock()
+	defer m.apiKeyLock.Unlock()
+	m.ApiKeys[keyHash] = &db.ApiKey{
+		Id: id,
+		Name: name,
+		Tenant: tenant,
+		Enabled: true,
+		CreatedAt: time.Now(),
+	}
+	return true, nil
+}
+
+func (m *MockFileConverterRepo) GetApiKey(keyHash string) (*db.ApiKey, error) {
+	if !m.Success {
+		return nil, errors.New("could not get api key")
+	}
+	m.apiKeyLock.Lock()
+	defer m.apiKeyLock.Unlock()
+	key := m.ApiKeys[keyHash]
+	if key == nil {
+		return nil, nil
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (m *MockFileConverterRepo) SetApiKeyEnabled(id string, enabled bool) (bool, error) {
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to update api key %s", id))
+	}
+	m.apiKeyLock.Lock()
+	defer m.apiKeyLock.Unlock()
+	for _, key := range m.ApiKeys {
+		if key.Id == id {
+			key.Enabled = enabled
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockFileConverterRepo) RecordApiKeyUse(id string) (bool, error) {
+	if !m.Success {
+		return false, errors.New(fmt.Sprintf("failed to record use of api key %s", id))
+	}
+	m.apiKeyLock.Lock()
+	defer m.apiKeyLock.Unlock()
+	for _, key := range m.ApiKeys {
+		if key.Id == id {
+			key.LastUsed = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
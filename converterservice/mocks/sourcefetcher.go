@@ -0,0 +1,59 @@
+// Mocks SourceFetcher
+package mocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
+	"io/ioutil"
+	"sync"
+)
+
+type MockSourceFetcher struct {
+	Success bool
+	// Blocks each fetch until its context is done
+	Hang    bool
+	Fetches int
+	// The source headers of the last fetch
+	SourceHeaders fileconverter.SourceHeaders
+	// Guards Fetches and SourceHeaders, which are written by running jobs
+	lock    sync.Mutex
+}
+
+func NewMockSourceFetcher() *MockSourceFetcher {
+	return &MockSourceFetcher{
+		Success: true,
+	}
+}
+
+// Returns the number of fetches and the source headers of the last one
+func (m *MockSourceFetcher) LastFetch() (int, fileconverter.SourceHeaders) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Fetches, m.SourceHeaders
+}
+
+// Writes the source URL to the file in place of the source, and uses it as the digest
+func (m *MockSourceFetcher) Fetch(ctx context.Context, req *fileconverter.FileConversionRequest,
+	path string) (*fileconverter.FetchedSource, error) {
+	m.lock.Lock()
+	m.Fetches++
+	m.SourceHeaders = req.SourceHeaders
+	m.lock.Unlock()
+	if m.Hang {
+		<- ctx.Done()
+		return nil, ctx.Err()
+	}
+	if !m.Success {
+		return nil, errors.New(fmt.Sprintf("failed to fetch source for %s", req.Id))
+	}
+	if err := ioutil.WriteFile(path, []byte(req.SourceUrl), 0600); err != nil {
+		return nil, err
+	}
+	return &fileconverter.FetchedSource{
+		Path: path,
+		Size: int64(len(req.SourceUrl)),
+		Digest: []byte(req.SourceUrl),
+	}, nil
+}
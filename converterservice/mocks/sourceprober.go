@@ -0,0 +1,31 @@
+// Mocks SourceProber
+package mocks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
+	"time"
+)
+
+type MockSourceProber struct {
+	Success        bool
+	// The duration reported for every source
+	SourceDuration time.Duration
+	Probes         int
+}
+
+func NewMockSourceProber(duration time.Duration) *MockSourceProber {
+	return &MockSourceProber{
+		Success: true,
+		SourceDuration: duration,
+	}
+}
+
+func (m *MockSourceProber) Duration(req *fileconverter.FileConversionRequest, path string) (time.Duration, error) {
+	m.Probes++
+	if m.Success {
+		return m.SourceDuration, nil
+	}
+	return 0, errors.New(fmt.Sprintf("failed to probe source for %s", req.Id))
+}
@@ -3,9 +3,12 @@ package mocks
 import (
 	"errors"
 	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"log"
 	"os"
 	"strings"
+	"sync"
 )
 
 type S3FileUploaderMock struct {
@@ -13,6 +16,14 @@ type S3FileUploaderMock struct {
 	endpoint string
 	region   string
 	Success  bool
+	// The number of uploads that fail before they start succeeding
+	UploadFailures int
+	Uploads        int
+	// The number of copies that fail before they start succeeding
+	CopyFailures   int
+	Copies         int
+	// Guards the failure and call counts, which are updated by running jobs
+	lock           sync.Mutex
 }
 
 type LocalFileUploaderMock struct {
@@ -40,39 +51,69 @@ func NewMockLocalFileUploader(region string, endpoint string, bucket string) *Lo
 	}
 }
 
-func Upload(id string, encoding string, file *os.File) error {
-	log.Printf("uploading id %s...\n", id)
+func Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error {
+	log.Printf("uploading id %s...\n", fileconverter.ObjectKey(tenant, id))
 	return nil
 }
 
-func SignedUrl(region string, endpoint string, bucket string, id string) string {
-	return fmt.Sprintf("http://%s.%s/%s/%s", region, endpoint, bucket, id)
+func SignedUrl(region string, endpoint string, bucket string, tenant string, id string) string {
+	return fmt.Sprintf("http://%s.%s/%s/%s", region, endpoint, bucket, fileconverter.ObjectKey(tenant, id))
 }
 
-func (m *S3FileUploaderMock) Upload(id string, encoding string, file *os.File) error {
+func (m *S3FileUploaderMock) Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error {
+	m.lock.Lock()
+	m.Uploads++
+	failed := m.UploadFailures > 0
+	if failed {
+		m.UploadFailures--
+	}
+	m.lock.Unlock()
+	if failed {
+		return errors.New(fmt.Sprintf("connection reset uploading %s", id))
+	}
 	if m.Success {
-		return Upload(id, encoding, file)
+		return Upload(tenant, id, encoding, file)
 	}
 	return errors.New(fmt.Sprintf("failed to upload %s", id))
 }
 
-func (m *S3FileUploaderMock) SignedUrl(id string) (string, error) {
+func (m *S3FileUploaderMock) Copy(tenant string, fromId string, toId string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Success && m.CopyFailures == 0 {
+		m.Copies++
+		return nil
+	}
+	if m.CopyFailures > 0 {
+		m.CopyFailures--
+	}
+	return errors.New(fmt.Sprintf("failed to copy %s to %s", fromId, toId))
+}
+
+func (m *S3FileUploaderMock) SignedUrl(tenant string, id string) (string, error) {
 	if m.Success {
-		return SignedUrl(m.region, m.endpoint, m.bucket, id), nil
+		return SignedUrl(m.region, m.endpoint, m.bucket, tenant, id), nil
 	}
 	return "", errors.New(fmt.Sprintf("failed to get signed URL for %s", id))
 }
 
-func (m *LocalFileUploaderMock) Upload(id string, encoding string, file *os.File) error {
+func (m *LocalFileUploaderMock) Upload(tenant string, id string, encoding enums.Encoding, file *os.File) error {
 	if m.Success {
-		return Upload(id, encoding, file)
+		return Upload(tenant, id, encoding, file)
 	}
 	return errors.New(fmt.Sprintf("failed to upload %s", id))
 }
 
-func (m *LocalFileUploaderMock) SignedUrl(id string) (string, error) {
+func (m *LocalFileUploaderMock) Copy(tenant string, fromId string, toId string) error {
+	if m.Success {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("failed to copy %s to %s", fromId, toId))
+}
+
+func (m *LocalFileUploaderMock) SignedUrl(tenant string, id string) (string, error) {
 	if m.Success {
-		url := SignedUrl(m.region, m.endpoint, m.bucket, id)
+		url := SignedUrl(m.region, m.endpoint, m.bucket, tenant, id)
 		dockerNetworkName := "s3_local"
 		localhost := "localhost"
 		url = strings.Replace(url, dockerNetworkName, localhost, 1)
@@ -0,0 +1,128 @@
+// Per-client limits on ConvertFile, so that one caller cannot fill the queue and starve the others.
+// Clients are the callers' API keys, since client ids sent in metadata are not authenticated, and each key
+// of a tenant is limited separately. Requests without a key all count as one client
+package converterservice
+
+import (
+	"fmt"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The metadata key holding the number of seconds a rejected caller should wait before retrying
+const retryAfterMetadata = "retry-after"
+
+// How long a caller at its active job quota is asked to wait, since it is not known when its jobs will finish
+const quotaRetryAfter = 5 * time.Second
+
+// The rate at which each client may create jobs. Buckets are kept in memory by each instance,
+// so behind N API instances a client may create up to N times as many jobs
+type RateLimit struct {
+	// The sustained number of requests allowed per second, or zero for no limit
+	PerSecond float64
+	// The number of requests a client may make at once after being idle
+	Burst     int
+}
+
+// A token bucket for each client, refilled continuously at the limit's rate
+type rateLimiter struct {
+	limit   RateLimit
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{
+		limit: limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+/*
+ * Takes a token from the client's bucket. Returns false and how long until a token is available
+ * when the bucket is empty
+ */
+func (r *rateLimiter) allow(client string) (bool, time.Duration) {
+	if r.limit.PerSecond <= 0 {
+		return true, 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	burst := float64(r.limit.Burst)
+	bucket := r.buckets[client]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		r.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*r.limit.PerSecond)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := (1 - bucket.tokens) / r.limit.PerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+/*
+ * Rejects the request if the client has used up its rate limit
+ */
+func (s *ConverterServer) checkRateLimit(ctx context.Context, client string) error {
+	allowed, retryAfter := s.rateLimiter.allow(client)
+	if allowed {
+		return nil
+	}
+	return resourceExhausted(ctx, retryAfter, "rate limit exceeded")
+}
+
+/*
+ * Rejects the request if the client already has as many queued or running jobs as it is allowed.
+ * Jobs are counted in the database, but concurrent requests may briefly take a client over its quota
+ */
+func (s *ConverterServer) checkActiveJobQuota(ctx context.Context, client string) error {
+	if s.config.MaxActiveJobs <= 0 {
+		return nil
+	}
+	active, err := s.repo.CountActiveConversions(client)
+	if err != nil {
+		log.Printf("failed to count active jobs, encountered %v", err)
+		return status.Error(codes.Internal, "an internal error occurred")
+	}
+	if active >= s.config.MaxActiveJobs {
+		return resourceExhausted(ctx, quotaRetryAfter,
+			fmt.Sprintf("too many active jobs, at most %d may be queued or running", s.config.MaxActiveJobs))
+	}
+	return nil
+}
+
+/*
+ * Returns a RESOURCE_EXHAUSTED error, sending the whole number of seconds to wait as retry-after metadata
+ */
+func resourceExhausted(ctx context.Context, retryAfter time.Duration, message string) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	header := metadata.Pairs(retryAfterMetadata, strconv.FormatInt(seconds, 10))
+	if err := grpc.SetHeader(ctx, header); err != nil {
+		log.Printf("failed to set %s header, encountered %v", retryAfterMetadata, err)
+	}
+	return status.Errorf(codes.ResourceExhausted, "%s, retry after %d second(s)", message, seconds)
+}
@@ -0,0 +1,110 @@
+package converterservice_test
+
+import (
+	"context"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
+	"github.com/reggiemcdonald/grpc-audio-converter/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// Records the headers a handler sets, standing in for the stream of a real gRPC call
+type testTransportStream struct {
+	header metadata.MD
+}
+
+func (s *testTransportStream) Method() string {
+	return "/ConverterService/ConvertFile"
+}
+
+func (s *testTransportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *testTransportStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *testTransportStream) SetTrailer(md metadata.MD) error {
+	return nil
+}
+
+func TestConverterServer_ConvertFile_RateLimit(t *testing.T) {
+	config := testingConfiguration()
+	serverConfig := toServerConfiguration(config)
+	serverConfig.RateLimit = converterservice.RateLimit{PerSecond: 0.01, Burst: 2}
+	server := converterservice.NewWithConfiguration(serverConfig)
+	authenticator := converterservice.NewAuthenticator(config.Db)
+	_, otherKey, err := converterservice.CreateApiKey(config.Db, "other", "other-tenant")
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := server.ConvertFile(context.TODO(), testGrpcRequest)
+		assert.Nil(t, err, "requests within the burst should be accepted")
+	}
+	stream := &testTransportStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.TODO(), stream)
+	res, err := server.ConvertFile(ctx, testGrpcRequest)
+	assert.Nil(t, res)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"100"}, stream.header.Get("retry-after"), "should wait for the next token")
+	convert := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.ConvertFile(ctx, req.(*pb.ConvertFileRequest))
+	}
+	_, err = authenticator.UnaryInterceptor(withApiKey(otherKey), testGrpcRequest, &grpc.UnaryServerInfo{}, convert)
+	assert.Nil(t, err, "other clients should have their own limit")
+}
+
+func TestConverterServer_ConvertFile_ActiveJobQuota(t *testing.T) {
+	config := testingConfiguration()
+	config.ExecutableFactory.Hang = true
+	serverConfig := toServerConfiguration(config)
+	serverConfig.MaxActiveJobs = 2
+	server := converterservice.NewWithConfiguration(serverConfig)
+	defer server.Shutdown()
+	for i := 0; i < 2; i++ {
+		_, err := server.ConvertFile(context.TODO(), testGrpcRequest)
+		assert.Nil(t, err, "requests within the quota should be accepted")
+	}
+	stream := &testTransportStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.TODO(), stream)
+	req := &pb.ConvertFileRequest{
+		SourceUrl: testGrpcRequest.SourceUrl,
+		SourceEncoding: testGrpcRequest.SourceEncoding,
+		DestEncoding: testGrpcRequest.DestEncoding,
+		IdempotencyKey: "test-key",
+	}
+	_, err := server.ConvertFile(ctx, req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.NotEmpty(t, stream.header.Get("retry-after"))
+	assert.Len(t, config.Db.Data, 2, "should not have created a job over the quota")
+	assert.Empty(t, config.Db.IdempotencyKeys, "should release the idempotency key of a rejected request")
+}
+
+func TestConverterServer_ConvertFile_LimitsPerKey(t *testing.T) {
+	config := testingConfiguration()
+	config.ExecutableFactory.Hang = true
+	serverConfig := toServerConfiguration(config)
+	serverConfig.RateLimit = converterservice.RateLimit{PerSecond: 0.01, Burst: 1}
+	serverConfig.MaxActiveJobs = 1
+	server := converterservice.NewWithConfiguration(serverConfig)
+	defer server.Shutdown()
+	authenticator := converterservice.NewAuthenticator(config.Db)
+	convert := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.ConvertFile(ctx, req.(*pb.ConvertFileRequest))
+	}
+	_, firstKey, err := converterservice.CreateApiKey(config.Db, "first", "shared-tenant")
+	assert.Nil(t, err)
+	_, secondKey, err := converterservice.CreateApiKey(config.Db, "second", "shared-tenant")
+	assert.Nil(t, err)
+	_, err = authenticator.UnaryInterceptor(withApiKey(firstKey), testGrpcRequest, &grpc.UnaryServerInfo{}, convert)
+	assert.Nil(t, err)
+	_, err = authenticator.UnaryInterceptor(withApiKey(firstKey), testGrpcRequest, &grpc.UnaryServerInfo{}, convert)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "the first key should be at its limits")
+	_, err = authenticator.UnaryInterceptor(withApiKey(secondKey), testGrpcRequest, &grpc.UnaryServerInfo{}, convert)
+	assert.Nil(t, err, "another key of the same tenant should have its own limits")
+}
@@ -0,0 +1,72 @@
+// Recovery of jobs left unfinished by a previous run of the service
+package converterservice
+
+import (
+	"fmt"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
+	"log"
+	"time"
+)
+
+// How often jobs that did not fit in the queue during recovery are enqueued again
+const recoveryRetryInterval = time.Second
+
+/*
+ * Re-enqueues the jobs that were queued, or converting on this instance, when the service last stopped,
+ * oldest first. Jobs that were converting are returned to QUEUED, and jobs whose request can no longer be run
+ * are failed. Jobs that do not fit in the queue are enqueued again as it drains
+ */
+func (s *ConverterServer) recoverJobs() {
+	jobs, err := s.repo.GetUnfinishedConversions(s.owner)
+	if err != nil {
+		log.Printf("failed to get unfinished jobs, encountered %v", err)
+		return
+	}
+	var overflow []FileConverterJob
+	for _, job := range jobs {
+		next, err := s.jobFromRecord(job)
+		if err != nil {
+			s.failUnrunnable(job, fmt.Sprintf("could not recover job: %v", err))
+			continue
+		}
+		if job.Status == enums.CONVERTING.Name() {
+			if requeued, err := s.repo.RequeueConversion(job.Id); err != nil {
+				log.Printf("failed to requeue %s, encountered %v", job.Id, err)
+			} else if requeued {
+				events.Publish(s.events, job.Id, enums.CONVERTING, enums.QUEUED)
+			}
+		}
+		if len(overflow) > 0 || s.queue.Enqueue(next) != nil {
+			overflow = append(overflow, next)
+		}
+	}
+	if len(jobs) > 0 {
+		log.Printf("recovered %d of %d unfinished jobs, %d are waiting for room in the queue",
+			len(jobs) - len(overflow), len(jobs), len(overflow))
+	}
+	if len(overflow) > 0 {
+		go s.enqueueOverflow(overflow, recoveryRetryInterval)
+	}
+}
+
+/*
+ * Enqueues the recovered jobs in order as room frees up in the queue, giving up once the queue is stopped
+ */
+func (s *ConverterServer) enqueueOverflow(jobs []FileConverterJob, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.queue.Running() {
+			log.Printf("queue stopped with %d recovered jobs still waiting, leaving them queued", len(jobs))
+			return
+		}
+		for len(jobs) > 0 && s.queue.Enqueue(jobs[0]) == nil {
+			jobs = jobs[1:]
+		}
+		if len(jobs) == 0 {
+			log.Println("enqueued every recovered job")
+			return
+		}
+	}
+}
@@ -2,5 +2,76 @@ CREATE TABLE convert_jobs (
     id varchar(50) PRIMARY KEY,
     status varchar(30),
     curr_url text,
-    last_updated timestamp
-);
\ No newline at end of file
+    last_updated timestamp,
+    error_code varchar(30),
+    error_message text,
+    attempts integer DEFAULT 0,
+    progress_percent double precision DEFAULT 0,
+    processed_ms bigint DEFAULT 0,
+    speed double precision DEFAULT 0,
+    source_url text,
+    source_encoding varchar(10),
+    dest_encoding varchar(10),
+    priority varchar(10),
+    timeout_seconds integer DEFAULT 0,
+    sample_rate integer DEFAULT 0,
+    channels integer DEFAULT 0,
+    callback_url text,
+    tenant varchar(100) NOT NULL DEFAULT '',
+    caller varchar(100) NOT NULL DEFAULT '',
+    source_headers bytea,
+    lease_owner text,
+    lease_expires_at timestamp
+);
+
+CREATE INDEX convert_jobs_unfinished ON convert_jobs (last_updated) WHERE status IN ('QUEUED', 'CONVERTING');
+
+CREATE INDEX convert_jobs_active ON convert_jobs (caller) WHERE status IN ('QUEUED', 'CONVERTING');
+
+CREATE INDEX convert_jobs_leases ON convert_jobs (lease_expires_at) WHERE status = 'CONVERTING';
+
+CREATE TABLE conversion_cache (
+    hash varchar(64) PRIMARY KEY,
+    object_key varchar(50),
+    expires_at timestamp
+);
+
+CREATE TABLE idempotency_keys (
+    caller varchar(100),
+    key varchar(100),
+    request_hash varchar(64),
+    job_id varchar(50),
+    created_at timestamp,
+    expires_at timestamp,
+    PRIMARY KEY (caller, key)
+);
+
+CREATE INDEX idempotency_keys_expiry ON idempotency_keys (expires_at);
+
+CREATE TABLE webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    job_id varchar(50),
+    url text,
+    payload text,
+    status varchar(10),
+    attempts integer DEFAULT 0,
+    response_code integer,
+    error text,
+    created_at timestamp,
+    last_attempt timestamp,
+    next_attempt timestamp
+);
+
+CREATE INDEX webhook_deliveries_job ON webhook_deliveries (job_id);
+
+CREATE INDEX webhook_deliveries_pending ON webhook_deliveries (next_attempt) WHERE status = 'PENDING';
+
+CREATE TABLE api_keys (
+    id varchar(50) PRIMARY KEY,
+    name text,
+    tenant varchar(100) NOT NULL,
+    key_hash varchar(64) UNIQUE,
+    enabled boolean DEFAULT TRUE,
+    created_at timestamp,
+    last_used timestamp
+);
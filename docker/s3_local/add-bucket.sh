@@ -4,4 +4,7 @@ awslocal s3api create-bucket \
         --bucket converter-service-source \
         --acl public-read-write >/dev/null
 echo "converter-service-source created"
+awslocal s3api create-bucket \
+        --bucket converter-service-input >/dev/null
+echo "converter-service-input created"
 
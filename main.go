@@ -2,13 +2,19 @@
 package main
 
 import (
+	"encoding/base64"
+	"flag"
+	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice"
 	db "github.com/reggiemcdonald/grpc-audio-converter/converterservice/db"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/events"
 	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/fileconverter"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -44,6 +50,10 @@ func getEnvAsIntWithDefault(key string, def int) int {
 	if stringValue == "" {
 		return def
 	}
+	return parseIntValue(key, stringValue)
+}
+
+func parseIntValue(key string, stringValue string) int {
 	numericValue, err := strconv.Atoi(stringValue)
 	if err != nil {
 		log.Fatalf("invalid env variable %s, encountered %v", key, err)
@@ -51,25 +61,181 @@ func getEnvAsIntWithDefault(key string, def int) int {
 	return numericValue
 }
 
+/*
+ * Returns a comma separated list of key=value pairs from the environment variable, or nil when it is unset
+ */
+func getEnvAsMap(key string) map[string]string {
+	stringValue := getEnvWithDefault(key, "")
+	if stringValue == "" {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, pair := range strings.Split(stringValue, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("invalid env variable %s, expected key=value pairs separated by commas", key)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return values
+}
+
+/*
+ * Returns a comma separated list from the environment variable, or nil when it is unset
+ */
+func getEnvAsList(key string) []string {
+	stringValue := getEnvWithDefault(key, "")
+	if stringValue == "" {
+		return nil
+	}
+	var values []string
+	for _, value := range strings.Split(stringValue, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+/*
+ * Returns the cipher for the source headers stored with jobs, or nil when SOURCE_HEADERS_KEY is not set.
+ * The key is 32 bytes encoded as base64, and must be the same for API servers and workers. SOURCE_HEADERS_OLD_KEYS
+ * are comma separated keys that are only used to open headers sealed before the key was rotated
+ */
+func sourceHeaderCipher() *fileconverter.HeaderCipher {
+	encoded := getEnvWithDefault("SOURCE_HEADERS_KEY", "")
+	if encoded == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Fatalf("invalid env variable SOURCE_HEADERS_KEY, expected base64")
+	}
+	var oldKeys [][]byte
+	for _, encoded := range strings.Split(getEnvWithDefault("SOURCE_HEADERS_OLD_KEYS", ""), ",") {
+		if encoded = strings.TrimSpace(encoded); encoded == "" {
+			continue
+		}
+		oldKey, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			log.Fatalf("invalid env variable SOURCE_HEADERS_OLD_KEYS, expected comma separated base64")
+		}
+		oldKeys = append(oldKeys, oldKey)
+	}
+	cipher, err := fileconverter.NewHeaderCipher(key, oldKeys...)
+	if err != nil {
+		log.Fatalf("invalid env variable SOURCE_HEADERS_KEY, encountered %v", err)
+	}
+	return cipher
+}
+
+/*
+ * Returns the service's source limits, and the limits of each tenant that overrides them.
+ * Tenant limits are comma separated tenant=value pairs
+ */
+func inputLimitsConfiguration() (fileconverter.InputLimits, map[string]fileconverter.InputLimits) {
+	global := fileconverter.InputLimits{
+		MaxBytes:    int64(getEnvAsIntWithDefault("MAX_SOURCE_BYTES", 1 << 30)),
+		MaxDuration: time.Duration(getEnvAsIntWithDefault("MAX_SOURCE_DURATION_SECONDS", 3 * 60 * 60)) * time.Second,
+	}
+	tenants := make(map[string]fileconverter.InputLimits)
+	for tenant, value := range getEnvAsMap("TENANT_MAX_SOURCE_BYTES") {
+		limits := tenants[tenant]
+		limits.MaxBytes = int64(parseIntValue("TENANT_MAX_SOURCE_BYTES", value))
+		tenants[tenant] = limits
+	}
+	for tenant, value := range getEnvAsMap("TENANT_MAX_SOURCE_DURATION_SECONDS") {
+		limits := tenants[tenant]
+		limits.MaxDuration = time.Duration(parseIntValue("TENANT_MAX_SOURCE_DURATION_SECONDS", value)) * time.Second
+		tenants[tenant] = limits
+	}
+	return global, tenants
+}
+
 /*
  * Returns the server configuration from environment variables
  */
-func defaultConfiguration() *converterservice.ConverterServerConfig{
+func defaultConfiguration(mode converterservice.RunMode) *converterservice.ConverterServerConfig{
 	concurrency := getEnvAsIntWithDefault("CONCURRENCY", 5)
 	poolSize := getEnvAsIntWithDefault("QUEUE_SIZE", 100)
-	port := getRequiredEnvAsInt("PORT")
+	jobTimeout := time.Duration(getEnvAsIntWithDefault("JOB_TIMEOUT_SECONDS", 1800)) * time.Second
+	progressInterval := time.Duration(getEnvAsIntWithDefault("PROGRESS_INTERVAL_MS", 2000)) * time.Millisecond
+	shutdownGracePeriod := time.Duration(getEnvAsIntWithDefault("SHUTDOWN_GRACE_PERIOD_SECONDS", 30)) * time.Second
+	defaultBackend := converterservice.MemoryQueue
+	if mode != converterservice.AllMode {
+		defaultBackend = converterservice.PostgresQueue
+	}
+	queueBackend := converterservice.QueueBackend(getEnvWithDefault("QUEUE_BACKEND", string(defaultBackend)))
+	if queueBackend != converterservice.MemoryQueue && queueBackend != converterservice.PostgresQueue {
+		log.Fatalf("invalid env variable QUEUE_BACKEND, expected %s or %s", converterservice.MemoryQueue,
+			converterservice.PostgresQueue)
+	}
+	if mode != converterservice.AllMode && queueBackend != converterservice.PostgresQueue {
+		log.Fatalf("%s mode requires QUEUE_BACKEND=%s", mode, converterservice.PostgresQueue)
+	}
+	starvationLimit := getEnvAsIntWithDefault("STARVATION_LIMIT", 10)
+	leaseTimeout := time.Duration(getEnvAsIntWithDefault("LEASE_TIMEOUT_SECONDS", 60)) * time.Second
+	pollInterval := time.Duration(getEnvAsIntWithDefault("POLL_INTERVAL_MS", 1000)) * time.Millisecond
+	retryPolicy := fileconverter.RetryPolicy{
+		MaxAttempts:    getEnvAsIntWithDefault("MAX_ATTEMPTS", 3),
+		InitialBackoff: time.Duration(getEnvAsIntWithDefault("RETRY_BACKOFF_MS", 1000)) * time.Millisecond,
+		MaxBackoff:     time.Duration(getEnvAsIntWithDefault("MAX_RETRY_BACKOFF_MS", 30000)) * time.Millisecond,
+	}
+	var port int
+	if mode.ServesApi() {
+		port = getRequiredEnvAsInt("PORT")
+	}
 	bucketName := getRequiredEnv("BUCKET_NAME")
+	tenantBuckets := getEnvAsMap("TENANT_BUCKETS")
 	region := getRequiredEnv("REGION")
 	s3endpoint := getEnvWithDefault("S3_ENDPOINT", "")
 	isDev := getEnvWithDefault("DEV", "false") == "true"
 	dbUser := getRequiredEnv("POSTGRES_USER")
 	dbPass := getRequiredEnv("POSTGRES_PASSWORD")
-	repo := db.NewFromCredentials(dbUser, dbPass)
+	conn := db.Connect(dbUser, dbPass)
+	repo := db.NewFromConnection(conn)
+	var publisher events.EventPublisher
+	if channel := getEnvWithDefault("EVENT_CHANNEL", events.DefaultChannel); channel != "" {
+		publisher = events.NewPostgresEventPublisher(conn, channel)
+	}
+	sourcePolicy := &fileconverter.SourcePolicy{
+		Schemes: getEnvAsList("SOURCE_URL_SCHEMES"),
+		Hosts: getEnvAsList("SOURCE_URL_HOSTS"),
+		AllowPrivateAddresses: getEnvWithDefault("ALLOW_PRIVATE_SOURCES", "false") == "true",
+		Buckets: getEnvAsList("SOURCE_BUCKETS"),
+	}
+	outputBuckets := []string{bucketName}
+	for _, bucket := range tenantBuckets {
+		outputBuckets = append(outputBuckets, bucket)
+	}
+	if err := sourcePolicy.CheckOutputBuckets(outputBuckets...); err != nil {
+		log.Fatalf("SOURCE_BUCKETS must not include BUCKET_NAME or TENANT_BUCKETS: %v", err)
+	}
+	var webhooks fileconverter.WebhookDispatcher
+	if secret := getEnvWithDefault("WEBHOOK_SECRET", ""); secret != "" {
+		webhooks = fileconverter.NewWebhookDispatcher(repo, secret, fileconverter.RetryPolicy{
+			MaxAttempts:    getEnvAsIntWithDefault("WEBHOOK_MAX_ATTEMPTS", 5),
+			InitialBackoff: time.Duration(getEnvAsIntWithDefault("WEBHOOK_BACKOFF_MS", 1000)) * time.Millisecond,
+			MaxBackoff:     time.Duration(getEnvAsIntWithDefault("WEBHOOK_MAX_BACKOFF_MS", 60000)) * time.Millisecond,
+		}, sourcePolicy)
+	}
+	requireApiKey := getEnvWithDefault("REQUIRE_API_KEY", "true") != "false"
+	// Without API keys every request counts as the same client, so limits are only on by default with keys
+	defaultRatePerMinute, defaultMaxActiveJobs := 0, 0
+	if requireApiKey {
+		defaultRatePerMinute, defaultMaxActiveJobs = 60, 20
+	}
+	rateLimit := converterservice.RateLimit{
+		PerSecond: float64(getEnvAsIntWithDefault("RATE_LIMIT_PER_MINUTE", defaultRatePerMinute)) / 60,
+		Burst:     getEnvAsIntWithDefault("RATE_LIMIT_BURST", 10),
+	}
+	maxActiveJobs := getEnvAsIntWithDefault("MAX_ACTIVE_JOBS", defaultMaxActiveJobs)
+	inputLimits, tenantInputLimits := inputLimitsConfiguration()
 	var s3Service fileconverter.FileUploader
 	if isDev {
-		s3Service = fileconverter.NewLocalFileUploader(region, s3endpoint, bucketName)
+		s3Service = fileconverter.NewLocalFileUploader(region, s3endpoint, bucketName, tenantBuckets)
 	} else {
-		s3Service = fileconverter.NewS3FileUploader(region, s3endpoint, bucketName)
+		s3Service = fileconverter.NewS3FileUploader(region, s3endpoint, bucketName, tenantBuckets)
 	}
 	return &converterservice.ConverterServerConfig{
 		Concurrency: concurrency,
@@ -77,13 +243,94 @@ func defaultConfiguration() *converterservice.ConverterServerConfig{
 		Port:        port,
 		Db:          repo,
 		S3service:   s3Service,
+		StarvationLimit: starvationLimit,
+		JobTimeout: jobTimeout,
+		Retry: retryPolicy,
+		ProgressInterval: progressInterval,
+		ShutdownGracePeriod: shutdownGracePeriod,
+		QueueBackend: queueBackend,
+		LeaseTimeout: leaseTimeout,
+		PollInterval: pollInterval,
+		Mode: mode,
+		InstanceId: os.Getenv("INSTANCE_ID"),
+		Webhooks: webhooks,
+		Events: publisher,
+		RequireApiKey: requireApiKey,
+		RateLimit: rateLimit,
+		MaxActiveJobs: maxActiveJobs,
+		InputLimits: inputLimits,
+		TenantInputLimits: tenantInputLimits,
+		SourcePolicy: sourcePolicy,
+		SourceHeaderCipher: sourceHeaderCipher(),
 	}
 }
 
+/*
+ * Returns the run mode from the -mode flag, falling back to the MODE environment variable
+ */
+func runMode(flagValue string) converterservice.RunMode {
+	mode := flagValue
+	if mode == "" {
+		mode = getEnvWithDefault("MODE", string(converterservice.AllMode))
+	}
+	switch runMode := converterservice.RunMode(mode); runMode {
+	case converterservice.AllMode, converterservice.ApiMode, converterservice.WorkerMode:
+		return runMode
+	default:
+		log.Fatalf("invalid mode %s, expected all, api or worker", mode)
+		return ""
+	}
+}
+
+/*
+ * Creates, enables or disables an API key. A created key is printed, since it cannot be recovered later.
+ * Created keys belong to the tenant, or to a tenant named after the key when none is given
+ */
+func manageApiKeys(create string, tenant string, enable string, disable string) {
+	repo := db.NewFromConnection(db.Connect(getRequiredEnv("POSTGRES_USER"), getRequiredEnv("POSTGRES_PASSWORD")))
+	if create != "" {
+		if tenant == "" {
+			tenant = create
+		}
+		id, key, err := converterservice.CreateApiKey(repo, create, tenant)
+		if err != nil {
+			log.Fatalf("failed to create api key, encountered %v", err)
+		}
+		fmt.Printf("id: %s\ntenant: %s\nkey: %s\n", id, tenant, key)
+	}
+	if enable != "" {
+		setApiKeyEnabled(repo, enable, true)
+	}
+	if disable != "" {
+		setApiKeyEnabled(repo, disable, false)
+	}
+}
+
+func setApiKeyEnabled(repo db.FileConverterRepository, id string, enabled bool) {
+	updated, err := repo.SetApiKeyEnabled(id, enabled)
+	if err != nil {
+		log.Fatalf("failed to update api key %s, encountered %v", id, err)
+	}
+	if !updated {
+		log.Fatalf("no api key has id %s", id)
+	}
+	log.Printf("api key %s enabled: %t", id, enabled)
+}
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("failed to load environment config %v", err)
 	}
-	server := converterservice.NewWithConfiguration(defaultConfiguration())
+	mode := flag.String("mode", "", "which parts of the service to run: all, api or worker. Defaults to MODE")
+	createApiKey := flag.String("create-api-key", "", "creates an API key with the given name, prints it and exits")
+	tenant := flag.String("tenant", "", "the tenant of the API key created by -create-api-key. Defaults to its name")
+	enableApiKey := flag.String("enable-api-key", "", "enables the API key with the given id and exits")
+	disableApiKey := flag.String("disable-api-key", "", "disables the API key with the given id and exits")
+	flag.Parse()
+	if *createApiKey != "" || *enableApiKey != "" || *disableApiKey != "" {
+		manageApiKeys(*createApiKey, *tenant, *enableApiKey, *disableApiKey)
+		return
+	}
+	server := converterservice.NewWithConfiguration(defaultConfiguration(runMode(*mode)))
 	converterservice.Start(server)
 }
@@ -1,34 +1,102 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/reggiemcdonald/grpc-audio-converter/converterservice/enums"
 	"github.com/reggiemcdonald/grpc-audio-converter/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 )
 
 func stringToEncoding(encoding string) (int, error) {
-	switch enc := strings.ToUpper(encoding); enc {
-	case "WAV":
+	enc, err := enums.EncodingFromName(encoding)
+	if err != nil {
+		return -1,errors.New("invalid encoding specified")
+	}
+	return enc.Value(),nil
+}
+
+func stringToPriority(priority string) (int, error) {
+	switch p := strings.ToUpper(priority); p {
+	case "", "NORMAL":
 		return 0,nil
-	case "MP4":
+	case "LOW":
 		return 1,nil
-	case "MP3":
+	case "HIGH":
 		return 2,nil
-	case "FLAC":
-		return 3,nil
 	default:
-		return -1,errors.New("invalid encoding specified")
+		return -1,errors.New("invalid priority specified")
+	}
+}
+
+// The query response as it has always been returned, with the names of its enums alongside their values
+type queryResponse struct {
+	*pb.ConvertFileQueryResponse
+	StatusName    string `json:"statusName"`
+	ErrorCodeName string `json:"errorCodeName,omitempty"`
+}
+
+/*
+ * Formats the query response, keeping its fields and adding the names of its enums
+ */
+func queryResponseToJSON(res *pb.ConvertFileQueryResponse) queryResponse {
+	response := *res
+	if response.Status == pb.ConvertFileQueryResponse_QUEUED {
+		response.Progress = nil
+	}
+	formatted := queryResponse{ConvertFileQueryResponse: &response, StatusName: res.Status.String()}
+	if res.Status == pb.ConvertFileQueryResponse_FAILED {
+		formatted.ErrorCodeName = res.ErrorCode.String()
+	}
+	return formatted
+}
+
+/*
+ * Formats a supported format with its encoding name in place of its value
+ */
+func supportedFormatToJSON(format *pb.SupportedFormat) gin.H {
+	return gin.H{
+		"name":        format.Name,
+		"extension":   format.Extension,
+		"mimeType":    format.MimeType,
+		"sampleRates": format.SampleRates,
+		"minBitrate":  format.MinBitrate,
+		"maxBitrate":  format.MaxBitrate,
+		"maxChannels": format.MaxChannels,
+		"source":      format.Source,
+		"destination": format.Destination,
+		"options":     format.Options,
 	}
 }
 
 type body struct {
-	SourceUrl string `json:"sourceUrl"`
+	SourceUrl     string            `json:"sourceUrl"`
+	CallbackUrl   string            `json:"callbackUrl"`
+	SourceHeaders map[string]string `json:"sourceHeaders"`
+}
+
+// Sends the REST interface's API key with every call to the converter service
+type apiKeyCredentials struct {
+	key string
+}
+
+func (a apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + a.key}, nil
+}
+
+// The converter service is reached over the internal network without TLS
+func (a apiKeyCredentials) RequireTransportSecurity() bool {
+	return false
 }
 
 func main() {
@@ -36,7 +104,13 @@ func main() {
 	if !exists {
 		log.Fatal("missing environment variable CONVERTER_SERVICE_PORT")
 	}
-	conn, err := grpc.Dial(fmt.Sprintf("converter:%s", converterPort), grpc.WithInsecure())
+	options := []grpc.DialOption{grpc.WithInsecure()}
+	if apiKey := os.Getenv("CONVERTER_API_KEY"); apiKey != "" {
+		options = append(options, grpc.WithPerRPCCredentials(apiKeyCredentials{key: apiKey}))
+	} else {
+		log.Println("CONVERTER_API_KEY is not set, calls will fail if the converter service requires API keys")
+	}
+	conn, err := grpc.Dial(fmt.Sprintf("converter:%s", converterPort), options...)
 	if err != nil {
 		fmt.Printf("Encountered error dialing %v", err)
 		log.Fatal("Failed to connect to the grpc service")
@@ -54,7 +128,19 @@ func main() {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, res)
+		c.JSON(http.StatusOK, queryResponseToJSON(res))
+	})
+	r.GET("/formats", func(c *gin.Context) {
+		res, err := client.ListSupportedFormats(c, &pb.ListSupportedFormatsRequest{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		formats := make([]gin.H, 0, len(res.Formats))
+		for _, format := range res.Formats {
+			formats = append(formats, supportedFormatToJSON(format))
+		}
+		c.JSON(http.StatusOK, gin.H{"formats": formats})
 	})
 	r.POST("/convert-file", func(c *gin.Context) {
 		var b body
@@ -64,21 +150,49 @@ func main() {
 		}
 		srcEncoding, errSrc := stringToEncoding(c.Query("src"))
 		destEncoding, errDst := stringToEncoding(c.Query("dest"))
-		if errSrc != nil || errDst != nil {
+		priority, errPriority := stringToPriority(c.Query("priority"))
+		timeout, errTimeout := strconv.ParseUint(c.DefaultQuery("timeout", "0"), 10, 32)
+		sampleRate, errSampleRate := strconv.ParseUint(c.DefaultQuery("sampleRate", "0"), 10, 32)
+		channels, errChannels := strconv.ParseUint(c.DefaultQuery("channels", "0"), 10, 32)
+		if errSrc != nil || errDst != nil || errPriority != nil || errTimeout != nil ||
+			errSampleRate != nil || errChannels != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid params"})
 			return
 		}
+		var header metadata.MD
 		res, err := client.ConvertFile(c, &pb.ConvertFileRequest{
 			SourceUrl: b.SourceUrl,
 			SourceEncoding: pb.Encoding(srcEncoding),
 			DestEncoding: pb.Encoding(destEncoding),
-		})
+			IdempotencyKey: c.GetHeader("Idempotency-Key"),
+			Priority: pb.Priority(priority),
+			TimeoutSeconds: uint32(timeout),
+			SampleRate: uint32(sampleRate),
+			Channels: uint32(channels),
+			CallbackUrl: b.CallbackUrl,
+			SourceHeaders: b.SourceHeaders,
+		}, grpc.Header(&header))
+		if status.Code(err) == codes.ResourceExhausted {
+			if retryAfter := header.Get("retry-after"); len(retryAfter) > 0 {
+				c.Header("Retry-After", retryAfter[0])
+			}
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": status.Convert(err).Message()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusAccepted, gin.H{"id": res.Id})
 	})
+	r.POST("/convert-file/:id/replay-webhooks", func(c *gin.Context) {
+		res, err := client.ReplayWebhooks(c, &pb.ReplayWebhooksRequest{Id: c.Param("id")})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"replayed": res.Replayed})
+	})
 	if err = r.Run(":4000"); err != nil {
 		log.Fatal("Failed to start")
 	}